@@ -14,7 +14,9 @@ import (
 	"k8s.io/client-go/rest"
 
 	"github.com/doyoubi/undermoon-operator/pkg/apis"
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
 	"github.com/doyoubi/undermoon-operator/pkg/controller"
+	"github.com/doyoubi/undermoon-operator/pkg/controller/undermoon"
 	"github.com/doyoubi/undermoon-operator/version"
 
 	"github.com/operator-framework/operator-sdk/pkg/k8sutil"
@@ -41,6 +43,13 @@ var (
 )
 var log = logf.Log.WithName("cmd")
 
+// Admission webhooks need TLS certificates so they are disabled by default.
+var (
+	enableWebhooks bool
+	webhookPort    int
+	webhookCertDir string
+)
+
 func printVersion() {
 	log.Info(fmt.Sprintf("Operator Version: %s", version.Version))
 	log.Info(fmt.Sprintf("Go Version: %s", runtime.Version()))
@@ -57,6 +66,14 @@ func main() {
 	// controller-runtime)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 
+	pflag.BoolVar(&enableWebhooks, "enable-webhooks", false, "Serve the admission webhooks of Undermoon")
+	pflag.IntVar(&webhookPort, "webhook-port", 9443, "The port the admission webhook server listens on")
+	pflag.StringVar(&webhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "The directory containing tls.crt and tls.key for the webhook server")
+
+	pflag.StringVar(&undermoonv1alpha1.DefaultUndermoonImage, "default-undermoon-image", undermoonv1alpha1.DefaultUndermoonImage, "The undermoon image used when undermoonImage is not specified")
+	pflag.StringVar(&undermoonv1alpha1.DefaultRedisImage, "default-redis-image", undermoonv1alpha1.DefaultRedisImage, "The Redis image used when redisImage is not specified")
+	pflag.StringVar(&undermoon.DefaultBackupUploaderImage, "backup-uploader-image", undermoon.DefaultBackupUploaderImage, "The image with the MinIO client used to upload backups to S3")
+
 	pflag.Parse()
 
 	// Use a zap logr.Logger implementation. If none of the zap
@@ -96,6 +113,8 @@ func main() {
 	options := manager.Options{
 		Namespace:          namespace,
 		MetricsBindAddress: fmt.Sprintf("%s:%d", metricsHost, metricsPort),
+		Port:               webhookPort,
+		CertDir:            webhookCertDir,
 	}
 
 	// Add support for MultiNamespace set in WATCH_NAMESPACE (e.g ns1,ns2)
@@ -128,6 +147,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Setup admission webhooks
+	if enableWebhooks {
+		if err := (&undermoonv1alpha1.Undermoon{}).SetupWebhookWithManager(mgr); err != nil {
+			log.Error(err, "Failed to setup webhooks")
+			os.Exit(1)
+		}
+	}
+
 	// Add the Metrics Service
 	addMetrics(ctx, cfg)
 
@@ -2,6 +2,7 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -21,22 +22,53 @@ type UndermoonSpec struct {
 	// +kubebuilder:validation:Minimum=1
 	ChunkNumber uint32 `json:"chunkNumber"`
 	// max_memory for each Redis instance in MBs.
+	// Changing it is applied to the running Redis by CONFIG SET.
+	// It can't be less than the used memory of any Redis.
 	// +kubebuilder:validation:Minimum=1
-	MaxMemory uint32 `json:"maxMemory"`
+	// +kubebuilder:default=32
+	// +optional
+	MaxMemory uint32 `json:"maxMemory,omitempty"`
 	// Port for the redis service.
 	// +kubebuilder:validation:Minimum=1
 	// +kubebuilder:validation:Maximum=65535
-	Port uint32 `json:"port"`
+	// +kubebuilder:default=5299
+	// +optional
+	Port uint32 `json:"port,omitempty"`
 	// Enable this to let the shards redirect the requests themselves so that the client does not need to support cluster mode.
-	ActiveRedirection bool `json:"activeRedirection"`
+	// +kubebuilder:default=false
+	// +optional
+	ActiveRedirection bool `json:"activeRedirection,omitempty"`
+	// Thread number of each server proxy.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=2
+	// +optional
+	ProxyThreads uint32 `json:"proxyThreads,omitempty"`
+	// Number of the brokers. One of them is the master and the others are the replicas.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=3
+	// +optional
+	BrokerNum uint32 `json:"brokerNum,omitempty"`
+	// Number of the coordinators.
 	// +kubebuilder:validation:Minimum=1
-	ProxyThreads uint32 `json:"proxyThreads"`
+	// +kubebuilder:default=3
+	// +optional
+	CoordinatorNum uint32 `json:"coordinatorNum,omitempty"`
+	// Tuning of the server proxies. Changing it upgrades the storage pods.
+	// +optional
+	ProxyConfig ProxyConfig `json:"proxyConfig"`
+	// Failure detection and migration settings of the brokers.
+	// +optional
+	BrokerConfig BrokerConfig `json:"brokerConfig"`
 
-	// +kubebuilder:validation:MinLength=1
-	UndermoonImage           string            `json:"undermoonImage"`
-	UndermoonImagePullPolicy corev1.PullPolicy `json:"undermoonImagePullPolicy"`
-	// +kubebuilder:validation:MinLength=1
-	RedisImage string `json:"redisImage"`
+	// Defaults to the image configured in the operator.
+	// +optional
+	UndermoonImage string `json:"undermoonImage,omitempty"`
+	// +kubebuilder:default=IfNotPresent
+	// +optional
+	UndermoonImagePullPolicy corev1.PullPolicy `json:"undermoonImagePullPolicy,omitempty"`
+	// Defaults to the image configured in the operator.
+	// +optional
+	RedisImage string `json:"redisImage,omitempty"`
 
 	// +optional
 	BrokerResources corev1.ResourceRequirements `json:"brokerResources"`
@@ -44,8 +76,328 @@ type UndermoonSpec struct {
 	CoordinatorResources corev1.ResourceRequirements `json:"coordinatorResources"`
 	// +optional
 	ProxyResources corev1.ResourceRequirements `json:"proxyResources"`
+	// The memory request defaults to a value derived from maxMemory.
 	// +optional
 	RedisResources corev1.ResourceRequirements `json:"redisResources"`
+	// Extra config of Redis such as `maxmemory-policy`, which defaults to `allkeys-lru`.
+	// Changing it is applied to the running Redis by CONFIG SET without restarting them.
+	// The config managed by the operator such as port, replication and maxmemory can't be set.
+	// +optional
+	RedisConfig map[string]string `json:"redisConfig,omitempty"`
+
+	// Scheduling and metadata of the pods of each component.
+	// Changing them upgrades the pods of the component.
+	// +optional
+	BrokerPod PodSettings `json:"brokerPod"`
+	// +optional
+	CoordinatorPod PodSettings `json:"coordinatorPod"`
+	// +optional
+	StoragePod PodSettings `json:"storagePod"`
+
+	// How the pods of the brokers, the coordinators and the storage are spread.
+	// Changing it upgrades the pods.
+	// +optional
+	Placement PlacementSpec `json:"placement"`
+
+	// How the storage pods are upgraded after the pod template is changed.
+	// +optional
+	UpgradeStrategy *UpgradeStrategy `json:"upgradeStrategy,omitempty"`
+
+	// Persist the Redis data to the persistent volumes.
+	// Redis does not persist any data when it's not specified.
+	// +optional
+	Persistence *PersistenceSpec `json:"persistence,omitempty"`
+
+	// Store the metadata file of the brokers in the persistent volumes
+	// so that the restarted brokers can recover the metadata.
+	// +optional
+	BrokerPersistence *BrokerPersistenceSpec `json:"brokerPersistence,omitempty"`
+
+	// Create the cluster from a directory containing the RDB files
+	// and the metadata snapshots of an UndermoonBackup.
+	// The cluster is created with the chunk number of the backup
+	// and then scaled to chunkNumber.
+	// +optional
+	RestoreFrom *BackupDestination `json:"restoreFrom,omitempty"`
+
+	// Require the clients to authenticate with the password in a Secret.
+	// The same password is used by Redis, the server proxies and the coordinators.
+	// +optional
+	Auth *AuthSpec `json:"auth,omitempty"`
+
+	// Enable TLS on the port of the server proxies.
+	// It can't be enabled or disabled after the cluster is created.
+	// +optional
+	TLS *TLSSpec `json:"tls,omitempty"`
+}
+
+// ProxyConfig defines the configuration of the server proxies.
+// The zero values are replaced by the defaults.
+type ProxyConfig struct {
+	// Value of RUST_LOG.
+	// +kubebuilder:default="undermoon=info,server_proxy=info"
+	// +optional
+	LogLevel string `json:"logLevel,omitempty"`
+	// Max number of the slow logs kept in each server proxy.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1024
+	// +optional
+	SlowlogLen uint32 `json:"slowlogLen,omitempty"`
+	// Requests slower than this in microseconds are logged. 0 logs every sampled request.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=10000
+	// +optional
+	SlowlogLogSlowerThan *int64 `json:"slowlogLogSlowerThan,omitempty"`
+	// Only 1 of every slowlogSampleRate requests is checked.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1000
+	// +optional
+	SlowlogSampleRate uint32 `json:"slowlogSampleRate,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=4096
+	// +optional
+	SessionChannelSize uint32 `json:"sessionChannelSize,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=4096
+	// +optional
+	BackendChannelSize uint32 `json:"backendChannelSize,omitempty"`
+	// Min time in nanoseconds to wait for batching the requests to Redis.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=20000
+	// +optional
+	BackendBatchMinTime uint64 `json:"backendBatchMinTime,omitempty"`
+	// Max time in nanoseconds to wait for batching the requests to Redis.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=400000
+	// +optional
+	BackendBatchMaxTime uint64 `json:"backendBatchMaxTime,omitempty"`
+	// Min time in nanoseconds to wait for batching the replies to the clients.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=20000
+	// +optional
+	SessionBatchMinTime uint64 `json:"sessionBatchMinTime,omitempty"`
+	// Max time in nanoseconds to wait for batching the replies to the clients.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=400000
+	// +optional
+	SessionBatchMaxTime uint64 `json:"sessionBatchMaxTime,omitempty"`
+}
+
+// BrokerConfig defines the configuration of the brokers.
+// The zero values are replaced by the defaults.
+type BrokerConfig struct {
+	// A server proxy is considered failed after not being reported alive for failureTTL seconds.
+	// It's applied to the running brokers without restarting them.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=60
+	// +optional
+	FailureTTL uint32 `json:"failureTTL,omitempty"`
+	// Number of the coordinators reporting the failure to fail over a server proxy.
+	// It should not be greater than coordinatorNum.
+	// Defaults to 2, or coordinatorNum if it's less than 2.
+	// It's applied to the running brokers without restarting them.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	FailureQuorum uint32 `json:"failureQuorum,omitempty"`
+	// Max number of the slot ranges migrating at the same time for each server proxy.
+	// It's applied to the running brokers without restarting them.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=2
+	// +optional
+	MigrationLimit uint32 `json:"migrationLimit,omitempty"`
+	// Interval in seconds for the replica brokers to sync the metadata from the master.
+	// Changing it restarts the brokers.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=5
+	// +optional
+	SyncMetaInterval uint32 `json:"syncMetaInterval,omitempty"`
+	// Interval in seconds to save the metadata to the file.
+	// Changing it restarts the brokers.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=10
+	// +optional
+	UpdateMetaFileInterval uint32 `json:"updateMetaFileInterval,omitempty"`
+}
+
+// TLSSpec defines the certificate of the server proxies.
+// The CA certificate is copied to the ConfigMap `<name>-tls-ca` for the clients.
+type TLSSpec struct {
+	// Name of the Secret containing `tls.crt`, `tls.key` and `ca.crt`.
+	// The operator generates a self-signed CA and a certificate
+	// in the Secret `<name>-tls` if it's not specified.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// DefaultAuthSecretKey is the default key of the password in the Secret.
+const DefaultAuthSecretKey = "password"
+
+// AuthSpec defines the password authentication of the cluster.
+type AuthSpec struct {
+	SecretRef AuthSecretReference `json:"secretRef"`
+}
+
+// AuthSecretReference selects the password in a Secret in the same namespace.
+type AuthSecretReference struct {
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// Defaults to `password`.
+	// +kubebuilder:default=password
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// BrokerPersistenceSpec defines the persistent volumes of the brokers.
+type BrokerPersistenceSpec struct {
+	// Uses the default storage class when it's not specified.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// Size of the persistent volume of each broker.
+	Size resource.Quantity `json:"size"`
+}
+
+// PersistenceMode is how Redis persists the data.
+// +kubebuilder:validation:Enum=RDB;AOF;RDBAndAOF
+type PersistenceMode string
+
+const (
+	// RDBPersistenceMode only saves the RDB snapshots.
+	RDBPersistenceMode PersistenceMode = "RDB"
+	// AOFPersistenceMode only enables the append only file.
+	AOFPersistenceMode PersistenceMode = "AOF"
+	// RDBAndAOFPersistenceMode enables both of them.
+	RDBAndAOFPersistenceMode PersistenceMode = "RDBAndAOF"
+)
+
+// AppendFsyncPolicy is the `appendfsync` config of Redis.
+// +kubebuilder:validation:Enum=always;everysec;no
+type AppendFsyncPolicy string
+
+const (
+	// AppendFsyncAlways calls fsync after every write.
+	AppendFsyncAlways AppendFsyncPolicy = "always"
+	// AppendFsyncEverySec calls fsync every second.
+	AppendFsyncEverySec AppendFsyncPolicy = "everysec"
+	// AppendFsyncNo lets the operating system flush the data.
+	AppendFsyncNo AppendFsyncPolicy = "no"
+)
+
+// PersistenceSpec defines the persistent volumes of the storage pods.
+// The two Redis inside a storage pod share the same volume with different directories.
+type PersistenceSpec struct {
+	// Uses the default storage class when it's not specified.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// Size of the persistent volume of each storage pod.
+	Size resource.Quantity `json:"size"`
+	// +kubebuilder:default=RDB
+	// +optional
+	Mode PersistenceMode `json:"mode,omitempty"`
+	// Only used when the append only file is enabled.
+	// +kubebuilder:default=everysec
+	// +optional
+	AppendFsync AppendFsyncPolicy `json:"appendFsync,omitempty"`
+}
+
+// PodSettings defines the scheduling and the metadata of the pods of a component.
+type PodSettings struct {
+	// Extra labels of the pods. The labels used by the operator can't be overridden.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// Defaults to the default service account of the namespace.
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+}
+
+// AntiAffinityMode is whether the pod anti-affinity is required or preferred.
+// +kubebuilder:validation:Enum=Required;Preferred
+type AntiAffinityMode string
+
+const (
+	// RequiredAntiAffinity does not schedule two pods of the same component to the same topology domain.
+	RequiredAntiAffinity AntiAffinityMode = "Required"
+	// PreferredAntiAffinity tries to avoid scheduling two pods of the same component to the same topology domain.
+	PreferredAntiAffinity AntiAffinityMode = "Preferred"
+)
+
+// DefaultAntiAffinityTopologyKey spreads the pods across the nodes.
+const DefaultAntiAffinityTopologyKey = "kubernetes.io/hostname"
+
+// PlacementSpec defines how the pods of each component are spread.
+// It's applied to the brokers, the coordinators and the storage pods separately.
+type PlacementSpec struct {
+	// Topology key of the pod anti-affinity between the pods of the same component,
+	// e.g. `kubernetes.io/hostname` or `topology.kubernetes.io/zone`.
+	// +kubebuilder:default=kubernetes.io/hostname
+	// +optional
+	AntiAffinityTopologyKey string `json:"antiAffinityTopologyKey,omitempty"`
+	// Use Required to make sure the pods of the same component never share a topology domain.
+	// Then the pods can't be scheduled if there are not enough domains.
+	// +kubebuilder:default=Preferred
+	// +optional
+	AntiAffinityMode AntiAffinityMode `json:"antiAffinityMode,omitempty"`
+	// The label selector of each constraint is set to the pods of the same component.
+	// +optional
+	TopologySpreadConstraints []TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+}
+
+// TopologySpreadConstraint spreads the pods of each component evenly across the topology domains.
+type TopologySpreadConstraint struct {
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +optional
+	MaxSkew int32 `json:"maxSkew,omitempty"`
+	// +kubebuilder:validation:MinLength=1
+	TopologyKey string `json:"topologyKey"`
+	// DoNotSchedule or ScheduleAnyway.
+	// +kubebuilder:validation:Enum=DoNotSchedule;ScheduleAnyway
+	// +kubebuilder:default=ScheduleAnyway
+	// +optional
+	WhenUnsatisfiable corev1.UnsatisfiableConstraintAction `json:"whenUnsatisfiable,omitempty"`
+}
+
+// UpgradeStrategyType is the type of the upgrade strategy of the storage pods.
+// +kubebuilder:validation:Enum=Rolling;Canary
+type UpgradeStrategyType string
+
+const (
+	// RollingUpgradeStrategyType upgrades the storage pods one by one.
+	RollingUpgradeStrategyType UpgradeStrategyType = "Rolling"
+	// CanaryUpgradeStrategyType upgrades one chunk first and only continues
+	// if the cluster stays healthy during the soak time.
+	CanaryUpgradeStrategyType UpgradeStrategyType = "Canary"
+)
+
+// DefaultCanarySoakSeconds is the default time to observe the canary chunk.
+const DefaultCanarySoakSeconds = 300
+
+// UpgradeStrategy defines how to upgrade the storage pods.
+type UpgradeStrategy struct {
+	// +kubebuilder:default=Rolling
+	// +optional
+	Type UpgradeStrategyType `json:"type,omitempty"`
+	// Only used by the Canary strategy.
+	// +optional
+	Canary *CanaryUpgradeStrategy `json:"canary,omitempty"`
+}
+
+// CanaryUpgradeStrategy defines the canary phase of the upgrade.
+type CanaryUpgradeStrategy struct {
+	// How long the upgraded chunk is checked before upgrading the rest of the pods.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=300
+	// +optional
+	SoakSeconds int32 `json:"soakSeconds,omitempty"`
 }
 
 // UndermoonStatus defines the observed state of Undermoon
@@ -55,8 +407,239 @@ type UndermoonStatus struct {
 	// Add custom validation using kubebuilder tags: https://book-v1.book.kubebuilder.io/beyond_basics/generating_crd.html
 
 	// Master broker address pointing to the master broker.
-	// +kubebuilder:validation:MinLength=1
-	MasterBrokerAddress string `json:"masterBrokerAddress"`
+	// +optional
+	MasterBrokerAddress string `json:"masterBrokerAddress,omitempty"`
+	// The generation observed by the operator.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Node number of the cluster reported by the broker.
+	// +optional
+	NodeNumber int `json:"nodeNumber,omitempty"`
+	// Node number of the cluster owning slots reported by the broker.
+	// +optional
+	NodeNumberWithSlots int `json:"nodeNumberWithSlots,omitempty"`
+	// Whether the broker is migrating slots of this cluster.
+	// +optional
+	IsMigrating bool `json:"isMigrating,omitempty"`
+	// Chunk number serving the slots.
+	// +optional
+	CurrentChunkNumber uint32 `json:"currentChunkNumber,omitempty"`
+	// Chunk number specified in the spec.
+	// +optional
+	DesiredChunkNumber uint32 `json:"desiredChunkNumber,omitempty"`
+	// Global epoch of the master broker.
+	// +optional
+	GlobalEpoch int64 `json:"globalEpoch,omitempty"`
+	// Number of server proxies which have received the metadata and are ready for the clients.
+	// +optional
+	ReadyProxyNumber int `json:"readyProxyNumber,omitempty"`
+	// Progress of the rolling upgrade of the storage pods.
+	// +optional
+	StorageUpgrade *StorageUpgradeStatus `json:"storageUpgrade,omitempty"`
+	// Result of the latest UndermoonBackups of this cluster.
+	// +optional
+	Backup *BackupRecord `json:"backup,omitempty"`
+	// Progress of restoring the cluster from restoreFrom.
+	// +optional
+	Restore *RestoreStatus `json:"restore,omitempty"`
+	// Progress of rotating the password after the Secret in auth is changed.
+	// +optional
+	Auth *AuthStatus `json:"auth,omitempty"`
+	// The maxMemory in MBs applied to the running Redis.
+	// +optional
+	MaxMemory uint32 `json:"maxMemory,omitempty"`
+	// Hash of the redisConfig applied to the running Redis.
+	// +optional
+	RedisConfigHash string `json:"redisConfigHash,omitempty"`
+	// The undermoon image used when undermoonImage is not specified.
+	// It's resolved from the operator on the first reconciliation
+	// so that changing the default images of the operator won't restart the existing clusters.
+	// +optional
+	DefaultUndermoonImage string `json:"defaultUndermoonImage,omitempty"`
+	// The Redis image used when redisImage is not specified.
+	// +optional
+	DefaultRedisImage string `json:"defaultRedisImage,omitempty"`
+	// The fields of the spec which can't be changed after the cluster is created.
+	// They are recorded by the operator since the validating webhook may not be enabled.
+	// +optional
+	AppliedImmutableSpec *ImmutableSpec `json:"appliedImmutableSpec,omitempty"`
+	// Conditions of the cluster such as Ready, Progressing and Migrating.
+	// +optional
+	Conditions []UndermoonCondition `json:"conditions,omitempty"`
+}
+
+// ImmutableSpec is the part of the spec used to create the cluster
+// which can't be changed afterwards.
+type ImmutableSpec struct {
+	ClusterName string `json:"clusterName"`
+	Port        uint32 `json:"port"`
+	// +optional
+	Persistence *PersistenceSpec `json:"persistence,omitempty"`
+	// +optional
+	BrokerPersistence *BrokerPersistenceSpec `json:"brokerPersistence,omitempty"`
+	// +optional
+	RestoreFrom *BackupDestination `json:"restoreFrom,omitempty"`
+	// +optional
+	Auth *AuthSpec `json:"auth,omitempty"`
+	// +optional
+	TLS *TLSSpec `json:"tls,omitempty"`
+}
+
+// StorageUpgradePhase is the phase of upgrading a single storage pod.
+type StorageUpgradePhase string
+
+const (
+	// StorageUpgradeFailingOver means the masters in the pod are being failed over to their peers.
+	StorageUpgradeFailingOver StorageUpgradePhase = "FailingOver"
+	// StorageUpgradeDeletingPod means the pod is going to be deleted and recreated with the new template.
+	StorageUpgradeDeletingPod StorageUpgradePhase = "DeletingPod"
+	// StorageUpgradeWaitingForPod means the recreated pod is not ready or not registered yet.
+	StorageUpgradeWaitingForPod StorageUpgradePhase = "WaitingForPod"
+	// StorageUpgradeSoaking means the canary chunk has been upgraded and is being checked.
+	StorageUpgradeSoaking StorageUpgradePhase = "Soaking"
+	// StorageUpgradeHalted means the canary chunk failed the health check.
+	// The upgrade will not continue until the pod template is changed again,
+	// or the `undermoon.operator.api/resume-upgrade` annotation is set to the target revision.
+	StorageUpgradeHalted StorageUpgradePhase = "Halted"
+	// StorageUpgradeCompleted means all the storage pods have been upgraded.
+	StorageUpgradeCompleted StorageUpgradePhase = "Completed"
+)
+
+// StorageUpgradeStatus records the progress of the rolling upgrade of the storage pods.
+type StorageUpgradeStatus struct {
+	// The StatefulSet revision the pods are upgrading to.
+	TargetRevision string `json:"targetRevision"`
+	// The pod being upgraded.
+	// +optional
+	CurrentPod string `json:"currentPod,omitempty"`
+	// +optional
+	Phase StorageUpgradePhase `json:"phase,omitempty"`
+	// When the operator started waiting for a replica to connect to the masters of the current pod.
+	// +optional
+	ReplicaWaitStartTime *metav1.Time `json:"replicaWaitStartTime,omitempty"`
+	// Number of pods running the target revision.
+	UpdatedPods int32 `json:"updatedPods"`
+	TotalPods   int32 `json:"totalPods"`
+	// The pods upgraded in the canary phase.
+	// +optional
+	CanaryPods []string `json:"canaryPods,omitempty"`
+	// When the canary chunk started soaking.
+	// +optional
+	CanaryStartTime *metav1.Time `json:"canaryStartTime,omitempty"`
+	// Whether the canary chunk passed the health check.
+	// +optional
+	CanaryPassed bool `json:"canaryPassed,omitempty"`
+	// Why the upgrade is halted. Set the `undermoon.operator.api/resume-upgrade` annotation
+	// to the target revision to resume it.
+	// +optional
+	HaltReason string `json:"haltReason,omitempty"`
+}
+
+// RestorePhase is the phase of restoring the cluster from a backup.
+type RestorePhase string
+
+const (
+	// RestoreLoadingMetadata means the metadata snapshots are being read from the backup.
+	RestoreLoadingMetadata RestorePhase = "LoadingMetadata"
+	// RestoreLoadingData means the storage pods are loading the RDB files.
+	RestoreLoadingData RestorePhase = "LoadingData"
+	// RestoreCompleted means the broker metadata has been restored.
+	RestoreCompleted RestorePhase = "Completed"
+	// RestoreFailed means the backup can't be restored. Recreate the Undermoon object to retry.
+	RestoreFailed RestorePhase = "Failed"
+)
+
+// RestoreStatus records the progress of restoring the cluster from a backup.
+type RestoreStatus struct {
+	// +optional
+	Phase RestorePhase `json:"phase,omitempty"`
+	// Chunk number of the backup.
+	// +optional
+	ChunkNumber uint32 `json:"chunkNumber,omitempty"`
+	// Epoch of the broker metadata snapshot.
+	// +optional
+	Epoch int64 `json:"epoch,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// PasswordRotationPhase is the phase of rotating the password.
+type PasswordRotationPhase string
+
+const (
+	// PasswordRotating means the new password is being applied to the running cluster.
+	PasswordRotating PasswordRotationPhase = "Rotating"
+	// PasswordRotationCompleted means the whole cluster is using the password in the Secret.
+	PasswordRotationCompleted PasswordRotationPhase = "Completed"
+)
+
+// AuthStatus records the password rotation.
+type AuthStatus struct {
+	// +optional
+	Phase PasswordRotationPhase `json:"phase,omitempty"`
+	// The resourceVersion of the Secret when the password was applied.
+	// +optional
+	SecretResourceVersion string `json:"secretResourceVersion,omitempty"`
+	// Number of Redis using the new password in the current rotation.
+	// +optional
+	RotatedRedis int32 `json:"rotatedRedis,omitempty"`
+	// Number of Redis in the current rotation.
+	// +optional
+	TotalRedis int32 `json:"totalRedis,omitempty"`
+	// When the current rotation started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// When the latest rotation completed.
+	// +optional
+	LastRotationTime *metav1.Time `json:"lastRotationTime,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// BackupRecord records the latest finished backups.
+type BackupRecord struct {
+	// +optional
+	LastSuccessfulBackup string `json:"lastSuccessfulBackup,omitempty"`
+	// +optional
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// +optional
+	LastFailedBackup string `json:"lastFailedBackup,omitempty"`
+	// +optional
+	LastFailedTime *metav1.Time `json:"lastFailedTime,omitempty"`
+}
+
+// UndermoonConditionType is the type of the Undermoon condition.
+type UndermoonConditionType string
+
+const (
+	// UndermoonReady means the cluster is serving with the desired node number.
+	UndermoonReady UndermoonConditionType = "Ready"
+	// UndermoonProgressing means the operator is still working on reaching the desired state.
+	UndermoonProgressing UndermoonConditionType = "Progressing"
+	// UndermoonMigrating means the slots are being migrated between the chunks.
+	UndermoonMigrating UndermoonConditionType = "Migrating"
+	// UndermoonDegraded means the operator failed to reconcile the cluster.
+	UndermoonDegraded UndermoonConditionType = "Degraded"
+	// UndermoonBrokerAvailable means the memory broker is available.
+	UndermoonBrokerAvailable UndermoonConditionType = "BrokerAvailable"
+	// UndermoonStorageAvailable means all the server proxies and Redis are ready.
+	UndermoonStorageAvailable UndermoonConditionType = "StorageAvailable"
+)
+
+// UndermoonCondition describes the state of the Undermoon cluster at a certain point.
+type UndermoonCondition struct {
+	Type UndermoonConditionType `json:"type"`
+	// One of True, False and Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+	// The last time the condition transitioned from one status to another.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// The reason for the last transition in CamelCase.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// A human readable message indicating details about the transition.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -64,6 +647,12 @@ type UndermoonStatus struct {
 // Undermoon is the Schema for the undermoons API
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:path=undermoons,scope=Namespaced
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Chunks",type="integer",JSONPath=".status.currentChunkNumber"
+// +kubebuilder:printcolumn:name="Desired",type="integer",JSONPath=".spec.chunkNumber"
+// +kubebuilder:printcolumn:name="Migrating",type="boolean",JSONPath=".status.isMigrating"
+// +kubebuilder:printcolumn:name="Epoch",type="integer",JSONPath=".status.globalEpoch"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 type Undermoon struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
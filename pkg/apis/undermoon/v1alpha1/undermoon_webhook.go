@@ -0,0 +1,718 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// DefaultServerProxyPort is the port for clients to connect to.
+const DefaultServerProxyPort = 5299
+
+// DefaultProxyThreads is the default thread number of the server proxy.
+const DefaultProxyThreads = 2
+
+// Defaults of ProxyConfig, the same as the ones of undermoon.
+const (
+	DefaultProxyLogLevel             = "undermoon=info,server_proxy=info"
+	DefaultProxySlowlogLen           = 1024
+	DefaultProxySlowlogLogSlowerThan = 10000
+	DefaultProxySlowlogSampleRate    = 1000
+	DefaultProxyChannelSize          = 4096
+	DefaultProxyBatchMinTime         = 20000
+	DefaultProxyBatchMaxTime         = 400000
+)
+
+// DefaultBrokerNum is the default number of the brokers.
+const DefaultBrokerNum = 3
+
+// DefaultCoordinatorNum is the default number of the coordinators.
+const DefaultCoordinatorNum = 3
+
+// Defaults of BrokerConfig, the same as the ones of undermoon.
+const (
+	DefaultBrokerFailureTTL             = 60
+	DefaultBrokerFailureQuorum          = 2
+	DefaultBrokerMigrationLimit         = 2
+	DefaultBrokerSyncMetaInterval       = 5
+	DefaultBrokerUpdateMetaFileInterval = 10
+)
+
+// DefaultMaxMemory is the default maxmemory of each Redis in MBs.
+const DefaultMaxMemory = 32
+
+// DefaultRedisMaxMemoryPolicy is used when maxmemory-policy is not set in redisConfig.
+const DefaultRedisMaxMemoryPolicy = "allkeys-lru"
+
+// DefaultUndermoonImage and DefaultRedisImage are used when the images are not specified.
+// They can be overridden by the operator command line flags.
+var (
+	DefaultUndermoonImage = "doyoubi/undermoon:0.3.1-buster"
+	DefaultRedisImage     = "redis:5.0.9"
+)
+
+// These ports are used by the Redis containers inside the storage pods
+// and can't be used by the server proxy.
+var reservedStoragePorts = map[uint32]bool{
+	7001: true,
+	7002: true,
+}
+
+// These Redis config are set by the operator and can't be set in redisConfig.
+var managedRedisConfig = map[string]bool{
+	"port":                  true,
+	"maxmemory":             true,
+	"slaveof":               true,
+	"replicaof":             true,
+	"slave-announce-ip":     true,
+	"slave-announce-port":   true,
+	"replica-announce-ip":   true,
+	"replica-announce-port": true,
+	"masterauth":            true,
+	"requirepass":           true,
+	"dir":                   true,
+	"dbfilename":            true,
+	"save":                  true,
+	"appendonly":            true,
+	"appendfsync":           true,
+	"appendfilename":        true,
+	"cluster-enabled":       true,
+	"include":               true,
+	"rename-command":        true,
+}
+
+// IsManagedRedisConfig returns true if the Redis config is set by the operator.
+func IsManagedRedisConfig(name string) bool {
+	return managedRedisConfig[strings.ToLower(name)]
+}
+
+var redisConfigNameRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// These labels are used by the operator to select the pods
+// and can't be set in the pod settings.
+var reservedPodLabels = []string{"undermoonService", "undermoonName", "undermoonClusterName"}
+
+// Simplified from the docker reference grammar:
+// [registry[:port]/]name[:tag][@digest]
+var imageRegexp = regexp.MustCompile(
+	`^([a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?(:[0-9]+)?/)?` +
+		`[a-z0-9]+([._-]+[a-z0-9]+)*(/[a-z0-9]+([._-]+[a-z0-9]+)*)*` +
+		`(:[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?` +
+		`(@sha256:[a-f0-9]{64})?$`,
+)
+
+// SetupWebhookWithManager registers the admission webhooks of Undermoon.
+func (cr *Undermoon) SetupWebhookWithManager(mgr manager.Manager) error {
+	return builder.WebhookManagedBy(mgr).For(cr).Complete()
+}
+
+var _ webhook.Defaulter = &Undermoon{}
+
+// Default implements webhook.Defaulter.
+func (cr *Undermoon) Default() {
+	spec := &cr.Spec
+	if spec.Port == 0 {
+		spec.Port = DefaultServerProxyPort
+	}
+	if spec.ProxyThreads == 0 {
+		spec.ProxyThreads = DefaultProxyThreads
+	}
+	if spec.MaxMemory == 0 {
+		spec.MaxMemory = DefaultMaxMemory
+	}
+	if spec.BrokerNum == 0 {
+		spec.BrokerNum = DefaultBrokerNum
+	}
+	if spec.CoordinatorNum == 0 {
+		spec.CoordinatorNum = DefaultCoordinatorNum
+	}
+	// Default runs on updates too. Use the default images pinned in the status
+	// so that the existing clusters won't be upgraded with the operator.
+	if spec.UndermoonImage == "" {
+		spec.UndermoonImage = cr.Status.DefaultUndermoonImage
+	}
+	if spec.UndermoonImage == "" {
+		spec.UndermoonImage = DefaultUndermoonImage
+	}
+	if spec.UndermoonImagePullPolicy == "" {
+		spec.UndermoonImagePullPolicy = corev1.PullIfNotPresent
+	}
+	if spec.RedisImage == "" {
+		spec.RedisImage = cr.Status.DefaultRedisImage
+	}
+	if spec.RedisImage == "" {
+		spec.RedisImage = DefaultRedisImage
+	}
+	if spec.RedisConfig == nil {
+		spec.RedisConfig = map[string]string{}
+	}
+	if _, ok := spec.RedisConfig["maxmemory-policy"]; !ok {
+		spec.RedisConfig["maxmemory-policy"] = DefaultRedisMaxMemoryPolicy
+	}
+	defaultProxyConfig(&spec.ProxyConfig)
+	defaultBrokerConfig(&spec.BrokerConfig, spec.CoordinatorNum)
+	defaultPlacement(&spec.Placement)
+	defaultUpgradeStrategy(spec.UpgradeStrategy)
+	defaultPersistence(spec.Persistence)
+	defaultAuth(spec.Auth)
+}
+
+func defaultProxyConfig(config *ProxyConfig) {
+	if config.LogLevel == "" {
+		config.LogLevel = DefaultProxyLogLevel
+	}
+	if config.SlowlogLen == 0 {
+		config.SlowlogLen = DefaultProxySlowlogLen
+	}
+	if config.SlowlogLogSlowerThan == nil {
+		slowerThan := int64(DefaultProxySlowlogLogSlowerThan)
+		config.SlowlogLogSlowerThan = &slowerThan
+	}
+	if config.SlowlogSampleRate == 0 {
+		config.SlowlogSampleRate = DefaultProxySlowlogSampleRate
+	}
+	if config.SessionChannelSize == 0 {
+		config.SessionChannelSize = DefaultProxyChannelSize
+	}
+	if config.BackendChannelSize == 0 {
+		config.BackendChannelSize = DefaultProxyChannelSize
+	}
+	if config.BackendBatchMinTime == 0 {
+		config.BackendBatchMinTime = DefaultProxyBatchMinTime
+	}
+	if config.BackendBatchMaxTime == 0 {
+		config.BackendBatchMaxTime = DefaultProxyBatchMaxTime
+	}
+	if config.SessionBatchMinTime == 0 {
+		config.SessionBatchMinTime = DefaultProxyBatchMinTime
+	}
+	if config.SessionBatchMaxTime == 0 {
+		config.SessionBatchMaxTime = DefaultProxyBatchMaxTime
+	}
+}
+
+func defaultBrokerConfig(config *BrokerConfig, coordinatorNum uint32) {
+	if config.FailureTTL == 0 {
+		config.FailureTTL = DefaultBrokerFailureTTL
+	}
+	if config.FailureQuorum == 0 {
+		config.FailureQuorum = DefaultBrokerFailureQuorum
+		if config.FailureQuorum > coordinatorNum {
+			config.FailureQuorum = coordinatorNum
+		}
+	}
+	if config.MigrationLimit == 0 {
+		config.MigrationLimit = DefaultBrokerMigrationLimit
+	}
+	if config.SyncMetaInterval == 0 {
+		config.SyncMetaInterval = DefaultBrokerSyncMetaInterval
+	}
+	if config.UpdateMetaFileInterval == 0 {
+		config.UpdateMetaFileInterval = DefaultBrokerUpdateMetaFileInterval
+	}
+}
+
+func defaultAuth(auth *AuthSpec) {
+	if auth == nil {
+		return
+	}
+	if auth.SecretRef.Key == "" {
+		auth.SecretRef.Key = DefaultAuthSecretKey
+	}
+}
+
+func defaultPersistence(persistence *PersistenceSpec) {
+	if persistence == nil {
+		return
+	}
+	if persistence.Mode == "" {
+		persistence.Mode = RDBPersistenceMode
+	}
+	if persistence.AppendFsync == "" {
+		persistence.AppendFsync = AppendFsyncEverySec
+	}
+}
+
+func defaultPlacement(placement *PlacementSpec) {
+	if placement.AntiAffinityTopologyKey == "" {
+		placement.AntiAffinityTopologyKey = DefaultAntiAffinityTopologyKey
+	}
+	if placement.AntiAffinityMode == "" {
+		placement.AntiAffinityMode = PreferredAntiAffinity
+	}
+	for i := range placement.TopologySpreadConstraints {
+		constraint := &placement.TopologySpreadConstraints[i]
+		if constraint.MaxSkew == 0 {
+			constraint.MaxSkew = 1
+		}
+		if constraint.WhenUnsatisfiable == "" {
+			constraint.WhenUnsatisfiable = corev1.ScheduleAnyway
+		}
+	}
+}
+
+func defaultUpgradeStrategy(strategy *UpgradeStrategy) {
+	if strategy == nil {
+		return
+	}
+	if strategy.Type == "" {
+		strategy.Type = RollingUpgradeStrategyType
+	}
+	if strategy.Type == CanaryUpgradeStrategyType && strategy.Canary == nil {
+		strategy.Canary = &CanaryUpgradeStrategy{}
+	}
+	if strategy.Canary != nil && strategy.Canary.SoakSeconds == 0 {
+		strategy.Canary.SoakSeconds = DefaultCanarySoakSeconds
+	}
+}
+
+var _ webhook.Validator = &Undermoon{}
+
+// ValidateCreate implements webhook.Validator.
+func (cr *Undermoon) ValidateCreate() error {
+	return cr.ValidateSpec()
+}
+
+// ValidateUpdate implements webhook.Validator.
+func (cr *Undermoon) ValidateUpdate(old runtime.Object) error {
+	oldUndermoon, ok := old.(*Undermoon)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected an Undermoon object but got %T", old))
+	}
+
+	// The object might be created before the defaulting webhook is enabled.
+	oldUndermoon = oldUndermoon.DeepCopy()
+	oldUndermoon.Default()
+
+	errs := cr.validateSpec()
+	errs = append(errs, cr.validateSpecChange(oldUndermoon)...)
+	return cr.toInvalidError(errs)
+}
+
+// ValidateDelete implements webhook.Validator.
+func (cr *Undermoon) ValidateDelete() error {
+	return nil
+}
+
+// ValidateSpec checks the spec of the object itself.
+// It's also used by the operator since the validating webhook may not be enabled.
+func (cr *Undermoon) ValidateSpec() error {
+	return cr.toInvalidError(cr.validateSpec())
+}
+
+func (cr *Undermoon) toInvalidError(errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	gk := schema.GroupKind{Group: SchemeGroupVersion.Group, Kind: "Undermoon"}
+	return apierrors.NewInvalid(gk, cr.ObjectMeta.Name, errs)
+}
+
+func (cr *Undermoon) validateSpec() field.ErrorList {
+	errs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+	spec := &cr.Spec
+
+	if len(spec.ClusterName) == 0 || len(spec.ClusterName) > 30 {
+		errs = append(errs, field.Invalid(specPath.Child("clusterName"), spec.ClusterName, "should be 1 to 30 characters"))
+	}
+	if spec.ChunkNumber < 1 {
+		errs = append(errs, field.Invalid(specPath.Child("chunkNumber"), spec.ChunkNumber, "should be at least 1"))
+	}
+	if spec.MaxMemory < 1 {
+		errs = append(errs, field.Invalid(specPath.Child("maxMemory"), spec.MaxMemory, "should be at least 1 MB"))
+	} else if limit, ok := spec.RedisResources.Limits[corev1.ResourceMemory]; ok && int64(spec.MaxMemory)*1024*1024 >= limit.Value() {
+		errs = append(errs, field.Invalid(
+			specPath.Child("maxMemory"),
+			spec.MaxMemory,
+			fmt.Sprintf("should be less than the memory limit %s of redisResources", limit.String()),
+		))
+	}
+	if spec.Port < 1 || spec.Port > 65535 {
+		errs = append(errs, field.Invalid(specPath.Child("port"), spec.Port, "should be between 1 and 65535"))
+	} else if reservedStoragePorts[spec.Port] {
+		errs = append(errs, field.Invalid(specPath.Child("port"), spec.Port, "is reserved for the Redis inside the storage pods"))
+	}
+	if spec.ProxyThreads < 1 {
+		errs = append(errs, field.Invalid(specPath.Child("proxyThreads"), spec.ProxyThreads, "should be at least 1"))
+	}
+
+	errs = append(errs, validateImage(specPath.Child("undermoonImage"), spec.UndermoonImage)...)
+	errs = append(errs, validateImage(specPath.Child("redisImage"), spec.RedisImage)...)
+	switch spec.UndermoonImagePullPolicy {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		errs = append(errs, field.NotSupported(
+			specPath.Child("undermoonImagePullPolicy"),
+			spec.UndermoonImagePullPolicy,
+			[]string{string(corev1.PullAlways), string(corev1.PullIfNotPresent), string(corev1.PullNever)},
+		))
+	}
+
+	errs = append(errs, validateResources(specPath.Child("brokerResources"), &spec.BrokerResources)...)
+	errs = append(errs, validateResources(specPath.Child("coordinatorResources"), &spec.CoordinatorResources)...)
+	errs = append(errs, validateResources(specPath.Child("proxyResources"), &spec.ProxyResources)...)
+	errs = append(errs, validateResources(specPath.Child("redisResources"), &spec.RedisResources)...)
+	errs = append(errs, validateRedisConfig(specPath.Child("redisConfig"), spec.RedisConfig)...)
+	errs = append(errs, validateProxyConfig(specPath.Child("proxyConfig"), &spec.ProxyConfig)...)
+	if spec.BrokerNum < 1 {
+		errs = append(errs, field.Invalid(specPath.Child("brokerNum"), spec.BrokerNum, "should be at least 1"))
+	}
+	if spec.CoordinatorNum < 1 {
+		errs = append(errs, field.Invalid(specPath.Child("coordinatorNum"), spec.CoordinatorNum, "should be at least 1"))
+	}
+	errs = append(errs, validateBrokerConfig(specPath.Child("brokerConfig"), &spec.BrokerConfig, spec.CoordinatorNum)...)
+	errs = append(errs, validatePodSettings(specPath.Child("brokerPod"), &spec.BrokerPod)...)
+	errs = append(errs, validatePodSettings(specPath.Child("coordinatorPod"), &spec.CoordinatorPod)...)
+	errs = append(errs, validatePodSettings(specPath.Child("storagePod"), &spec.StoragePod)...)
+	errs = append(errs, validatePlacement(specPath.Child("placement"), &spec.Placement)...)
+	errs = append(errs, validateUpgradeStrategy(specPath.Child("upgradeStrategy"), spec.UpgradeStrategy)...)
+	errs = append(errs, validatePersistence(specPath.Child("persistence"), spec.Persistence)...)
+	if spec.BrokerPersistence != nil && spec.BrokerPersistence.Size.Sign() <= 0 {
+		errs = append(errs, field.Invalid(
+			specPath.Child("brokerPersistence", "size"),
+			spec.BrokerPersistence.Size.String(),
+			"should be positive",
+		))
+	}
+	errs = append(errs, validateRestoreFrom(specPath.Child("restoreFrom"), spec.RestoreFrom, spec.Persistence)...)
+	if spec.Auth != nil && len(spec.Auth.SecretRef.Name) == 0 {
+		errs = append(errs, field.Required(specPath.Child("auth", "secretRef", "name"), "secret name should be specified"))
+	}
+
+	return errs
+}
+
+func (cr *Undermoon) validateSpecChange(old *Undermoon) field.ErrorList {
+	errs := cr.validateImmutableSpec(old.GenImmutableSpec())
+	specPath := field.NewPath("spec")
+
+	if cr.Spec.ChunkNumber != old.Spec.ChunkNumber && old.Status.IsMigrating {
+		errs = append(errs, field.Forbidden(
+			specPath.Child("chunkNumber"),
+			"can't be modified while the broker is migrating slots, try again after the migration is done",
+		))
+	}
+
+	return errs
+}
+
+// GenImmutableSpec returns the fields of the spec which can't be changed after the cluster is created.
+func (cr *Undermoon) GenImmutableSpec() *ImmutableSpec {
+	spec := cr.Spec.DeepCopy()
+	return &ImmutableSpec{
+		ClusterName:       spec.ClusterName,
+		Port:              spec.Port,
+		Persistence:       spec.Persistence,
+		BrokerPersistence: spec.BrokerPersistence,
+		RestoreFrom:       spec.RestoreFrom,
+		Auth:              spec.Auth,
+		TLS:               spec.TLS,
+	}
+}
+
+// ValidateImmutableSpec checks whether the spec changes the fields used to create the cluster.
+// It's used by the operator with the fields recorded in the status
+// since the validating webhook may not be enabled.
+func (cr *Undermoon) ValidateImmutableSpec(applied *ImmutableSpec) error {
+	return cr.toInvalidError(cr.validateImmutableSpec(applied))
+}
+
+func (cr *Undermoon) validateImmutableSpec(applied *ImmutableSpec) field.ErrorList {
+	errs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+
+	// The services and the storage StatefulSet are generated from these fields
+	// and the broker metadata depends on them.
+	if cr.Spec.ClusterName != applied.ClusterName {
+		errs = append(errs, field.Forbidden(specPath.Child("clusterName"), "can't be modified"))
+	}
+	if cr.Spec.Port != applied.Port {
+		errs = append(errs, field.Forbidden(specPath.Child("port"), "can't be modified"))
+	}
+
+	// The volumeClaimTemplates of the StatefulSet can't be updated.
+	if !persistentVolumeEqual(cr.Spec.Persistence, applied.Persistence) {
+		errs = append(errs, field.Forbidden(
+			specPath.Child("persistence"),
+			"can't be enabled, disabled, or change the storage class and the size",
+		))
+	}
+	if !brokerPersistentVolumeEqual(cr.Spec.BrokerPersistence, applied.BrokerPersistence) {
+		errs = append(errs, field.Forbidden(
+			specPath.Child("brokerPersistence"),
+			"can't be enabled, disabled, or change the storage class and the size",
+		))
+	}
+
+	if !reflect.DeepEqual(cr.Spec.RestoreFrom, applied.RestoreFrom) {
+		errs = append(errs, field.Forbidden(specPath.Child("restoreFrom"), "can't be modified"))
+	}
+	// The password is rotated by changing the Secret instead.
+	if !reflect.DeepEqual(cr.Spec.Auth, applied.Auth) {
+		errs = append(errs, field.Forbidden(specPath.Child("auth"), "can't be modified, change the password in the Secret to rotate it"))
+	}
+	// The operator and the coordinators need to connect to both the old and the upgraded server proxies.
+	if !reflect.DeepEqual(cr.Spec.TLS, applied.TLS) {
+		errs = append(errs, field.Forbidden(specPath.Child("tls"), "can't be modified"))
+	}
+
+	return errs
+}
+
+func validateImage(fldPath *field.Path, image string) field.ErrorList {
+	if len(image) == 0 {
+		return field.ErrorList{field.Required(fldPath, "image should be specified")}
+	}
+	if !imageRegexp.MatchString(image) {
+		return field.ErrorList{field.Invalid(fldPath, image, "invalid image reference")}
+	}
+	return nil
+}
+
+func validateUpgradeStrategy(fldPath *field.Path, strategy *UpgradeStrategy) field.ErrorList {
+	if strategy == nil {
+		return nil
+	}
+	errs := field.ErrorList{}
+	switch strategy.Type {
+	case RollingUpgradeStrategyType, CanaryUpgradeStrategyType:
+	default:
+		errs = append(errs, field.NotSupported(
+			fldPath.Child("type"),
+			strategy.Type,
+			[]string{string(RollingUpgradeStrategyType), string(CanaryUpgradeStrategyType)},
+		))
+	}
+	if strategy.Canary != nil && strategy.Canary.SoakSeconds < 1 {
+		errs = append(errs, field.Invalid(fldPath.Child("canary", "soakSeconds"), strategy.Canary.SoakSeconds, "should be at least 1"))
+	}
+	return errs
+}
+
+func validatePodSettings(fldPath *field.Path, settings *PodSettings) field.ErrorList {
+	errs := field.ErrorList{}
+	errs = append(errs, metav1validation.ValidateLabels(settings.Labels, fldPath.Child("labels"))...)
+	for _, key := range reservedPodLabels {
+		if _, ok := settings.Labels[key]; ok {
+			errs = append(errs, field.Forbidden(fldPath.Child("labels").Key(key), "is used by the operator"))
+		}
+	}
+	errs = append(errs, apivalidation.ValidateAnnotations(settings.Annotations, fldPath.Child("annotations"))...)
+	errs = append(errs, metav1validation.ValidateLabels(settings.NodeSelector, fldPath.Child("nodeSelector"))...)
+	for i, secret := range settings.ImagePullSecrets {
+		if secret.Name == "" {
+			errs = append(errs, field.Required(fldPath.Child("imagePullSecrets").Index(i).Child("name"), "secret name should be specified"))
+		}
+	}
+	return errs
+}
+
+func validatePlacement(fldPath *field.Path, placement *PlacementSpec) field.ErrorList {
+	errs := field.ErrorList{}
+	if placement.AntiAffinityTopologyKey == "" {
+		errs = append(errs, field.Required(fldPath.Child("antiAffinityTopologyKey"), "topology key should be specified"))
+	}
+	switch placement.AntiAffinityMode {
+	case RequiredAntiAffinity, PreferredAntiAffinity:
+	default:
+		errs = append(errs, field.NotSupported(
+			fldPath.Child("antiAffinityMode"),
+			placement.AntiAffinityMode,
+			[]string{string(RequiredAntiAffinity), string(PreferredAntiAffinity)},
+		))
+	}
+	for i, constraint := range placement.TopologySpreadConstraints {
+		constraintPath := fldPath.Child("topologySpreadConstraints").Index(i)
+		if constraint.MaxSkew < 1 {
+			errs = append(errs, field.Invalid(constraintPath.Child("maxSkew"), constraint.MaxSkew, "should be at least 1"))
+		}
+		if constraint.TopologyKey == "" {
+			errs = append(errs, field.Required(constraintPath.Child("topologyKey"), "topology key should be specified"))
+		}
+		switch constraint.WhenUnsatisfiable {
+		case corev1.DoNotSchedule, corev1.ScheduleAnyway:
+		default:
+			errs = append(errs, field.NotSupported(
+				constraintPath.Child("whenUnsatisfiable"),
+				constraint.WhenUnsatisfiable,
+				[]string{string(corev1.DoNotSchedule), string(corev1.ScheduleAnyway)},
+			))
+		}
+	}
+	return errs
+}
+
+func validateRedisConfig(fldPath *field.Path, config map[string]string) field.ErrorList {
+	errs := field.ErrorList{}
+	for name, value := range config {
+		if !redisConfigNameRegexp.MatchString(name) {
+			errs = append(errs, field.Invalid(fldPath.Key(name), name, "should only contain lowercase letters, digits and '-'"))
+			continue
+		}
+		if IsManagedRedisConfig(name) {
+			errs = append(errs, field.Forbidden(fldPath.Key(name), "is managed by the operator"))
+			continue
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			errs = append(errs, field.Invalid(fldPath.Key(name), value, "should not contain line breaks"))
+		}
+	}
+	return errs
+}
+
+func validateProxyConfig(fldPath *field.Path, config *ProxyConfig) field.ErrorList {
+	errs := field.ErrorList{}
+	if config.SlowlogLogSlowerThan != nil && *config.SlowlogLogSlowerThan < 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("slowlogLogSlowerThan"), *config.SlowlogLogSlowerThan, "should not be negative"))
+	}
+	if config.BackendBatchMinTime > config.BackendBatchMaxTime {
+		errs = append(errs, field.Invalid(
+			fldPath.Child("backendBatchMinTime"),
+			config.BackendBatchMinTime,
+			"should not be greater than backendBatchMaxTime",
+		))
+	}
+	if config.SessionBatchMinTime > config.SessionBatchMaxTime {
+		errs = append(errs, field.Invalid(
+			fldPath.Child("sessionBatchMinTime"),
+			config.SessionBatchMinTime,
+			"should not be greater than sessionBatchMaxTime",
+		))
+	}
+	return errs
+}
+
+func validateBrokerConfig(fldPath *field.Path, config *BrokerConfig, coordinatorNum uint32) field.ErrorList {
+	errs := field.ErrorList{}
+	// The quorum could never be reached with more than the coordinators.
+	if config.FailureQuorum < 1 || config.FailureQuorum > coordinatorNum {
+		errs = append(errs, field.Invalid(
+			fldPath.Child("failureQuorum"),
+			config.FailureQuorum,
+			fmt.Sprintf("should be between 1 and coordinatorNum %d", coordinatorNum),
+		))
+	}
+	if config.FailureTTL < 1 {
+		errs = append(errs, field.Invalid(fldPath.Child("failureTTL"), config.FailureTTL, "should be at least 1 second"))
+	}
+	if config.MigrationLimit < 1 {
+		errs = append(errs, field.Invalid(fldPath.Child("migrationLimit"), config.MigrationLimit, "should be at least 1"))
+	}
+	if config.SyncMetaInterval < 1 {
+		errs = append(errs, field.Invalid(fldPath.Child("syncMetaInterval"), config.SyncMetaInterval, "should be at least 1 second"))
+	}
+	if config.UpdateMetaFileInterval < 1 {
+		errs = append(errs, field.Invalid(fldPath.Child("updateMetaFileInterval"), config.UpdateMetaFileInterval, "should be at least 1 second"))
+	}
+	return errs
+}
+
+func validatePersistence(fldPath *field.Path, persistence *PersistenceSpec) field.ErrorList {
+	if persistence == nil {
+		return nil
+	}
+	errs := field.ErrorList{}
+	if persistence.Size.Sign() <= 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("size"), persistence.Size.String(), "should be positive"))
+	}
+	switch persistence.Mode {
+	case RDBPersistenceMode, AOFPersistenceMode, RDBAndAOFPersistenceMode:
+	default:
+		errs = append(errs, field.NotSupported(
+			fldPath.Child("mode"),
+			persistence.Mode,
+			[]string{string(RDBPersistenceMode), string(AOFPersistenceMode), string(RDBAndAOFPersistenceMode)},
+		))
+	}
+	switch persistence.AppendFsync {
+	case AppendFsyncAlways, AppendFsyncEverySec, AppendFsyncNo:
+	default:
+		errs = append(errs, field.NotSupported(
+			fldPath.Child("appendFsync"),
+			persistence.AppendFsync,
+			[]string{string(AppendFsyncAlways), string(AppendFsyncEverySec), string(AppendFsyncNo)},
+		))
+	}
+	return errs
+}
+
+func validateRestoreFrom(fldPath *field.Path, restoreFrom *BackupDestination, persistence *PersistenceSpec) field.ErrorList {
+	if restoreFrom == nil {
+		return nil
+	}
+	errs := field.ErrorList{}
+	if (restoreFrom.PersistentVolumeClaim == nil) == (restoreFrom.S3 == nil) {
+		errs = append(errs, field.Invalid(fldPath, "", "exactly one of persistentVolumeClaim and s3 should be specified"))
+	}
+	// Redis ignores the RDB file on startup when AOF is enabled.
+	if persistence != nil && persistence.Mode != RDBPersistenceMode {
+		errs = append(errs, field.Invalid(
+			fldPath.Root().Child("persistence", "mode"),
+			persistence.Mode,
+			"should be RDB when restoring from a backup",
+		))
+	}
+	return errs
+}
+
+func persistentVolumeEqual(a, b *PersistenceSpec) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return volumeEqual(a.StorageClassName, b.StorageClassName, a.Size, b.Size)
+}
+
+func brokerPersistentVolumeEqual(a, b *BrokerPersistenceSpec) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return volumeEqual(a.StorageClassName, b.StorageClassName, a.Size, b.Size)
+}
+
+func volumeEqual(storageClassA, storageClassB *string, sizeA, sizeB resource.Quantity) bool {
+	if sizeA.Cmp(sizeB) != 0 {
+		return false
+	}
+	if storageClassA == nil || storageClassB == nil {
+		return storageClassA == nil && storageClassB == nil
+	}
+	return *storageClassA == *storageClassB
+}
+
+func validateResources(fldPath *field.Path, resources *corev1.ResourceRequirements) field.ErrorList {
+	errs := field.ErrorList{}
+	for name, quantity := range resources.Limits {
+		if quantity.Sign() < 0 {
+			errs = append(errs, field.Invalid(fldPath.Child("limits").Key(string(name)), quantity.String(), "should not be negative"))
+		}
+	}
+	for name, quantity := range resources.Requests {
+		if quantity.Sign() < 0 {
+			errs = append(errs, field.Invalid(fldPath.Child("requests").Key(string(name)), quantity.String(), "should not be negative"))
+			continue
+		}
+		limit, ok := resources.Limits[name]
+		if ok && quantity.Cmp(limit) > 0 {
+			errs = append(errs, field.Invalid(
+				fldPath.Child("requests").Key(string(name)),
+				quantity.String(),
+				fmt.Sprintf("should be less than or equal to the limit %s", limit.String()),
+			))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,316 @@
+package v1alpha1
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func newTestUndermoon() *Undermoon {
+	cr := &Undermoon{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+		},
+		Spec: UndermoonSpec{
+			ClusterName: "mycluster",
+			ChunkNumber: 1,
+		},
+	}
+	cr.Default()
+	return cr
+}
+
+func errorFields(errs field.ErrorList) []string {
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidateSpec(t *testing.T) {
+	cases := []struct {
+		name     string
+		modify   func(spec *UndermoonSpec)
+		expected []string
+	}{
+		{name: "valid", modify: func(spec *UndermoonSpec) {}, expected: []string{}},
+		{
+			name:     "empty cluster name",
+			modify:   func(spec *UndermoonSpec) { spec.ClusterName = "" },
+			expected: []string{"spec.clusterName"},
+		},
+		{
+			name:     "long cluster name",
+			modify:   func(spec *UndermoonSpec) { spec.ClusterName = strings.Repeat("a", 31) },
+			expected: []string{"spec.clusterName"},
+		},
+		{
+			name:     "no chunk",
+			modify:   func(spec *UndermoonSpec) { spec.ChunkNumber = 0 },
+			expected: []string{"spec.chunkNumber"},
+		},
+		{
+			name: "maxMemory not less than the limit",
+			modify: func(spec *UndermoonSpec) {
+				spec.MaxMemory = 64
+				spec.RedisResources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")}
+			},
+			expected: []string{"spec.maxMemory"},
+		},
+		{
+			name: "maxMemory less than the limit",
+			modify: func(spec *UndermoonSpec) {
+				spec.MaxMemory = 63
+				spec.RedisResources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")}
+			},
+			expected: []string{},
+		},
+		{
+			name:     "reserved port",
+			modify:   func(spec *UndermoonSpec) { spec.Port = 7001 },
+			expected: []string{"spec.port"},
+		},
+		{
+			name: "invalid images",
+			modify: func(spec *UndermoonSpec) {
+				spec.UndermoonImage = "Undermoon:latest"
+				spec.RedisImage = "redis:5.0.9 "
+			},
+			expected: []string{"spec.redisImage", "spec.undermoonImage"},
+		},
+		{
+			name:     "invalid pull policy",
+			modify:   func(spec *UndermoonSpec) { spec.UndermoonImagePullPolicy = "Sometimes" },
+			expected: []string{"spec.undermoonImagePullPolicy"},
+		},
+		{
+			name: "failure quorum greater than the coordinator number",
+			modify: func(spec *UndermoonSpec) {
+				spec.CoordinatorNum = 1
+				spec.BrokerConfig.FailureQuorum = 2
+			},
+			expected: []string{"spec.brokerConfig.failureQuorum"},
+		},
+		{
+			name: "invalid redis config",
+			modify: func(spec *UndermoonSpec) {
+				spec.RedisConfig["maxmemory"] = "1GB"
+				spec.RedisConfig["Timeout"] = "300"
+				spec.RedisConfig["notify-keyspace-events"] = "KEA\nslaveof 10.0.0.1 6379"
+			},
+			expected: []string{
+				"spec.redisConfig[Timeout]",
+				"spec.redisConfig[maxmemory]",
+				"spec.redisConfig[notify-keyspace-events]",
+			},
+		},
+		{
+			name:     "reserved pod label",
+			modify:   func(spec *UndermoonSpec) { spec.StoragePod.Labels = map[string]string{"undermoonName": "other"} },
+			expected: []string{"spec.storagePod.labels[undermoonName]"},
+		},
+		{
+			name: "invalid upgrade strategy",
+			modify: func(spec *UndermoonSpec) {
+				spec.UpgradeStrategy = &UpgradeStrategy{Type: "BlueGreen", Canary: &CanaryUpgradeStrategy{SoakSeconds: -1}}
+			},
+			expected: []string{"spec.upgradeStrategy.canary.soakSeconds", "spec.upgradeStrategy.type"},
+		},
+		{
+			name:     "auth without secret",
+			modify:   func(spec *UndermoonSpec) { spec.Auth = &AuthSpec{} },
+			expected: []string{"spec.auth.secretRef.name"},
+		},
+	}
+
+	for _, c := range cases {
+		cr := newTestUndermoon()
+		c.modify(&cr.Spec)
+		fields := errorFields(cr.validateSpec())
+		if !reflect.DeepEqual(fields, c.expected) {
+			t.Errorf("%s: expected errors on %v, got %v", c.name, c.expected, fields)
+		}
+		if err := cr.ValidateSpec(); (err != nil) != (len(c.expected) != 0) {
+			t.Errorf("%s: unexpected ValidateSpec result %v", c.name, err)
+		}
+	}
+}
+
+func TestValidateSpecChange(t *testing.T) {
+	size := resource.MustParse("1Gi")
+	cases := []struct {
+		name     string
+		modify   func(old, cr *Undermoon)
+		expected []string
+	}{
+		{
+			name: "scale and upgrade",
+			modify: func(old, cr *Undermoon) {
+				cr.Spec.ChunkNumber = 3
+				cr.Spec.BrokerNum = 5
+				cr.Spec.MaxMemory = 64
+				cr.Spec.RedisImage = "redis:6.0.5"
+			},
+			expected: []string{},
+		},
+		{
+			name: "immutable fields",
+			modify: func(old, cr *Undermoon) {
+				cr.Spec.ClusterName = "renamed"
+				cr.Spec.Port = 6379
+				cr.Spec.TLS = &TLSSpec{}
+				cr.Spec.Auth = &AuthSpec{SecretRef: AuthSecretReference{Name: "password", Key: DefaultAuthSecretKey}}
+				cr.Spec.Persistence = &PersistenceSpec{Size: size}
+			},
+			expected: []string{"spec.auth", "spec.clusterName", "spec.persistence", "spec.port", "spec.tls"},
+		},
+		{
+			name: "scale while migrating",
+			modify: func(old, cr *Undermoon) {
+				old.Status.IsMigrating = true
+				cr.Spec.ChunkNumber = 2
+			},
+			expected: []string{"spec.chunkNumber"},
+		},
+		{
+			name: "other changes while migrating",
+			modify: func(old, cr *Undermoon) {
+				old.Status.IsMigrating = true
+				cr.Spec.BrokerNum = 1
+			},
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		old := newTestUndermoon()
+		cr := newTestUndermoon()
+		c.modify(old, cr)
+		fields := errorFields(cr.validateSpecChange(old))
+		if !reflect.DeepEqual(fields, c.expected) {
+			t.Errorf("%s: expected errors on %v, got %v", c.name, c.expected, fields)
+		}
+	}
+}
+
+func TestDefault(t *testing.T) {
+	cr := &Undermoon{
+		Spec: UndermoonSpec{
+			ClusterName:     "mycluster",
+			ChunkNumber:     1,
+			CoordinatorNum:  1,
+			UpgradeStrategy: &UpgradeStrategy{Type: CanaryUpgradeStrategyType},
+			Persistence:     &PersistenceSpec{Size: resource.MustParse("1Gi")},
+			Auth:            &AuthSpec{SecretRef: AuthSecretReference{Name: "password"}},
+		},
+	}
+	cr.Default()
+	spec := &cr.Spec
+
+	checks := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"port", spec.Port, uint32(DefaultServerProxyPort)},
+		{"proxyThreads", spec.ProxyThreads, uint32(DefaultProxyThreads)},
+		{"maxMemory", spec.MaxMemory, uint32(DefaultMaxMemory)},
+		{"brokerNum", spec.BrokerNum, uint32(DefaultBrokerNum)},
+		{"coordinatorNum", spec.CoordinatorNum, uint32(1)},
+		{"undermoonImage", spec.UndermoonImage, DefaultUndermoonImage},
+		{"undermoonImagePullPolicy", spec.UndermoonImagePullPolicy, corev1.PullIfNotPresent},
+		{"redisImage", spec.RedisImage, DefaultRedisImage},
+		{"redisConfig", spec.RedisConfig, map[string]string{"maxmemory-policy": DefaultRedisMaxMemoryPolicy}},
+		// The failure quorum should not be greater than the coordinator number.
+		{"brokerConfig.failureQuorum", spec.BrokerConfig.FailureQuorum, uint32(1)},
+		{"proxyConfig.backendBatchMaxTime", spec.ProxyConfig.BackendBatchMaxTime, uint64(DefaultProxyBatchMaxTime)},
+		{"placement.antiAffinityTopologyKey", spec.Placement.AntiAffinityTopologyKey, DefaultAntiAffinityTopologyKey},
+		{"upgradeStrategy.canary.soakSeconds", spec.UpgradeStrategy.Canary.SoakSeconds, int32(DefaultCanarySoakSeconds)},
+		{"persistence.mode", spec.Persistence.Mode, RDBPersistenceMode},
+		{"auth.secretRef.key", spec.Auth.SecretRef.Key, DefaultAuthSecretKey},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, c.got)
+		}
+	}
+
+	if err := cr.ValidateSpec(); err != nil {
+		t.Errorf("expected the defaulted spec to be valid: %v", err)
+	}
+
+	// Defaulting again should not change anything.
+	defaulted := cr.DeepCopy()
+	defaulted.Default()
+	if !reflect.DeepEqual(defaulted, cr) {
+		t.Errorf("expected Default to be idempotent")
+	}
+}
+
+func TestDefaultPinnedImages(t *testing.T) {
+	cr := &Undermoon{
+		Spec: UndermoonSpec{
+			ClusterName: "mycluster",
+			ChunkNumber: 1,
+		},
+		// Pinned by the operator of an older version.
+		Status: UndermoonStatus{
+			DefaultUndermoonImage: "doyoubi/undermoon:0.3.0-buster",
+			DefaultRedisImage:     "redis:5.0.8",
+		},
+	}
+	cr.Default()
+	if cr.Spec.UndermoonImage != cr.Status.DefaultUndermoonImage {
+		t.Errorf("expected undermoonImage %s, got %s", cr.Status.DefaultUndermoonImage, cr.Spec.UndermoonImage)
+	}
+	if cr.Spec.RedisImage != cr.Status.DefaultRedisImage {
+		t.Errorf("expected redisImage %s, got %s", cr.Status.DefaultRedisImage, cr.Spec.RedisImage)
+	}
+}
+
+func TestDefaultKeepSpecified(t *testing.T) {
+	slowerThan := int64(0)
+	cr := &Undermoon{
+		Spec: UndermoonSpec{
+			ClusterName:    "mycluster",
+			ChunkNumber:    1,
+			MaxMemory:      100,
+			UndermoonImage: "localhost:5000/undermoon:dev",
+			RedisImage:     "redis:6.0.5",
+			RedisConfig:    map[string]string{"maxmemory-policy": "noeviction"},
+			ProxyConfig:    ProxyConfig{SlowlogLogSlowerThan: &slowerThan},
+			BrokerConfig:   BrokerConfig{FailureQuorum: 3},
+		},
+	}
+	cr.Default()
+	spec := &cr.Spec
+
+	checks := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"maxMemory", spec.MaxMemory, uint32(100)},
+		{"undermoonImage", spec.UndermoonImage, "localhost:5000/undermoon:dev"},
+		{"redisImage", spec.RedisImage, "redis:6.0.5"},
+		{"redisConfig", spec.RedisConfig, map[string]string{"maxmemory-policy": "noeviction"}},
+		{"proxyConfig.slowlogLogSlowerThan", *spec.ProxyConfig.SlowlogLogSlowerThan, int64(0)},
+		{"brokerConfig.failureQuorum", spec.BrokerConfig.FailureQuorum, uint32(3)},
+		// The memory request is derived by the operator from the applied maxMemory.
+		{"redisResources", spec.RedisResources, corev1.ResourceRequirements{}},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, c.got)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UndermoonBackupSpec defines the desired state of UndermoonBackup
+type UndermoonBackupSpec struct {
+	// Name of the Undermoon object in the same namespace.
+	// +kubebuilder:validation:MinLength=1
+	UndermoonName string `json:"undermoonName"`
+	// Where the RDB files and the metadata snapshot are copied to.
+	Destination BackupDestination `json:"destination"`
+}
+
+// BackupDestination specifies where to store the backup.
+// Only one of them should be specified.
+type BackupDestination struct {
+	// +optional
+	PersistentVolumeClaim *PVCBackupDestination `json:"persistentVolumeClaim,omitempty"`
+	// +optional
+	S3 *S3BackupDestination `json:"s3,omitempty"`
+}
+
+// PVCBackupDestination stores the backup in an existing PersistentVolumeClaim.
+type PVCBackupDestination struct {
+	// +kubebuilder:validation:MinLength=1
+	ClaimName string `json:"claimName"`
+	// Directory inside the volume. Defaults to the name of the UndermoonBackup.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// S3BackupDestination uploads the backup to an S3 compatible object storage such as MinIO.
+type S3BackupDestination struct {
+	// Such as https://s3.amazonaws.com or http://minio.default.svc:9000
+	// +kubebuilder:validation:MinLength=1
+	Endpoint string `json:"endpoint"`
+	// +kubebuilder:validation:MinLength=1
+	Bucket string `json:"bucket"`
+	// Object key prefix. Defaults to the name of the UndermoonBackup.
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+	// Name of the Secret containing `accessKeyID` and `secretAccessKey`.
+	// +kubebuilder:validation:MinLength=1
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// UndermoonBackupPhase is the phase of the whole backup.
+type UndermoonBackupPhase string
+
+const (
+	// BackupPending means the backup has not started yet.
+	BackupPending UndermoonBackupPhase = "Pending"
+	// BackupRunning means the shards are being saved or copied.
+	BackupRunning UndermoonBackupPhase = "Running"
+	// BackupCompleted means all the shards and the metadata have been copied to the destination.
+	BackupCompleted UndermoonBackupPhase = "Completed"
+	// BackupFailed means the backup can't be finished. Create a new one to retry.
+	BackupFailed UndermoonBackupPhase = "Failed"
+)
+
+// ShardBackupPhase is the phase of backing up a master Redis.
+type ShardBackupPhase string
+
+const (
+	// ShardBackupPending means the job has not been created yet.
+	ShardBackupPending ShardBackupPhase = "Pending"
+	// ShardBackupCopying means the RDB file is being dumped and copied to the destination.
+	ShardBackupCopying ShardBackupPhase = "Copying"
+	// ShardBackupCompleted means the RDB file has been copied to the destination.
+	ShardBackupCompleted ShardBackupPhase = "Completed"
+	// ShardBackupFailed means the shard can't be backed up.
+	ShardBackupFailed ShardBackupPhase = "Failed"
+)
+
+// ShardBackupStatus records the progress of backing up a master Redis.
+type ShardBackupStatus struct {
+	// Address of the master Redis.
+	NodeAddress string `json:"nodeAddress"`
+	// Address of the server proxy owning the master Redis.
+	ProxyAddress string `json:"proxyAddress"`
+	// Slot ranges such as `0-8191`.
+	// +optional
+	Slots string `json:"slots,omitempty"`
+	// +optional
+	Phase ShardBackupPhase `json:"phase,omitempty"`
+	// Path of the RDB file in the destination.
+	// +optional
+	Path string `json:"path,omitempty"`
+	// Size of the RDB file in bytes.
+	// +optional
+	Size int64 `json:"size,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// UndermoonBackupStatus defines the observed state of UndermoonBackup
+type UndermoonBackupStatus struct {
+	// +optional
+	Phase UndermoonBackupPhase `json:"phase,omitempty"`
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Epoch of the broker metadata snapshot.
+	// +optional
+	Epoch int64 `json:"epoch,omitempty"`
+	// ConfigMap storing the broker metadata snapshot.
+	// +optional
+	MetadataConfigMap string `json:"metadataConfigMap,omitempty"`
+	// Path of the broker metadata snapshot in the destination.
+	// +optional
+	MetadataPath string `json:"metadataPath,omitempty"`
+	// Whether the metadata snapshot has been copied to the destination.
+	// +optional
+	MetadataCopied bool `json:"metadataCopied,omitempty"`
+	// Total size of the RDB files in bytes.
+	// +optional
+	TotalSize int64 `json:"totalSize,omitempty"`
+	// +optional
+	Shards []ShardBackupStatus `json:"shards,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// UndermoonBackup is the Schema for the undermoonbackups API
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=undermoonbackups,scope=Namespaced
+// +kubebuilder:printcolumn:name="Undermoon",type="string",JSONPath=".spec.undermoonName"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Size",type="integer",JSONPath=".status.totalSize"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+type UndermoonBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UndermoonBackupSpec   `json:"spec,omitempty"`
+	Status UndermoonBackupStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// UndermoonBackupList contains a list of UndermoonBackup
+type UndermoonBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UndermoonBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UndermoonBackup{}, &UndermoonBackupList{})
+}
@@ -0,0 +1,86 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UndermoonBackupScheduleSpec defines the desired state of UndermoonBackupSchedule
+type UndermoonBackupScheduleSpec struct {
+	// Name of the Undermoon object in the same namespace.
+	// +kubebuilder:validation:MinLength=1
+	UndermoonName string `json:"undermoonName"`
+	// Cron expression such as `0 2 * * *`.
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+	// Stop creating new backups. The existing backups are still pruned.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+	// Which finished backups to keep.
+	// +optional
+	Retention BackupRetention `json:"retention,omitempty"`
+	// Each backup is stored in a sub directory or under a sub prefix
+	// named after the UndermoonBackup.
+	Destination BackupDestination `json:"destination"`
+}
+
+// BackupRetention specifies when the old backups are deleted together with their archives.
+// The latest completed backup is never deleted.
+type BackupRetention struct {
+	// Maximum number of finished backups to keep. Defaults to 7.
+	// Set to 0 to keep all of them.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxCount *int32 `json:"maxCount,omitempty"`
+	// Backups older than this such as `168h` are deleted.
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+}
+
+// UndermoonBackupScheduleStatus defines the observed state of UndermoonBackupSchedule
+type UndermoonBackupScheduleStatus struct {
+	// The last time a backup was scheduled.
+	// +optional
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// Completion time of the latest completed backup.
+	// +optional
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// Completion time of the latest failed backup.
+	// +optional
+	LastFailedTime *metav1.Time `json:"lastFailedTime,omitempty"`
+	// Backups still running.
+	// +optional
+	Active []string `json:"active,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// UndermoonBackupSchedule is the Schema for the undermoonbackupschedules API
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=undermoonbackupschedules,scope=Namespaced
+// +kubebuilder:printcolumn:name="Undermoon",type="string",JSONPath=".spec.undermoonName"
+// +kubebuilder:printcolumn:name="Schedule",type="string",JSONPath=".spec.schedule"
+// +kubebuilder:printcolumn:name="Suspend",type="boolean",JSONPath=".spec.suspend"
+// +kubebuilder:printcolumn:name="Last Success",type="date",JSONPath=".status.lastSuccessfulTime"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+type UndermoonBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UndermoonBackupScheduleSpec   `json:"spec,omitempty"`
+	Status UndermoonBackupScheduleStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// UndermoonBackupScheduleList contains a list of UndermoonBackupSchedule
+type UndermoonBackupScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UndermoonBackupSchedule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UndermoonBackupSchedule{}, &UndermoonBackupScheduleList{})
+}
@@ -0,0 +1,214 @@
+package undermoon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	pkgerrors "github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const redisPasswordEnvName = "UM_REDIS_PASSWORD"
+const redisPasswordEnvStr = "$(UM_REDIS_PASSWORD)"
+
+const authVolumeName = "auth"
+const authPath = "/etc/undermoon/auth"
+const appliedAuthVolumeName = "applied-auth"
+const appliedAuthPath = "/etc/undermoon/applied-auth"
+
+// secretPropagationDelay is the time for the kubelet to refresh the mounted Secrets,
+// which is the sync period plus the TTL of its Secret cache by default.
+const secretPropagationDelay = 2 * time.Minute
+
+func authSecretKey(auth *undermoonv1alpha1.AuthSpec) string {
+	if auth.SecretRef.Key == "" {
+		return undermoonv1alpha1.DefaultAuthSecretKey
+	}
+	return auth.SecretRef.Key
+}
+
+// genAuthEnv loads the password from the Secret to the env with the specified names.
+// It returns nothing if the authentication is disabled.
+func genAuthEnv(cr *undermoonv1alpha1.Undermoon, names ...string) []corev1.EnvVar {
+	auth := cr.Spec.Auth
+	if auth == nil {
+		return nil
+	}
+	env := []corev1.EnvVar{}
+	for _, name := range names {
+		env = append(env, corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: auth.SecretRef.Name,
+					},
+					Key: authSecretKey(auth),
+				},
+			},
+		})
+	}
+	return env
+}
+
+// genAuthVolumes mounts both the Secret of auth and the applied Secret
+// since the env is not changed after the password is rotated.
+// The applied Secret is created by the operator after the pods so it's optional.
+func genAuthVolumes(cr *undermoonv1alpha1.Undermoon) []corev1.Volume {
+	if cr.Spec.Auth == nil {
+		return nil
+	}
+	optional := true
+	return []corev1.Volume{
+		{
+			Name: authVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: cr.Spec.Auth.SecretRef.Name,
+				},
+			},
+		},
+		{
+			Name: appliedAuthVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: AppliedAuthSecretName(cr.ObjectMeta.Name),
+					Optional:   &optional,
+				},
+			},
+		},
+	}
+}
+
+func genAuthVolumeMounts(cr *undermoonv1alpha1.Undermoon) []corev1.VolumeMount {
+	if cr.Spec.Auth == nil {
+		return nil
+	}
+	return []corev1.VolumeMount{
+		{
+			Name:      authVolumeName,
+			MountPath: authPath,
+			ReadOnly:  true,
+		},
+		{
+			Name:      appliedAuthVolumeName,
+			MountPath: appliedAuthPath,
+			ReadOnly:  true,
+		},
+	}
+}
+
+// genAuthPasswordFiles returns the mounted files of the new password and then the old one.
+// During the rotation, the server proxies may be using either of them.
+func genAuthPasswordFiles(cr *undermoonv1alpha1.Undermoon) []string {
+	return []string{
+		fmt.Sprintf("%s/%s", authPath, authSecretKey(cr.Spec.Auth)),
+		fmt.Sprintf("%s/%s", appliedAuthPath, undermoonv1alpha1.DefaultAuthSecretKey),
+	}
+}
+
+func genRedisAuthArgs(cr *undermoonv1alpha1.Undermoon) []string {
+	if cr.Spec.Auth == nil {
+		return nil
+	}
+	// The replicas also need the password to connect to their masters.
+	return []string{"--requirepass", redisPasswordEnvStr, "--masterauth", redisPasswordEnvStr}
+}
+
+// AppliedAuthSecretName defines the Secret storing the password used by the running cluster.
+// It's only updated after the password in the Secret of auth is applied to the whole cluster.
+func AppliedAuthSecretName(undermoonName string) string {
+	return fmt.Sprintf("%s-applied-auth", undermoonName)
+}
+
+func createAppliedAuthSecret(cr *undermoonv1alpha1.Undermoon, password string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      AppliedAuthSecretName(cr.ObjectMeta.Name),
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"undermoonName":        cr.ObjectMeta.Name,
+				"undermoonClusterName": cr.Spec.ClusterName,
+			},
+		},
+		Data: map[string][]byte{
+			undermoonv1alpha1.DefaultAuthSecretKey: []byte(password),
+		},
+	}
+}
+
+// getAuthSecret returns the Secret specified in auth and the password inside it.
+func getAuthSecret(c client.Client, cr *undermoonv1alpha1.Undermoon) (*corev1.Secret, string, error) {
+	auth := cr.Spec.Auth
+	secret := &corev1.Secret{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: auth.SecretRef.Name, Namespace: cr.Namespace}, secret)
+	if err != nil {
+		return nil, "", pkgerrors.Wrapf(err, "failed to get auth secret %s", auth.SecretRef.Name)
+	}
+	password, ok := secret.Data[authSecretKey(auth)]
+	if !ok {
+		return nil, "", pkgerrors.Errorf("key %s not found in auth secret %s", authSecretKey(auth), auth.SecretRef.Name)
+	}
+	return secret, string(password), nil
+}
+
+// getAppliedAuthSecret returns nil if the Secret has not been created.
+func getAppliedAuthSecret(c client.Client, cr *undermoonv1alpha1.Undermoon) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: AppliedAuthSecretName(cr.ObjectMeta.Name), Namespace: cr.Namespace}, secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return secret, nil
+}
+
+// getAuthPassword returns the password used by the running cluster,
+// which is different from the one in the Secret of auth during the password rotation.
+// It returns an empty string if the authentication is disabled.
+func getAuthPassword(c client.Client, cr *undermoonv1alpha1.Undermoon) (string, error) {
+	if cr.Spec.Auth == nil {
+		return "", nil
+	}
+
+	applied, err := getAppliedAuthSecret(c, cr)
+	if err != nil {
+		return "", err
+	}
+	if applied != nil {
+		return string(applied.Data[undermoonv1alpha1.DefaultAuthSecretKey]), nil
+	}
+
+	_, password, err := getAuthSecret(c, cr)
+	return password, err
+}
+
+// undermoonsUsingSecret maps the changes of a Secret to the Undermoon objects using it in auth.
+func undermoonsUsingSecret(c client.Client, namespace, secretName string) []reconcile.Request {
+	undermoonList := &undermoonv1alpha1.UndermoonList{}
+	err := c.List(context.TODO(), undermoonList, client.InNamespace(namespace))
+	if err != nil {
+		log.Error(err, "failed to list Undermoon", "Namespace", namespace)
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, cr := range undermoonList.Items {
+		if cr.Spec.Auth == nil || cr.Spec.Auth.SecretRef.Name != secretName {
+			continue
+		}
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: cr.ObjectMeta.Name, Namespace: cr.Namespace},
+		})
+	}
+	return requests
+}
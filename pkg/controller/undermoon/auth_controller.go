@@ -0,0 +1,273 @@
+package undermoon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/go-redis/redis/v8"
+	pkgerrors "github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// authController rotates the password without restarting the pods
+// after the password in the Secret of auth is changed:
+// (1) CONFIG SET masterauth and requirepass on the replicas and then the masters,
+// (2) CONFIG SET the passwords of the server proxies and the coordinators,
+// (3) save the new password to the applied Secret used by the operator clients.
+// Each step tries the new password first so that it can be resumed after failures
+// and the pods restarted during the rotation are handled.
+type authController struct {
+	r         *ReconcileUndermoon
+	redisPool *redisClientPool
+	proxyPool *serverProxyClientPool
+	coordPool *coordinatorClientPool
+}
+
+func newAuthController(r *ReconcileUndermoon) *authController {
+	return &authController{
+		r:         r,
+		redisPool: newRedisClientPool(),
+		proxyPool: newServerProxyClientPool(),
+		coordPool: newCoordinatorClientPool(),
+	}
+}
+
+// rotatePassword returns true when the password is being rotated.
+func (con *authController) rotatePassword(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, storageStatefulSet *appsv1.StatefulSet, coordinatorService *corev1.Service) (bool, error) {
+	if cr.Spec.Auth == nil {
+		return false, nil
+	}
+
+	secret, newPassword, err := getAuthSecret(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get auth secret", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	applied, err := getAppliedAuthSecret(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get applied auth secret", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	if applied == nil {
+		// The pods are created with the password in the Secret.
+		return false, con.saveAppliedPassword(reqLogger, cr, secret, newPassword)
+	}
+
+	oldPassword := string(applied.Data[undermoonv1alpha1.DefaultAuthSecretKey])
+	if oldPassword == newPassword {
+		return false, nil
+	}
+
+	status := cr.Status.Auth
+	if status == nil || status.Phase != undermoonv1alpha1.PasswordRotating {
+		now := metav1.Now()
+		if status == nil {
+			status = &undermoonv1alpha1.AuthStatus{}
+			cr.Status.Auth = status
+		}
+		status.Phase = undermoonv1alpha1.PasswordRotating
+		status.StartTime = &now
+		status.RotatedRedis = 0
+		status.TotalRedis = 0
+		status.Message = ""
+		con.r.recorder.Event(cr, corev1.EventTypeNormal, eventPasswordRotationStarted, "Start rotating the password")
+	}
+	setProgressing(cr, reasonRotatingPassword, "rotating the password")
+
+	// The readiness probes of the server proxies read the new password from the mounted Secret,
+	// which is only refreshed by the kubelet periodically.
+	if time.Since(status.StartTime.Time) < secretPropagationDelay {
+		reqLogger.Info("waiting for the auth secret to be refreshed in the pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return true, nil
+	}
+
+	err = con.rotateRedisPasswords(reqLogger, cr, storageStatefulSet, oldPassword, newPassword)
+	if err != nil {
+		return true, con.rotationFailed(cr, err)
+	}
+	err = con.rotateServerProxyPasswords(reqLogger, cr, storageStatefulSet, oldPassword, newPassword)
+	if err != nil {
+		return true, con.rotationFailed(cr, err)
+	}
+	err = con.rotateCoordinatorPasswords(reqLogger, cr, coordinatorService, oldPassword, newPassword)
+	if err != nil {
+		return true, con.rotationFailed(cr, err)
+	}
+
+	err = con.saveAppliedPassword(reqLogger, cr, secret, newPassword)
+	if err != nil {
+		return true, err
+	}
+	now := metav1.Now()
+	status.LastRotationTime = &now
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventPasswordRotated,
+		"Rotated the password of %d Redis, the server proxies and the coordinators", status.RotatedRedis)
+	// Let the other controllers use the new password in the next reconciliation.
+	return true, nil
+}
+
+func (con *authController) rotationFailed(cr *undermoonv1alpha1.Undermoon, err error) error {
+	cr.Status.Auth.Message = err.Error()
+	con.r.recorder.Event(cr, corev1.EventTypeWarning, eventPasswordRotationFailed, err.Error())
+	return err
+}
+
+func (con *authController) saveAppliedPassword(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, secret *corev1.Secret, password string) error {
+	applied := createAppliedAuthSecret(cr, password)
+	if err := controllerutil.SetControllerReference(cr, applied, con.r.scheme); err != nil {
+		return err
+	}
+
+	found, err := getAppliedAuthSecret(con.r.client, cr)
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		err = con.r.client.Create(context.TODO(), applied)
+	} else {
+		found.Data = applied.Data
+		err = con.r.client.Update(context.TODO(), found)
+	}
+	if err != nil {
+		reqLogger.Error(err, "failed to save applied auth secret", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	if cr.Status.Auth == nil {
+		cr.Status.Auth = &undermoonv1alpha1.AuthStatus{}
+	}
+	cr.Status.Auth.Phase = undermoonv1alpha1.PasswordRotationCompleted
+	cr.Status.Auth.SecretResourceVersion = secret.ObjectMeta.ResourceVersion
+	cr.Status.Auth.Message = ""
+	return nil
+}
+
+// rotateRedisPasswords changes the replicas before the masters.
+// The established replication connections are not affected.
+func (con *authController) rotateRedisPasswords(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, storageStatefulSet *appsv1.StatefulSet, oldPassword, newPassword string) error {
+	pods, err := getStatefulSetPods(con.r.client, storageStatefulSet)
+	if err != nil {
+		reqLogger.Error(err, "failed to list storage pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	replicas := []string{}
+	masters := []string{}
+	for _, pod := range pods {
+		host := genStorageFQDNFromName(pod.ObjectMeta.Name, cr)
+		for _, port := range []int{redisPort1, redisPort2} {
+			address := fmt.Sprintf("%s:%d", host, port)
+			role, err := con.getRedisRole(address, oldPassword, newPassword)
+			if err != nil {
+				reqLogger.Error(err, "failed to get Redis role", "redisAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+				return pkgerrors.Wrapf(err, "failed to get the role of Redis %s", address)
+			}
+			if role == nodeRoleMaster {
+				masters = append(masters, address)
+			} else {
+				replicas = append(replicas, address)
+			}
+		}
+	}
+
+	status := cr.Status.Auth
+	status.TotalRedis = int32(len(replicas) + len(masters))
+	status.RotatedRedis = 0
+	for _, address := range append(replicas, masters...) {
+		err := con.rotateRedisPassword(address, oldPassword, newPassword)
+		if err != nil {
+			reqLogger.Error(err, "failed to rotate Redis password", "redisAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return pkgerrors.Wrapf(err, "failed to rotate the password of Redis %s", address)
+		}
+		status.RotatedRedis++
+	}
+	return nil
+}
+
+func (con *authController) getRedisRole(address, oldPassword, newPassword string) (string, error) {
+	client := con.redisPool.getClient(address, newPassword)
+	infoStr, err := client.Info(context.TODO(), "replication").Result()
+	if err != nil {
+		client = con.redisPool.getClient(address, oldPassword)
+		infoStr, err = client.Info(context.TODO(), "replication").Result()
+		if err != nil {
+			return "", err
+		}
+	}
+	replInfo, err := parseReplicationInfo(infoStr)
+	if err != nil {
+		return "", err
+	}
+	return replInfo.role, nil
+}
+
+func (con *authController) rotateRedisPassword(address, oldPassword, newPassword string) error {
+	err := setRedisPassword(con.redisPool.getClient(address, newPassword), newPassword)
+	if err != nil {
+		err = setRedisPassword(con.redisPool.getClient(address, oldPassword), newPassword)
+	}
+	return err
+}
+
+// The masters also need masterauth after failover.
+func setRedisPassword(client *redis.Client, password string) error {
+	ctx := context.TODO()
+	err := client.ConfigSet(ctx, "masterauth", password).Err()
+	if err != nil {
+		return err
+	}
+	return client.ConfigSet(ctx, "requirepass", password).Err()
+}
+
+func (con *authController) rotateServerProxyPasswords(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, storageStatefulSet *appsv1.StatefulSet, oldPassword, newPassword string) error {
+	pods, err := getStatefulSetPods(con.r.client, storageStatefulSet)
+	if err != nil {
+		reqLogger.Error(err, "failed to list storage pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	tlsConfig, err := getProxyTLSConfig(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get TLS config", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	for _, pod := range pods {
+		address := genStorageAddressFromName(pod.ObjectMeta.Name, cr)
+		err := con.proxyPool.getClient(address, newPassword, tlsConfig).setPassword(newPassword)
+		if err != nil {
+			err = con.proxyPool.getClient(address, oldPassword, tlsConfig).setPassword(newPassword)
+		}
+		if err != nil {
+			reqLogger.Error(err, "failed to rotate server proxy password", "proxyAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return pkgerrors.Wrapf(err, "failed to rotate the password of server proxy %s", address)
+		}
+	}
+	return nil
+}
+
+func (con *authController) rotateCoordinatorPasswords(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, coordinatorService *corev1.Service, oldPassword, newPassword string) error {
+	endpoints, err := getEndpoints(con.r.client, coordinatorService.Name, coordinatorService.Namespace)
+	if err != nil {
+		reqLogger.Error(err, "failed to get coordinator endpoints", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		address := genCoordinatorAddressFromName(endpoint.Hostname, cr)
+		err := con.coordPool.getClient(address, newPassword).setPassword(newPassword)
+		if err != nil {
+			err = con.coordPool.getClient(address, oldPassword).setPassword(newPassword)
+		}
+		if err != nil {
+			reqLogger.Error(err, "failed to rotate coordinator password", "coordinatorAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return pkgerrors.Wrapf(err, "failed to rotate the password of coordinator %s", address)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package undermoon
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultBackupUploaderImage is used to upload the backup files to S3.
+// It can be overridden by the operator command line flags.
+var DefaultBackupUploaderImage = "minio/mc:RELEASE.2020-10-03T02-54-56Z"
+
+const backupDataVolumeName = "backup-data"
+const backupMetaVolumeName = "backup-meta"
+const backupDataPath = "/backup"
+const backupMetaPath = "/backup-meta"
+const backupDumpContainerName = "dump"
+const backupUploadContainerName = "upload"
+const backupMetadataKey = "metadata.json"
+const backupClusterMetaKey = "cluster.json"
+const backupJobBackoffLimit int32 = 2
+
+// Used by the minio/mc image to access the S3 destination.
+const s3AliasCmd = "mc alias set dest \"$S3_ENDPOINT\" \"$S3_ACCESS_KEY_ID\" \"$S3_SECRET_ACCESS_KEY\" > /dev/null"
+
+// BackupMetadataConfigMapName defines the ConfigMap storing the broker metadata snapshot.
+func BackupMetadataConfigMapName(backupName string) string {
+	return fmt.Sprintf("%s-metadata", backupName)
+}
+
+func backupShardJobName(backupName string, index int) string {
+	return fmt.Sprintf("%s-shard-%d", backupName, index)
+}
+
+func backupMetadataJobName(backupName string) string {
+	return fmt.Sprintf("%s-metadata", backupName)
+}
+
+func backupCleanupJobName(backupName string) string {
+	return fmt.Sprintf("%s-cleanup", backupName)
+}
+
+func backupShardFileName(index int) string {
+	return fmt.Sprintf("shard-%d.rdb", index)
+}
+
+// The directory in the PVC or the object key prefix in S3.
+func backupDestinationPrefix(backup *undermoonv1alpha1.UndermoonBackup) string {
+	dest := backup.Spec.Destination
+	if dest.PersistentVolumeClaim != nil && dest.PersistentVolumeClaim.Path != "" {
+		return dest.PersistentVolumeClaim.Path
+	}
+	if dest.S3 != nil && dest.S3.Prefix != "" {
+		return dest.S3.Prefix
+	}
+	return backup.ObjectMeta.Name
+}
+
+func backupDestinationPath(backup *undermoonv1alpha1.UndermoonBackup, fileName string) string {
+	prefix := backupDestinationPrefix(backup)
+	if s3 := backup.Spec.Destination.S3; s3 != nil {
+		return fmt.Sprintf("s3://%s/%s", s3.Bucket, path.Join(prefix, fileName))
+	}
+	return path.Join(prefix, fileName)
+}
+
+func createBackupMetadataConfigMap(backup *undermoonv1alpha1.UndermoonBackup, metadata, clusterMeta []byte) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      BackupMetadataConfigMapName(backup.ObjectMeta.Name),
+			Namespace: backup.Namespace,
+			Labels:    backupLabels(backup),
+		},
+		Data: map[string]string{
+			backupMetadataKey:    string(metadata),
+			backupClusterMetaKey: string(clusterMeta),
+		},
+	}
+}
+
+func backupLabels(backup *undermoonv1alpha1.UndermoonBackup) map[string]string {
+	return map[string]string{
+		"undermoonBackupName": backup.ObjectMeta.Name,
+		"undermoonName":       backup.Spec.UndermoonName,
+	}
+}
+
+func backupScheduleLabels(schedule *undermoonv1alpha1.UndermoonBackupSchedule) map[string]string {
+	return map[string]string{
+		"undermoonBackupScheduleName": schedule.ObjectMeta.Name,
+		"undermoonName":               schedule.Spec.UndermoonName,
+	}
+}
+
+// createScheduledBackup stores each backup of the schedule in its own directory or prefix.
+// The name only depends on the scheduled time so that retrying will not create duplicate backups.
+func createScheduledBackup(schedule *undermoonv1alpha1.UndermoonBackupSchedule, scheduledTime time.Time) *undermoonv1alpha1.UndermoonBackup {
+	name := fmt.Sprintf("%s-%d", schedule.ObjectMeta.Name, scheduledTime.Unix())
+	dest := schedule.Spec.Destination.DeepCopy()
+	if dest.PersistentVolumeClaim != nil {
+		dest.PersistentVolumeClaim.Path = path.Join(dest.PersistentVolumeClaim.Path, name)
+	}
+	if dest.S3 != nil {
+		dest.S3.Prefix = path.Join(dest.S3.Prefix, name)
+	}
+	return &undermoonv1alpha1.UndermoonBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: schedule.Namespace,
+			Labels:    backupScheduleLabels(schedule),
+		},
+		Spec: undermoonv1alpha1.UndermoonBackupSpec{
+			UndermoonName: schedule.Spec.UndermoonName,
+			Destination:   *dest,
+		},
+	}
+}
+
+// createBackupShardJob dumps the RDB of the master Redis by `redis-cli --rdb`
+// and copies it to the destination.
+func createBackupShardJob(backup *undermoonv1alpha1.UndermoonBackup, cr *undermoonv1alpha1.Undermoon, index int, redisAddress string) (*batchv1.Job, error) {
+	host, port, err := net.SplitHostPort(redisAddress)
+	if err != nil {
+		return nil, err
+	}
+	fileName := backupShardFileName(index)
+	dumpCmd := fmt.Sprintf("redis-cli -h %s -p %s --rdb %s", host, port, path.Join(backupDataPath, fileName))
+	return createBackupJob(backup, cr, backupShardJobName(backup.ObjectMeta.Name, index), dumpCmd, []string{fileName}, nil), nil
+}
+
+// createBackupMetadataJob copies the broker metadata snapshot and the cluster metadata
+// in the ConfigMap to the destination. Both are needed for restoring the cluster.
+func createBackupMetadataJob(backup *undermoonv1alpha1.UndermoonBackup, cr *undermoonv1alpha1.Undermoon) *batchv1.Job {
+	dumpCmd := fmt.Sprintf(
+		"cp %s %s %s/",
+		path.Join(backupMetaPath, backupMetadataKey),
+		path.Join(backupMetaPath, backupClusterMetaKey),
+		backupDataPath,
+	)
+	metaVolume := corev1.Volume{
+		Name: backupMetaVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: BackupMetadataConfigMapName(backup.ObjectMeta.Name),
+				},
+			},
+		},
+	}
+	fileNames := []string{backupMetadataKey, backupClusterMetaKey}
+	return createBackupJob(backup, cr, backupMetadataJobName(backup.ObjectMeta.Name), dumpCmd, fileNames, &metaVolume)
+}
+
+func createBackupJob(backup *undermoonv1alpha1.UndermoonBackup, cr *undermoonv1alpha1.Undermoon, name, dumpCmd string, fileNames []string, metaVolume *corev1.Volume) *batchv1.Job {
+	labels := backupLabels(backup)
+	dest := backup.Spec.Destination
+	filePaths := []string{}
+	for _, fileName := range fileNames {
+		filePaths = append(filePaths, path.Join(backupDataPath, fileName))
+	}
+	// The size of the first file is reported through the termination message.
+	reportSizeCmd := fmt.Sprintf("stat -c %%s %s > /dev/termination-log", filePaths[0])
+
+	dataVolume := corev1.Volume{
+		Name: backupDataVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	}
+	dataMount := corev1.VolumeMount{
+		Name:      backupDataVolumeName,
+		MountPath: backupDataPath,
+	}
+	if dest.PersistentVolumeClaim != nil {
+		dataVolume.VolumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: dest.PersistentVolumeClaim.ClaimName,
+			},
+		}
+		dataMount.SubPath = backupDestinationPrefix(backup)
+	}
+
+	volumes := []corev1.Volume{dataVolume}
+	dumpMounts := []corev1.VolumeMount{dataMount}
+	if metaVolume != nil {
+		volumes = append(volumes, *metaVolume)
+		dumpMounts = append(dumpMounts, corev1.VolumeMount{
+			Name:      backupMetaVolumeName,
+			MountPath: backupMetaPath,
+		})
+	}
+
+	dumpContainer := corev1.Container{
+		Name:            backupDumpContainerName,
+		Image:           cr.Spec.RedisImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", dumpCmd},
+		// Used by `redis-cli` when the authentication is enabled.
+		Env:          genAuthEnv(cr, "REDISCLI_AUTH"),
+		VolumeMounts: dumpMounts,
+	}
+
+	uploadContainer := corev1.Container{
+		Name:            backupUploadContainerName,
+		Image:           cr.Spec.RedisImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", reportSizeCmd},
+		VolumeMounts:    []corev1.VolumeMount{dataMount},
+	}
+	if s3 := dest.S3; s3 != nil {
+		objectDir := path.Join(s3.Bucket, backupDestinationPrefix(backup))
+		uploadContainer.Image = DefaultBackupUploaderImage
+		uploadContainer.Env = genS3Env(s3)
+		uploadContainer.Command = []string{
+			"sh",
+			"-c",
+			fmt.Sprintf(
+				"%s && mc cp %s dest/%s/ && %s",
+				s3AliasCmd, strings.Join(filePaths, " "), objectDir, reportSizeCmd,
+			),
+		}
+	}
+
+	backoffLimit := backupJobBackoffLimit
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: backup.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{dumpContainer},
+					Containers:     []corev1.Container{uploadContainer},
+					Volumes:        volumes,
+				},
+			},
+		},
+	}
+}
+
+// createBackupCleanupJob removes the archive of the backup from the destination.
+func createBackupCleanupJob(backup *undermoonv1alpha1.UndermoonBackup, labels map[string]string) *batchv1.Job {
+	dest := backup.Spec.Destination
+	prefix := backupDestinationPrefix(backup)
+	container := corev1.Container{
+		Name:            "cleanup",
+		Image:           DefaultBackupUploaderImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+	}
+	volumes := []corev1.Volume{}
+	if s3 := dest.S3; s3 != nil {
+		container.Env = genS3Env(s3)
+		container.Command = []string{
+			"sh",
+			"-c",
+			fmt.Sprintf(
+				"%s && mc rm --recursive --force dest/%s/",
+				s3AliasCmd, path.Join(s3.Bucket, prefix),
+			),
+		}
+	} else if dest.PersistentVolumeClaim != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: backupDataVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: dest.PersistentVolumeClaim.ClaimName,
+				},
+			},
+		})
+		container.VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      backupDataVolumeName,
+				MountPath: backupDataPath,
+			},
+		}
+		container.Command = []string{"rm", "-rf", path.Join(backupDataPath, prefix)}
+	}
+
+	backoffLimit := backupJobBackoffLimit
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backupCleanupJobName(backup.ObjectMeta.Name),
+			Namespace: backup.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{container},
+					Volumes:       volumes,
+				},
+			},
+		},
+	}
+}
+
+func genS3Env(s3 *undermoonv1alpha1.S3BackupDestination) []corev1.EnvVar {
+	secretEnv := func(name, key string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: s3.CredentialsSecret},
+					Key:                  key,
+				},
+			},
+		}
+	}
+	return []corev1.EnvVar{
+		{
+			Name:  "S3_ENDPOINT",
+			Value: s3.Endpoint,
+		},
+		secretEnv("S3_ACCESS_KEY_ID", "accessKeyID"),
+		secretEnv("S3_SECRET_ACCESS_KEY", "secretAccessKey"),
+	}
+}
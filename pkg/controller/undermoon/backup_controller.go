@@ -0,0 +1,478 @@
+package undermoon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	pkgerrors "github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var backupLog = logf.Log.WithName("controller_undermoonbackup")
+
+// AddBackup creates a new UndermoonBackup Controller and adds it to the Manager.
+func AddBackup(mgr manager.Manager) error {
+	r := &ReconcileUndermoonBackup{
+		client:       mgr.GetClient(),
+		scheme:       mgr.GetScheme(),
+		recorder:     mgr.GetEventRecorderFor("undermoon-backup-controller"),
+		brokerClient: newBrokerClient(),
+	}
+
+	c, err := controller.New("undermoon-backup-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &undermoonv1alpha1.UndermoonBackup{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &batchv1.Job{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &undermoonv1alpha1.UndermoonBackup{},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileUndermoonBackup implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileUndermoonBackup{}
+
+// ReconcileUndermoonBackup reconciles a UndermoonBackup object
+type ReconcileUndermoonBackup struct {
+	client       client.Client
+	scheme       *runtime.Scheme
+	recorder     record.EventRecorder
+	brokerClient *brokerClient
+}
+
+// Reconcile backs up the master Redis of the referenced Undermoon cluster:
+// (1) take a snapshot of the broker metadata and find the master Redis,
+// (2) dump the RDB of each master Redis and copy it to the destination by Jobs,
+// (3) copy the metadata snapshot to the destination by a Job.
+func (r *ReconcileUndermoonBackup) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := backupLog.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
+	reqLogger.Info("Reconciling UndermoonBackup")
+
+	backup := &undermoonv1alpha1.UndermoonBackup{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, backup)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	if backupFinished(backup) {
+		err := r.recordBackupResult(reqLogger, backup)
+		if err == errRetryReconciliation {
+			return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	originalStatus := backup.Status.DeepCopy()
+	result, err := r.reconcileBackup(reqLogger, backup)
+	if err != nil && err != errRetryReconciliation {
+		reqLogger.Error(err, "failed to reconcile backup", "Name", backup.ObjectMeta.Name, "UndermoonName", backup.Spec.UndermoonName)
+		r.recorder.Event(backup, corev1.EventTypeWarning, eventReconcileFailed, err.Error())
+	}
+
+	statusErr := r.updateBackupStatus(reqLogger, backup, originalStatus)
+	if err == nil && statusErr != nil {
+		err = statusErr
+	}
+	if err == errRetryReconciliation {
+		return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
+	}
+	return result, err
+}
+
+func backupFinished(backup *undermoonv1alpha1.UndermoonBackup) bool {
+	phase := backup.Status.Phase
+	return phase == undermoonv1alpha1.BackupCompleted || phase == undermoonv1alpha1.BackupFailed
+}
+
+func (r *ReconcileUndermoonBackup) reconcileBackup(reqLogger logr.Logger, backup *undermoonv1alpha1.UndermoonBackup) (reconcile.Result, error) {
+	if backup.Status.Phase == "" {
+		now := metav1.Now()
+		backup.Status.Phase = undermoonv1alpha1.BackupPending
+		backup.Status.StartTime = &now
+	}
+
+	if err := validateBackupDestination(&backup.Spec.Destination); err != nil {
+		r.failBackup(backup, err.Error())
+		return reconcile.Result{}, nil
+	}
+
+	cr := &undermoonv1alpha1.Undermoon{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: backup.Spec.UndermoonName, Namespace: backup.Namespace}, cr)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			r.failBackup(backup, fmt.Sprintf("Undermoon %s not found", backup.Spec.UndermoonName))
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	cr.Default()
+
+	if backup.Status.Phase == undermoonv1alpha1.BackupPending {
+		err := r.startBackup(reqLogger, backup, cr)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	err = r.backupMetadata(reqLogger, backup, cr)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if backupFinished(backup) {
+		return reconcile.Result{}, nil
+	}
+
+	for i := range backup.Status.Shards {
+		err := r.backupShard(reqLogger, backup, cr, i)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	completed := backup.Status.MetadataCopied
+	var totalSize int64
+	for _, shard := range backup.Status.Shards {
+		switch shard.Phase {
+		case undermoonv1alpha1.ShardBackupFailed:
+			r.failBackup(backup, fmt.Sprintf("failed to back up %s: %s", shard.NodeAddress, shard.Message))
+			return reconcile.Result{}, nil
+		case undermoonv1alpha1.ShardBackupCompleted:
+			totalSize += shard.Size
+		default:
+			completed = false
+		}
+	}
+	backup.Status.TotalSize = totalSize
+
+	if !completed {
+		return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
+	}
+
+	now := metav1.Now()
+	backup.Status.Phase = undermoonv1alpha1.BackupCompleted
+	backup.Status.CompletionTime = &now
+	backup.Status.Message = fmt.Sprintf("backed up %d shards", len(backup.Status.Shards))
+	r.recorder.Eventf(backup, corev1.EventTypeNormal, eventBackupCompleted,
+		"Backed up %d shards of %s, %d bytes in total", len(backup.Status.Shards), cr.Spec.ClusterName, totalSize)
+	return reconcile.Result{}, nil
+}
+
+func validateBackupDestination(dest *undermoonv1alpha1.BackupDestination) error {
+	if (dest.PersistentVolumeClaim == nil) == (dest.S3 == nil) {
+		return pkgerrors.New("exactly one of persistentVolumeClaim and s3 should be specified in the destination")
+	}
+	return nil
+}
+
+func (r *ReconcileUndermoonBackup) failBackup(backup *undermoonv1alpha1.UndermoonBackup, message string) {
+	now := metav1.Now()
+	backup.Status.Phase = undermoonv1alpha1.BackupFailed
+	backup.Status.CompletionTime = &now
+	backup.Status.Message = message
+	r.recorder.Event(backup, corev1.EventTypeWarning, eventBackupFailed, message)
+}
+
+// startBackup takes a snapshot of the metadata and finds out all the master Redis.
+func (r *ReconcileUndermoonBackup) startBackup(reqLogger logr.Logger, backup *undermoonv1alpha1.UndermoonBackup, cr *undermoonv1alpha1.Undermoon) error {
+	masterBrokerAddress := cr.Status.MasterBrokerAddress
+	if masterBrokerAddress == "" {
+		reqLogger.Info("waiting for the master broker", "UndermoonName", cr.ObjectMeta.Name)
+		return errRetryReconciliation
+	}
+	if cr.Status.IsMigrating {
+		reqLogger.Info("waiting for the slot migration to finish", "UndermoonName", cr.ObjectMeta.Name)
+		return errRetryReconciliation
+	}
+
+	meta, err := r.brokerClient.getClusterMeta(masterBrokerAddress, cr.Spec.ClusterName)
+	if err != nil {
+		reqLogger.Error(err, "failed to get cluster meta", "UndermoonName", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	metadata, err := r.brokerClient.getMetadata(masterBrokerAddress)
+	if err != nil {
+		reqLogger.Error(err, "failed to get broker metadata", "UndermoonName", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	clusterMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	configMap := createBackupMetadataConfigMap(backup, metadata, clusterMeta)
+	if err := controllerutil.SetControllerReference(backup, configMap, r.scheme); err != nil {
+		return err
+	}
+	err = r.client.Create(context.TODO(), configMap)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		reqLogger.Error(err, "failed to create metadata ConfigMap", "Name", backup.ObjectMeta.Name)
+		return err
+	}
+
+	shards := []undermoonv1alpha1.ShardBackupStatus{}
+	for _, node := range meta.Nodes {
+		if node.Repl.Role != nodeRoleMaster {
+			continue
+		}
+		shards = append(shards, undermoonv1alpha1.ShardBackupStatus{
+			NodeAddress:  node.Address,
+			ProxyAddress: node.ProxyAddress,
+			Slots:        formatSlotRanges(node.Slots),
+			Phase:        undermoonv1alpha1.ShardBackupPending,
+			Path:         backupDestinationPath(backup, backupShardFileName(len(shards))),
+		})
+	}
+
+	backup.Status.Phase = undermoonv1alpha1.BackupRunning
+	backup.Status.Epoch = meta.Epoch
+	backup.Status.MetadataConfigMap = configMap.ObjectMeta.Name
+	backup.Status.MetadataPath = backupDestinationPath(backup, backupMetadataKey)
+	backup.Status.Shards = shards
+	r.recorder.Eventf(backup, corev1.EventTypeNormal, eventBackupStarted,
+		"Start backing up %d shards of %s at epoch %d", len(shards), cr.Spec.ClusterName, meta.Epoch)
+	return nil
+}
+
+func formatSlotRanges(slots []slotRange) string {
+	ranges := []string{}
+	for _, slot := range slots {
+		for _, r := range slot.RangeList {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	return strings.Join(ranges, ",")
+}
+
+func (r *ReconcileUndermoonBackup) backupMetadata(reqLogger logr.Logger, backup *undermoonv1alpha1.UndermoonBackup, cr *undermoonv1alpha1.Undermoon) error {
+	if backup.Status.MetadataCopied {
+		return nil
+	}
+	job := createBackupMetadataJob(backup, cr)
+	done, _, err := r.runBackupJob(reqLogger, backup, job)
+	if err != nil {
+		if err == errBackupJobFailed {
+			r.failBackup(backup, fmt.Sprintf("failed to copy the metadata snapshot: job %s failed", job.Name))
+			return nil
+		}
+		return err
+	}
+	backup.Status.MetadataCopied = done
+	return nil
+}
+
+func (r *ReconcileUndermoonBackup) backupShard(reqLogger logr.Logger, backup *undermoonv1alpha1.UndermoonBackup, cr *undermoonv1alpha1.Undermoon, index int) error {
+	shard := &backup.Status.Shards[index]
+	if shard.Phase != undermoonv1alpha1.ShardBackupPending && shard.Phase != undermoonv1alpha1.ShardBackupCopying {
+		return nil
+	}
+
+	job, err := createBackupShardJob(backup, cr, index, shard.NodeAddress)
+	if err != nil {
+		shard.Phase = undermoonv1alpha1.ShardBackupFailed
+		shard.Message = err.Error()
+		return nil
+	}
+	shard.Phase = undermoonv1alpha1.ShardBackupCopying
+	done, size, err := r.runBackupJob(reqLogger, backup, job)
+	if err != nil {
+		if err == errBackupJobFailed {
+			shard.Phase = undermoonv1alpha1.ShardBackupFailed
+			shard.Message = fmt.Sprintf("job %s failed", job.Name)
+			return nil
+		}
+		return err
+	}
+	if !done {
+		return nil
+	}
+
+	// The RDB is dumped when the job runs, not when the metadata snapshot is taken.
+	// They only match if the epoch has not changed since then.
+	masterBrokerAddress := cr.Status.MasterBrokerAddress
+	if masterBrokerAddress == "" {
+		reqLogger.Info("waiting for the master broker", "UndermoonName", cr.ObjectMeta.Name)
+		return errRetryReconciliation
+	}
+	meta, err := r.brokerClient.getClusterMeta(masterBrokerAddress, cr.Spec.ClusterName)
+	if err != nil {
+		reqLogger.Error(err, "failed to get cluster meta", "UndermoonName", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	if meta.Epoch != backup.Status.Epoch {
+		shard.Phase = undermoonv1alpha1.ShardBackupFailed
+		shard.Message = fmt.Sprintf("the epoch changed from %d to %d while dumping the RDB", backup.Status.Epoch, meta.Epoch)
+		return nil
+	}
+	shard.Phase = undermoonv1alpha1.ShardBackupCompleted
+	shard.Size = size
+	return nil
+}
+
+var errBackupJobFailed = pkgerrors.New("backup job failed")
+
+// runBackupJob creates the job if it does not exist and returns whether it succeeded
+// and the size of the file reported by the job.
+func (r *ReconcileUndermoonBackup) runBackupJob(reqLogger logr.Logger, backup *undermoonv1alpha1.UndermoonBackup, job *batchv1.Job) (bool, int64, error) {
+	if err := controllerutil.SetControllerReference(backup, job, r.scheme); err != nil {
+		return false, 0, err
+	}
+
+	found := &batchv1.Job{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating a new backup job", "Namespace", job.Namespace, "Name", job.Name)
+		err = r.client.Create(context.TODO(), job)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			reqLogger.Error(err, "failed to create backup job", "Name", job.Name)
+			return false, 0, err
+		}
+		return false, 0, nil
+	} else if err != nil {
+		reqLogger.Error(err, "failed to get backup job", "Name", job.Name)
+		return false, 0, err
+	}
+
+	for _, cond := range found.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			return false, 0, errBackupJobFailed
+		}
+	}
+	if found.Status.Succeeded == 0 {
+		return false, 0, nil
+	}
+
+	size, err := r.getBackupJobFileSize(found)
+	if err != nil {
+		reqLogger.Error(err, "failed to get the file size from the backup job", "Name", found.Name)
+		return false, 0, err
+	}
+	return true, size, nil
+}
+
+func (r *ReconcileUndermoonBackup) getBackupJobFileSize(job *batchv1.Job) (int64, error) {
+	podList := &corev1.PodList{}
+	err := r.client.List(
+		context.TODO(),
+		podList,
+		client.InNamespace(job.Namespace),
+		client.MatchingLabels{"job-name": job.Name},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != backupUploadContainerName || status.State.Terminated == nil {
+				continue
+			}
+			return strconv.ParseInt(strings.TrimSpace(status.State.Terminated.Message), 10, 64)
+		}
+	}
+	return 0, pkgerrors.Errorf("no succeeded pod found for job %s", job.Name)
+}
+
+// recordBackupResult reports the finished backup on the status of the Undermoon object.
+func (r *ReconcileUndermoonBackup) recordBackupResult(reqLogger logr.Logger, backup *undermoonv1alpha1.UndermoonBackup) error {
+	completionTime := backup.Status.CompletionTime
+	if completionTime == nil {
+		return nil
+	}
+
+	cr := &undermoonv1alpha1.Undermoon{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: backup.Spec.UndermoonName, Namespace: backup.Namespace}, cr)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	record := &undermoonv1alpha1.BackupRecord{}
+	if cr.Status.Backup != nil {
+		record = cr.Status.Backup.DeepCopy()
+	}
+	switch backup.Status.Phase {
+	case undermoonv1alpha1.BackupCompleted:
+		if record.LastSuccessfulTime != nil && !record.LastSuccessfulTime.Before(completionTime) {
+			return nil
+		}
+		record.LastSuccessfulBackup = backup.ObjectMeta.Name
+		record.LastSuccessfulTime = completionTime.DeepCopy()
+	case undermoonv1alpha1.BackupFailed:
+		if record.LastFailedTime != nil && !record.LastFailedTime.Before(completionTime) {
+			return nil
+		}
+		record.LastFailedBackup = backup.ObjectMeta.Name
+		record.LastFailedTime = completionTime.DeepCopy()
+	default:
+		return nil
+	}
+
+	cr.Status.Backup = record
+	err = r.client.Status().Update(context.TODO(), cr)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on recording backup result. Try again.", "error", err)
+			return errRetryReconciliation
+		}
+		reqLogger.Error(err, "Failed to record backup result", "UndermoonName", cr.ObjectMeta.Name)
+		return err
+	}
+	return nil
+}
+
+func (r *ReconcileUndermoonBackup) updateBackupStatus(reqLogger logr.Logger, backup *undermoonv1alpha1.UndermoonBackup, originalStatus *undermoonv1alpha1.UndermoonBackupStatus) error {
+	if equality.Semantic.DeepEqual(&backup.Status, originalStatus) {
+		return nil
+	}
+
+	err := r.client.Status().Update(context.TODO(), backup)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on updating backup status. Try again.", "error", err)
+			return errRetryReconciliation
+		}
+		reqLogger.Error(err, "Failed to update backup status", "Name", backup.ObjectMeta.Name)
+		return err
+	}
+	return nil
+}
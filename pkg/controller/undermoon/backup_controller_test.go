@@ -0,0 +1,133 @@
+package undermoon
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/doyoubi/undermoon-operator/pkg/apis"
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestBackup(cr *undermoonv1alpha1.Undermoon, epoch int64) *undermoonv1alpha1.UndermoonBackup {
+	return &undermoonv1alpha1.UndermoonBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-backup",
+			Namespace: cr.Namespace,
+		},
+		Spec: undermoonv1alpha1.UndermoonBackupSpec{
+			UndermoonName: cr.ObjectMeta.Name,
+			Destination: undermoonv1alpha1.BackupDestination{
+				PersistentVolumeClaim: &undermoonv1alpha1.PVCBackupDestination{ClaimName: "backup-pvc"},
+			},
+		},
+		Status: undermoonv1alpha1.UndermoonBackupStatus{
+			Phase: undermoonv1alpha1.BackupRunning,
+			Epoch: epoch,
+			Shards: []undermoonv1alpha1.ShardBackupStatus{
+				{
+					NodeAddress:  "127.0.0.1:7001",
+					ProxyAddress: "127.0.0.1:5299",
+					Phase:        undermoonv1alpha1.ShardBackupCopying,
+				},
+			},
+		},
+	}
+}
+
+// The shard job has finished and reported the size of the RDB file.
+func newTestFinishedShardJob(backup *undermoonv1alpha1.UndermoonBackup) []runtime.Object {
+	jobName := backupShardJobName(backup.ObjectMeta.Name, 0)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: jobName, Namespace: backup.Namespace},
+		Status:     batchv1.JobStatus{Succeeded: 1},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName + "-abcde",
+			Namespace: backup.Namespace,
+			Labels:    map[string]string{"job-name": jobName},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodSucceeded,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name: backupUploadContainerName,
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{Message: "1024\n"},
+					},
+				},
+			},
+		},
+	}
+	return []runtime.Object{job, pod}
+}
+
+func newTestEpochBroker(t *testing.T, epoch int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/api/v2/clusters/meta/") {
+			t.Errorf("unexpected broker request %s %s", req.Method, req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"cluster":{"name":"test-cluster","epoch":%d,"nodes":[]}}`, epoch)))
+	}))
+}
+
+func TestBackupShardCheckEpoch(t *testing.T) {
+	cases := []struct {
+		name        string
+		brokerEpoch int64
+		phase       undermoonv1alpha1.ShardBackupPhase
+		size        int64
+	}{
+		{"epoch not changed", 3, undermoonv1alpha1.ShardBackupCompleted, 1024},
+		{"epoch changed", 4, undermoonv1alpha1.ShardBackupFailed, 0},
+	}
+
+	s := runtime.NewScheme()
+	if err := scheme.AddToScheme(s); err != nil {
+		t.Fatalf("failed to add scheme: %v", err)
+	}
+	if err := apis.AddToScheme(s); err != nil {
+		t.Fatalf("failed to add undermoon scheme: %v", err)
+	}
+
+	for _, c := range cases {
+		broker := newTestEpochBroker(t, c.brokerEpoch)
+		cr := newTestUndermoon()
+		cr.Status.MasterBrokerAddress = strings.TrimPrefix(broker.URL, "http://")
+		backup := newTestBackup(cr, 3)
+
+		r := &ReconcileUndermoonBackup{
+			client:       fake.NewFakeClientWithScheme(s, newTestFinishedShardJob(backup)...),
+			scheme:       s,
+			recorder:     record.NewFakeRecorder(100),
+			brokerClient: newBrokerClient(),
+		}
+		err := r.backupShard(backupLog, backup, cr, 0)
+		broker.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		shard := backup.Status.Shards[0]
+		if shard.Phase != c.phase {
+			t.Errorf("%s: expected phase %s, got %s: %s", c.name, c.phase, shard.Phase, shard.Message)
+		}
+		if shard.Size != c.size {
+			t.Errorf("%s: expected size %d, got %d", c.name, c.size, shard.Size)
+		}
+	}
+}
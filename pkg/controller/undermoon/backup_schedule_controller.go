@@ -0,0 +1,342 @@
+package undermoon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var backupScheduleLog = logf.Log.WithName("controller_undermoonbackupschedule")
+
+const defaultBackupRetentionCount int32 = 7
+
+// AddBackupSchedule creates a new UndermoonBackupSchedule Controller and adds it to the Manager.
+func AddBackupSchedule(mgr manager.Manager) error {
+	r := &ReconcileUndermoonBackupSchedule{
+		client:   mgr.GetClient(),
+		scheme:   mgr.GetScheme(),
+		recorder: mgr.GetEventRecorderFor("undermoon-backup-schedule-controller"),
+	}
+
+	c, err := controller.New("undermoon-backup-schedule-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &undermoonv1alpha1.UndermoonBackupSchedule{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// The backups and the cleanup jobs.
+	ownedTypes := []runtime.Object{
+		&undermoonv1alpha1.UndermoonBackup{},
+		&batchv1.Job{},
+	}
+	for _, t := range ownedTypes {
+		err = c.Watch(&source.Kind{Type: t}, &handler.EnqueueRequestForOwner{
+			IsController: true,
+			OwnerType:    &undermoonv1alpha1.UndermoonBackupSchedule{},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileUndermoonBackupSchedule implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileUndermoonBackupSchedule{}
+
+// ReconcileUndermoonBackupSchedule reconciles a UndermoonBackupSchedule object
+type ReconcileUndermoonBackupSchedule struct {
+	client   client.Client
+	scheme   *runtime.Scheme
+	recorder record.EventRecorder
+}
+
+// Reconcile creates an UndermoonBackup on each tick of the cron schedule
+// and deletes the old backups together with their archives.
+func (r *ReconcileUndermoonBackupSchedule) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := backupScheduleLog.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
+	reqLogger.Info("Reconciling UndermoonBackupSchedule")
+
+	schedule := &undermoonv1alpha1.UndermoonBackupSchedule{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, schedule)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	originalStatus := schedule.Status.DeepCopy()
+	result, err := r.reconcileSchedule(reqLogger, schedule)
+	if err != nil && err != errRetryReconciliation {
+		reqLogger.Error(err, "failed to reconcile backup schedule", "Name", schedule.ObjectMeta.Name, "UndermoonName", schedule.Spec.UndermoonName)
+		r.recorder.Event(schedule, corev1.EventTypeWarning, eventReconcileFailed, err.Error())
+	}
+
+	statusErr := r.updateScheduleStatus(reqLogger, schedule, originalStatus)
+	if err == nil && statusErr != nil {
+		err = statusErr
+	}
+	if err == errRetryReconciliation {
+		return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
+	}
+	return result, err
+}
+
+func (r *ReconcileUndermoonBackupSchedule) reconcileSchedule(reqLogger logr.Logger, schedule *undermoonv1alpha1.UndermoonBackupSchedule) (reconcile.Result, error) {
+	backups, err := r.listScheduledBackups(schedule)
+	if err != nil {
+		reqLogger.Error(err, "failed to list backups", "Name", schedule.ObjectMeta.Name)
+		return reconcile.Result{}, err
+	}
+	refreshScheduleStatus(schedule, backups)
+	schedule.Status.Message = ""
+
+	err = r.pruneBackups(reqLogger, schedule, backups)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	sched, err := cron.ParseStandard(schedule.Spec.Schedule)
+	if err != nil {
+		message := fmt.Sprintf("invalid schedule %q: %s", schedule.Spec.Schedule, err)
+		r.recorder.Event(schedule, corev1.EventTypeWarning, eventInvalidSchedule, message)
+		schedule.Status.Message = message
+		return reconcile.Result{}, nil
+	}
+
+	if schedule.Spec.Suspend {
+		return reconcile.Result{}, nil
+	}
+
+	now := time.Now()
+	earliest := schedule.ObjectMeta.CreationTimestamp.Time
+	if schedule.Status.LastScheduleTime != nil {
+		earliest = schedule.Status.LastScheduleTime.Time
+	}
+	// Only the latest missed tick is run.
+	var scheduledTime time.Time
+	for t := sched.Next(earliest); !t.After(now); t = sched.Next(t) {
+		scheduledTime = t
+	}
+
+	if !scheduledTime.IsZero() {
+		err := r.runScheduledBackup(reqLogger, schedule, scheduledTime)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		schedule.Status.LastScheduleTime = &metav1.Time{Time: scheduledTime}
+	}
+
+	return reconcile.Result{RequeueAfter: sched.Next(now).Sub(now)}, nil
+}
+
+func (r *ReconcileUndermoonBackupSchedule) runScheduledBackup(reqLogger logr.Logger, schedule *undermoonv1alpha1.UndermoonBackupSchedule, scheduledTime time.Time) error {
+	// Don't let the backups compete for dumping the RDB.
+	if len(schedule.Status.Active) != 0 {
+		reqLogger.Info("skip the scheduled backup since the last one is still running", "active", schedule.Status.Active)
+		r.recorder.Eventf(schedule, corev1.EventTypeNormal, eventBackupSkipped,
+			"Skipped the backup scheduled at %s since %v is still running", scheduledTime.Format(time.RFC3339), schedule.Status.Active)
+		return nil
+	}
+
+	backup := createScheduledBackup(schedule, scheduledTime)
+	if err := controllerutil.SetControllerReference(schedule, backup, r.scheme); err != nil {
+		return err
+	}
+	err := r.client.Create(context.TODO(), backup)
+	if err != nil {
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+		reqLogger.Error(err, "failed to create scheduled backup", "Name", schedule.ObjectMeta.Name, "backup", backup.ObjectMeta.Name)
+		return err
+	}
+	reqLogger.Info("created scheduled backup", "backup", backup.ObjectMeta.Name)
+	r.recorder.Eventf(schedule, corev1.EventTypeNormal, eventBackupScheduled, "Created backup %s", backup.ObjectMeta.Name)
+	schedule.Status.Active = append(schedule.Status.Active, backup.ObjectMeta.Name)
+	return nil
+}
+
+// listScheduledBackups returns the backups created by this schedule, newest first.
+func (r *ReconcileUndermoonBackupSchedule) listScheduledBackups(schedule *undermoonv1alpha1.UndermoonBackupSchedule) ([]undermoonv1alpha1.UndermoonBackup, error) {
+	backupList := &undermoonv1alpha1.UndermoonBackupList{}
+	err := r.client.List(
+		context.TODO(),
+		backupList,
+		client.InNamespace(schedule.Namespace),
+		client.MatchingLabels{"undermoonBackupScheduleName": schedule.ObjectMeta.Name},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []undermoonv1alpha1.UndermoonBackup{}
+	for _, backup := range backupList.Items {
+		if !metav1.IsControlledBy(&backup, schedule) {
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[j].ObjectMeta.CreationTimestamp.Before(&backups[i].ObjectMeta.CreationTimestamp)
+	})
+	return backups, nil
+}
+
+func refreshScheduleStatus(schedule *undermoonv1alpha1.UndermoonBackupSchedule, backups []undermoonv1alpha1.UndermoonBackup) {
+	active := []string{}
+	for i := range backups {
+		backup := &backups[i]
+		completionTime := backup.Status.CompletionTime
+		switch backup.Status.Phase {
+		case undermoonv1alpha1.BackupCompleted:
+			if completionTime != nil && (schedule.Status.LastSuccessfulTime == nil || schedule.Status.LastSuccessfulTime.Before(completionTime)) {
+				schedule.Status.LastSuccessfulTime = completionTime.DeepCopy()
+			}
+		case undermoonv1alpha1.BackupFailed:
+			if completionTime != nil && (schedule.Status.LastFailedTime == nil || schedule.Status.LastFailedTime.Before(completionTime)) {
+				schedule.Status.LastFailedTime = completionTime.DeepCopy()
+			}
+		default:
+			active = append(active, backup.ObjectMeta.Name)
+		}
+	}
+	sort.Strings(active)
+	if len(active) == 0 {
+		active = nil
+	}
+	schedule.Status.Active = active
+}
+
+// pruneBackups deletes the finished backups beyond the retention policy.
+// The latest completed backup is always kept.
+func (r *ReconcileUndermoonBackupSchedule) pruneBackups(reqLogger logr.Logger, schedule *undermoonv1alpha1.UndermoonBackupSchedule, backups []undermoonv1alpha1.UndermoonBackup) error {
+	retention := schedule.Spec.Retention
+	maxCount := defaultBackupRetentionCount
+	if retention.MaxCount != nil {
+		maxCount = *retention.MaxCount
+	}
+
+	now := time.Now()
+	latestCompletedFound := false
+	var finishedNum int32
+	for i := range backups {
+		backup := &backups[i]
+		if !backupFinished(backup) {
+			continue
+		}
+		finishedNum++
+		if backup.Status.Phase == undermoonv1alpha1.BackupCompleted && !latestCompletedFound {
+			latestCompletedFound = true
+			continue
+		}
+
+		expired := maxCount > 0 && finishedNum > maxCount
+		if retention.MaxAge != nil && now.Sub(backup.ObjectMeta.CreationTimestamp.Time) > retention.MaxAge.Duration {
+			expired = true
+		}
+		if !expired {
+			continue
+		}
+
+		err := r.pruneBackup(reqLogger, schedule, backup)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBackup removes the archive by a Job before deleting the UndermoonBackup.
+func (r *ReconcileUndermoonBackupSchedule) pruneBackup(reqLogger logr.Logger, schedule *undermoonv1alpha1.UndermoonBackupSchedule, backup *undermoonv1alpha1.UndermoonBackup) error {
+	job := createBackupCleanupJob(backup, backupScheduleLabels(schedule))
+	if err := controllerutil.SetControllerReference(schedule, job, r.scheme); err != nil {
+		return err
+	}
+
+	found := &batchv1.Job{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating a new backup cleanup job", "Namespace", job.Namespace, "Name", job.Name)
+		err = r.client.Create(context.TODO(), job)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			reqLogger.Error(err, "failed to create backup cleanup job", "Name", job.Name)
+			return err
+		}
+		return nil
+	} else if err != nil {
+		reqLogger.Error(err, "failed to get backup cleanup job", "Name", job.Name)
+		return err
+	}
+
+	for _, cond := range found.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			// Keep the backup and the failed job for investigation.
+			message := fmt.Sprintf("failed to remove the archive of %s: job %s failed", backup.ObjectMeta.Name, found.Name)
+			r.recorder.Event(schedule, corev1.EventTypeWarning, eventBackupPruneFailed, message)
+			schedule.Status.Message = message
+			return nil
+		}
+	}
+	if found.Status.Succeeded == 0 {
+		return nil
+	}
+
+	err = r.client.Delete(context.TODO(), backup)
+	if err != nil && !errors.IsNotFound(err) {
+		reqLogger.Error(err, "failed to delete backup", "backup", backup.ObjectMeta.Name)
+		return err
+	}
+	err = r.client.Delete(context.TODO(), found, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		reqLogger.Error(err, "failed to delete backup cleanup job", "Name", found.Name)
+		return err
+	}
+	reqLogger.Info("pruned backup", "backup", backup.ObjectMeta.Name)
+	r.recorder.Eventf(schedule, corev1.EventTypeNormal, eventBackupPruned, "Deleted backup %s and its archive", backup.ObjectMeta.Name)
+	return nil
+}
+
+func (r *ReconcileUndermoonBackupSchedule) updateScheduleStatus(reqLogger logr.Logger, schedule *undermoonv1alpha1.UndermoonBackupSchedule, originalStatus *undermoonv1alpha1.UndermoonBackupScheduleStatus) error {
+	if equality.Semantic.DeepEqual(&schedule.Status, originalStatus) {
+		return nil
+	}
+
+	err := r.client.Status().Update(context.TODO(), schedule)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on updating backup schedule status. Try again.", "error", err)
+			return errRetryReconciliation
+		}
+		reqLogger.Error(err, "Failed to update backup schedule status", "Name", schedule.ObjectMeta.Name)
+		return err
+	}
+	return nil
+}
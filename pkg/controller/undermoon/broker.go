@@ -2,6 +2,7 @@ package undermoon
 
 import (
 	"fmt"
+	"strconv"
 
 	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
@@ -10,10 +11,10 @@ import (
 )
 
 const brokerPort = 7799
-const brokerNum int32 = 3
 const brokerContainerName = "broker"
 const undermoonServiceTypeBroker = "broker"
-const brokerTopologyKey = "undermoon-broker-topology-key"
+const brokerMetaVolumeName = "broker-meta"
+const brokerMetaPath = "/undermoon-meta"
 
 func createBrokerService(cr *undermoonv1alpha1.Undermoon) *corev1.Service {
 	undermoonName := cr.ObjectMeta.Name
@@ -65,25 +66,13 @@ func createBrokerStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulSe
 			Name:  "UNDERMOON_ADDRESS",
 			Value: fmt.Sprintf("0.0.0.0:%d", brokerPort),
 		},
-		{
-			Name:  "UNDERMOON_FAILURE_TTL",
-			Value: "60",
-		},
-		{
-			Name:  "UNDERMOON_FAILURE_QUORUM",
-			Value: "2",
-		},
-		{
-			Name:  "UNDERMOON_MIGRATION_LIMIT",
-			Value: "2",
-		},
 		{
 			Name:  "UNDERMOON_RECOVER_FROM_META_FILE",
 			Value: "true",
 		},
 		{
 			Name:  "UNDERMOON_META_FILENAME",
-			Value: "metadata",
+			Value: genBrokerMetaFilename(cr),
 		},
 		{
 			Name:  "UNDERMOON_AUTO_UPDATE_META_FILE",
@@ -91,7 +80,7 @@ func createBrokerStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulSe
 		},
 		{
 			Name:  "UNDERMOON_UPDATE_META_FILE_INTERVAL",
-			Value: "10",
+			Value: strconv.FormatUint(uint64(cr.Spec.BrokerConfig.UpdateMetaFileInterval), 10),
 		},
 		{
 			Name:  "UNDERMOON_REPLICA_ADDRESSES",
@@ -99,7 +88,7 @@ func createBrokerStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulSe
 		},
 		{
 			Name:  "UNDERMOON_SYNC_META_INTERVAL",
-			Value: "5",
+			Value: strconv.FormatUint(uint64(cr.Spec.BrokerConfig.SyncMetaInterval), 10),
 		},
 		{
 			Name:  "UNDERMOON_ENABLE_ORDERED_PROXY",
@@ -117,18 +106,39 @@ func createBrokerStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulSe
 		Command:         []string{"mem_broker"},
 		Env:             env,
 		Resources:       cr.Spec.BrokerResources,
+		// The failure detection and migration settings are not in the pod template
+		// so that changing them does not restart the brokers.
+		EnvFrom: []corev1.EnvFromSource{
+			{
+				ConfigMapRef: &corev1.ConfigMapEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: BrokerConfigMapName(cr.ObjectMeta.Name),
+					},
+				},
+			},
+		},
+	}
+	if cr.Spec.BrokerPersistence != nil {
+		container.VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      brokerMetaVolumeName,
+				MountPath: brokerMetaPath,
+			},
+		}
 	}
 	podSpec := corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels: labels,
 		},
 		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{container},
-			Affinity:   genAntiAffinity(labels, cr.ObjectMeta.Namespace, brokerTopologyKey),
+			Containers:                []corev1.Container{container},
+			Affinity:                  genAntiAffinity(labels, cr.ObjectMeta.Namespace, &cr.Spec.Placement),
+			TopologySpreadConstraints: genTopologySpreadConstraints(labels, &cr.Spec.Placement),
 		},
 	}
+	applyPodSettings(&podSpec, &cr.Spec.BrokerPod)
 
-	replicaNum := brokerNum
+	replicaNum := int32(cr.Spec.BrokerNum)
 
 	return &appsv1.StatefulSet{
 		TypeMeta: metav1.TypeMeta{
@@ -146,6 +156,77 @@ func createBrokerStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulSe
 			Replicas:            &replicaNum,
 			Template:            podSpec,
 			PodManagementPolicy: appsv1.ParallelPodManagement,
+			// The master broker is restarted last by the operator.
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.OnDeleteStatefulSetStrategyType,
+			},
+			VolumeClaimTemplates: genBrokerVolumeClaimTemplates(cr),
+		},
+	}
+}
+
+// BrokerConfigMapName defines the ConfigMap for the settings
+// which can be changed without restarting the brokers.
+func BrokerConfigMapName(undermoonName string) string {
+	return fmt.Sprintf("%s-bk-config", undermoonName)
+}
+
+func createBrokerConfigMap(cr *undermoonv1alpha1.Undermoon) *corev1.ConfigMap {
+	config := &cr.Spec.BrokerConfig
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      BrokerConfigMapName(cr.ObjectMeta.Name),
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"undermoonService":     undermoonServiceTypeBroker,
+				"undermoonName":        cr.ObjectMeta.Name,
+				"undermoonClusterName": cr.Spec.ClusterName,
+			},
+		},
+		Data: map[string]string{
+			"UNDERMOON_FAILURE_TTL":     strconv.FormatUint(uint64(config.FailureTTL), 10),
+			"UNDERMOON_FAILURE_QUORUM":  strconv.FormatUint(uint64(config.FailureQuorum), 10),
+			"UNDERMOON_MIGRATION_LIMIT": strconv.FormatUint(uint64(config.MigrationLimit), 10),
+		},
+	}
+}
+
+func genBrokerRuntimeConfig(cr *undermoonv1alpha1.Undermoon) brokerRuntimeConfig {
+	config := &cr.Spec.BrokerConfig
+	return brokerRuntimeConfig{
+		FailureTTL:     uint64(config.FailureTTL),
+		FailureQuorum:  uint64(config.FailureQuorum),
+		MigrationLimit: uint64(config.MigrationLimit),
+	}
+}
+
+// The metadata file is only kept after restarting when the persistent volume is used.
+func genBrokerMetaFilename(cr *undermoonv1alpha1.Undermoon) string {
+	if cr.Spec.BrokerPersistence == nil {
+		return "metadata"
+	}
+	return fmt.Sprintf("%s/metadata", brokerMetaPath)
+}
+
+func genBrokerVolumeClaimTemplates(cr *undermoonv1alpha1.Undermoon) []corev1.PersistentVolumeClaim {
+	persistence := cr.Spec.BrokerPersistence
+	if persistence == nil {
+		return nil
+	}
+	return []corev1.PersistentVolumeClaim{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: brokerMetaVolumeName,
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				StorageClassName: persistence.StorageClassName,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: persistence.Size,
+					},
+				},
+			},
 		},
 	}
 }
@@ -155,9 +236,9 @@ func BrokerStatefulSetName(undermoonName string) string {
 	return fmt.Sprintf("%s-bk-ss", undermoonName)
 }
 
-func genBrokerNames(undermoonName string) []string {
+func genBrokerNames(undermoonName string, replicas int) []string {
 	names := []string{}
-	for i := int32(0); i != brokerNum; i++ {
+	for i := 0; i != replicas; i++ {
 		name := fmt.Sprintf("%s-%d", BrokerStatefulSetName(undermoonName), i)
 		names = append(names, name)
 	}
@@ -171,7 +252,7 @@ func genBrokerFQDN(podName, undermoonName, namespace string) string {
 
 func genBrokerStatefulSetAddrs(cr *undermoonv1alpha1.Undermoon) []string {
 	addrs := []string{}
-	for _, name := range genBrokerNames(cr.ObjectMeta.Name) {
+	for _, name := range genBrokerNames(cr.ObjectMeta.Name, int(cr.Spec.BrokerNum)) {
 		addr := genBrokerAddressFromName(name, cr)
 		addrs = append(addrs, addr)
 	}
@@ -77,6 +77,47 @@ func (client *brokerClient) storeReplicaAddresses(address string, replicaAddress
 	return nil
 }
 
+// brokerRuntimeConfig is the part of the broker config
+// which can be changed without restarting the broker.
+type brokerRuntimeConfig struct {
+	FailureTTL     uint64 `json:"failure_ttl"`
+	FailureQuorum  uint64 `json:"failure_quorum"`
+	MigrationLimit uint64 `json:"migration_limit"`
+}
+
+func (client *brokerClient) getRuntimeConfig(address string) (*brokerRuntimeConfig, error) {
+	url := fmt.Sprintf("http://%s/api/v2/config", address)
+	res, err := client.httpClient.R().SetResult(&brokerRuntimeConfig{}).Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode() != 200 {
+		return nil, errors.Errorf("Failed to get config from broker: invalid status code %d", res.StatusCode())
+	}
+
+	config, ok := res.Result().(*brokerRuntimeConfig)
+	if !ok {
+		content := res.Body()
+		return nil, errors.Errorf("Failed to get config from broker: invalid response payload %s", string(content))
+	}
+	return config, nil
+}
+
+func (client *brokerClient) setRuntimeConfig(address string, config brokerRuntimeConfig) error {
+	url := fmt.Sprintf("http://%s/api/v2/config", address)
+	res, err := client.httpClient.R().SetBody(&config).Put(url)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode() != 200 {
+		content := res.Body()
+		return errors.Errorf("Failed to set broker config: invalid status code %d: %s", res.StatusCode(), string(content))
+	}
+	return nil
+}
+
 func (client *brokerClient) getEpoch(address string) (int64, error) {
 	url := fmt.Sprintf("http://%s/api/v2/epoch", address)
 	res, err := client.httpClient.R().Get(url)
@@ -348,3 +389,112 @@ func (client *brokerClient) fixEpoch(address string) error {
 	content := res.Body()
 	return errors.Errorf("Failed to get cluster info: invalid status code %d: %s", res.StatusCode(), string(content))
 }
+
+type slotRange struct {
+	RangeList [][2]int `json:"range_list"`
+}
+
+type replPeer struct {
+	NodeAddress  string `json:"node_address"`
+	ProxyAddress string `json:"proxy_address"`
+}
+
+type replMeta struct {
+	Role  string     `json:"role"`
+	Peers []replPeer `json:"peers"`
+}
+
+const nodeRoleMaster = "master"
+
+type clusterNode struct {
+	Address      string      `json:"address"`
+	ProxyAddress string      `json:"proxy_address"`
+	ClusterName  string      `json:"cluster_name"`
+	Slots        []slotRange `json:"slots"`
+	Repl         replMeta    `json:"repl"`
+}
+
+type clusterMeta struct {
+	Name  string        `json:"name"`
+	Epoch int64         `json:"epoch"`
+	Nodes []clusterNode `json:"nodes"`
+}
+
+type clusterMetaResponse struct {
+	Cluster *clusterMeta `json:"cluster"`
+}
+
+func (client *brokerClient) getClusterMeta(address, clusterName string) (*clusterMeta, error) {
+	url := fmt.Sprintf("http://%s/api/v2/clusters/meta/%s", address, clusterName)
+	res, err := client.httpClient.R().SetResult(&clusterMetaResponse{}).Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode() != 200 {
+		content := res.Body()
+		return nil, errors.Errorf("Failed to get cluster meta: invalid status code %d: %s", res.StatusCode(), string(content))
+	}
+
+	response, ok := res.Result().(*clusterMetaResponse)
+	if !ok || response.Cluster == nil {
+		content := res.Body()
+		return nil, errors.Errorf("Failed to get cluster meta: invalid response payload %s", string(content))
+	}
+	return response.Cluster, nil
+}
+
+// failoverServerProxy lets the peer proxy take over the master nodes of this proxy.
+func (client *brokerClient) failoverServerProxy(address, proxyAddress string) error {
+	url := fmt.Sprintf("http://%s/api/v2/proxies/failover/%s", address, proxyAddress)
+	res, err := client.httpClient.R().SetError(&errorResponse{}).Post(url)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode() == 200 {
+		return nil
+	}
+
+	if res.StatusCode() == 409 {
+		response, ok := res.Error().(*errorResponse)
+		if ok && response.Error == errStrMigrationRunning {
+			return errMigrationRunning
+		}
+	}
+
+	content := res.Body()
+	return errors.Errorf("Failed to failover server proxy: invalid status code %d: %s", res.StatusCode(), string(content))
+}
+
+// getMetadata returns the whole metadata of the broker
+// which can be used to recover the broker by PUT /api/v2/metadata.
+func (client *brokerClient) getMetadata(address string) ([]byte, error) {
+	url := fmt.Sprintf("http://%s/api/v2/metadata", address)
+	res, err := client.httpClient.R().Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode() != 200 {
+		content := res.Body()
+		return nil, errors.Errorf("Failed to get broker metadata: invalid status code %d: %s", res.StatusCode(), string(content))
+	}
+	return res.Body(), nil
+}
+
+// restoreMetadata replaces the whole metadata of the broker.
+// It should only be sent to a broker without any server proxy registered.
+func (client *brokerClient) restoreMetadata(address string, metadata []byte) error {
+	url := fmt.Sprintf("http://%s/api/v2/metadata", address)
+	res, err := client.httpClient.R().SetBody(metadata).Put(url)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode() != 200 {
+		content := res.Body()
+		return errors.Errorf("Failed to restore broker metadata: invalid status code %d: %s", res.StatusCode(), string(content))
+	}
+	return nil
+}
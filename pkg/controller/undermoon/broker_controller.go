@@ -2,6 +2,7 @@ package undermoon
 
 import (
 	"context"
+	"reflect"
 
 	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
 	"github.com/go-logr/logr"
@@ -32,6 +33,12 @@ func (con *memBrokerController) createBroker(reqLogger logr.Logger, cr *undermoo
 		return nil, nil, err
 	}
 
+	// The brokers load a part of the config from it.
+	err = con.createOrUpdateBrokerConfigMap(reqLogger, cr)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	brokerStatefulSet, err := createStatefulSetGuard(func() (*appsv1.StatefulSet, error) {
 		return con.getOrCreateBrokerStatefulSet(reqLogger, cr)
 	})
@@ -43,15 +50,76 @@ func (con *memBrokerController) createBroker(reqLogger logr.Logger, cr *undermoo
 	return brokerStatefulSet, brokerService, nil
 }
 
+func (con *memBrokerController) createOrUpdateBrokerConfigMap(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) error {
+	configMap := createBrokerConfigMap(cr)
+	if err := controllerutil.SetControllerReference(cr, configMap, con.r.scheme); err != nil {
+		return err
+	}
+
+	found := &corev1.ConfigMap{}
+	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: configMap.Name, Namespace: configMap.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating a new broker ConfigMap", "Namespace", configMap.Namespace, "Name", configMap.Name)
+		err = con.r.client.Create(context.TODO(), configMap)
+	} else if err == nil && !reflect.DeepEqual(found.Data, configMap.Data) {
+		found.Data = configMap.Data
+		err = con.r.client.Update(context.TODO(), found)
+	}
+	if err != nil {
+		reqLogger.Error(err, "failed to create or update broker ConfigMap", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	return nil
+}
+
+// reconcileConfig applies the config to the running brokers
+// since the ConfigMap is only loaded when the brokers start.
+func (con *memBrokerController) reconcileConfig(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, brokerService *corev1.Service) error {
+	endpoints, err := getEndpoints(con.r.client, brokerService.Name, brokerService.Namespace)
+	if err != nil {
+		reqLogger.Error(err, "failed to get broker endpoints", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	desired := genBrokerRuntimeConfig(cr)
+	for _, endpoint := range endpoints {
+		address := genBrokerAddressFromName(endpoint.Hostname, cr)
+		config, err := con.client.getRuntimeConfig(address)
+		if err != nil {
+			reqLogger.Error(err, "failed to get broker config", "brokerAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return err
+		}
+		if *config == desired {
+			continue
+		}
+
+		err = con.client.setRuntimeConfig(address, desired)
+		if err != nil {
+			reqLogger.Error(err, "failed to set broker config", "brokerAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventBrokerConfigFailed, "Failed to set the config of broker %s: %s", address, err)
+			return err
+		}
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventBrokerConfigUpdated,
+			"Set failureTTL=%d failureQuorum=%d migrationLimit=%d on broker %s",
+			desired.FailureTTL, desired.FailureQuorum, desired.MigrationLimit, address)
+	}
+	return nil
+}
+
 func (con *memBrokerController) getOrCreateBrokerService(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) (*corev1.Service, error) {
 	service := createBrokerService(cr)
 
 	if err := controllerutil.SetControllerReference(cr, service, con.r.scheme); err != nil {
 		return nil, err
 	}
+	hash, err := serviceSpecHash(service)
+	if err != nil {
+		return nil, err
+	}
+	setSpecHashAnnotation(&service.ObjectMeta, hash)
 
 	found := &corev1.Service{}
-	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, found)
+	err = con.r.client.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		reqLogger.Info("Creating a new broker service", "Namespace", service.Namespace, "Name", service.Name)
 		err = con.r.client.Create(context.TODO(), service)
@@ -65,14 +133,23 @@ func (con *memBrokerController) getOrCreateBrokerService(reqLogger logr.Logger,
 		}
 
 		reqLogger.Info("Successfully created a new broker service", "Namespace", service.Namespace, "Name", service.Name)
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCreatedService, "Created broker service %s", service.Name)
 		return service, nil
 	} else if err != nil {
 		reqLogger.Error(err, "failed to get broker service")
 		return nil, err
 	}
 
-	reqLogger.Info("Skip reconcile: broker service already exists", "Namespace", found.Namespace, "Name", found.Name)
-	return found, nil
+	updated, changed, err := updateServiceIfChanged(con.r.client, reqLogger, found, service)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventUpdatedService, "Updated broker service %s", found.Name)
+	} else {
+		reqLogger.Info("Skip reconcile: broker service already exists", "Namespace", found.Namespace, "Name", found.Name)
+	}
+	return updated, nil
 }
 
 func (con *memBrokerController) getOrCreateBrokerStatefulSet(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) (*appsv1.StatefulSet, error) {
@@ -82,10 +159,15 @@ func (con *memBrokerController) getOrCreateBrokerStatefulSet(reqLogger logr.Logg
 		reqLogger.Error(err, "SetControllerReference failed")
 		return nil, err
 	}
+	hash, err := statefulSetSpecHash(broker)
+	if err != nil {
+		return nil, err
+	}
+	setSpecHashAnnotation(&broker.ObjectMeta, hash)
 
 	// Check if this broker Statefulset already exists
 	found := &appsv1.StatefulSet{}
-	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: broker.Name, Namespace: broker.Namespace}, found)
+	err = con.r.client.Get(context.TODO(), types.NamespacedName{Name: broker.Name, Namespace: broker.Namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		reqLogger.Info("Creating a new broker statefulset", "Namespace", broker.Namespace, "Name", broker.Name)
 		err = con.r.client.Create(context.TODO(), broker)
@@ -99,6 +181,7 @@ func (con *memBrokerController) getOrCreateBrokerStatefulSet(reqLogger logr.Logg
 		}
 
 		// Statefulset created successfully - don't requeue
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCreatedStatefulSet, "Created broker statefulset %s", broker.Name)
 		return broker, nil
 	} else if err != nil {
 		reqLogger.Error(err, "failed to get broker statefulset")
@@ -106,8 +189,16 @@ func (con *memBrokerController) getOrCreateBrokerStatefulSet(reqLogger logr.Logg
 	}
 
 	// broker already exists - don't requeue
-	reqLogger.Info("Skip reconcile: broker statefulset already exists", "Namespace", found.Namespace, "Name", found.Name)
-	return found, nil
+	updated, changed, err := updateStatefulSetIfChanged(con.r.client, reqLogger, found, broker)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventUpdatedStatefulSet, "Updated broker statefulset %s", found.Name)
+	} else {
+		reqLogger.Info("Skip reconcile: broker statefulset already exists", "Namespace", found.Namespace, "Name", found.Name)
+	}
+	return updated, nil
 }
 
 func (con *memBrokerController) getServiceEndpointsNum(brokerService *corev1.Service) (int, error) {
@@ -123,7 +214,12 @@ func (con *memBrokerController) brokerReady(brokerStatefulSet *appsv1.StatefulSe
 	if err != nil {
 		return false, err
 	}
-	ready := brokerStatefulSet.Status.ReadyReplicas >= brokerNum-1 && n >= int(brokerNum-1)
+	// Allow one broker to be restarted. The master broker is required even if there's only one.
+	minReady := *brokerStatefulSet.Spec.Replicas - 1
+	if minReady < 1 {
+		minReady = 1
+	}
+	ready := brokerStatefulSet.Status.ReadyReplicas >= minReady && n >= int(minReady)
 	return ready, nil
 }
 
@@ -132,6 +228,7 @@ func (con *memBrokerController) brokerAllReady(brokerStatefulSet *appsv1.Statefu
 	if err != nil {
 		return false, err
 	}
+	brokerNum := *brokerStatefulSet.Spec.Replicas
 	ready := brokerStatefulSet.Status.ReadyReplicas == brokerNum && n >= int(brokerNum)
 	return ready, nil
 }
@@ -153,10 +250,14 @@ func (con *memBrokerController) reconcileMaster(reqLogger logr.Logger, cr *under
 		reqLogger.Error(err, "failed to get current master", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
 		return "", nil, err
 	}
-	err = con.setMasterBrokerStatus(reqLogger, cr, currMaster)
-	if err != nil {
-		return "", nil, err
+	// The master broker is found for the first time when the cluster is created.
+	if cr.Status.MasterBrokerAddress != "" && cr.Status.MasterBrokerAddress != currMaster {
+		reqLogger.Info("master broker changed", "oldMaster", cr.Status.MasterBrokerAddress, "newMaster", currMaster)
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventMasterBrokerChanged,
+			"Master broker changed from %q to %q", cr.Status.MasterBrokerAddress, currMaster)
 	}
+	// The status will be updated at the end of the reconciliation.
+	cr.Status.MasterBrokerAddress = currMaster
 
 	replicaAddresses := make([]string, 0)
 	for _, address := range brokerAddresses {
@@ -169,20 +270,6 @@ func (con *memBrokerController) reconcileMaster(reqLogger logr.Logger, cr *under
 	return currMaster, replicaAddresses, nil
 }
 
-func (con *memBrokerController) setMasterBrokerStatus(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, masterBrokerAddress string) error {
-	cr.Status.MasterBrokerAddress = masterBrokerAddress
-	err := con.r.client.Status().Update(context.TODO(), cr)
-	if err != nil {
-		if errors.IsConflict(err) {
-			reqLogger.Info("Conflict on master broker status. Try again.", "error", err)
-			return errRetryReconciliation
-		}
-		reqLogger.Error(err, "Failed to set master broker address", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
-		return err
-	}
-	return nil
-}
-
 func (con *memBrokerController) getCurrentMaster(reqLogger logr.Logger, brokerAddresses []string) (string, error) {
 	if len(brokerAddresses) == 0 {
 		return "", pkgerrors.Errorf("broker addresses is empty")
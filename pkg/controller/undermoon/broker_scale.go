@@ -0,0 +1,108 @@
+package undermoon
+
+import (
+	"context"
+	"fmt"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// The StatefulSet removes the pods with the largest ordinals first when scaling down.
+// If the master broker is one of them, the mastership is moved to a kept broker
+// before changing the replica number.
+// Returns true if the scaling is still in progress.
+func (con *memBrokerController) scaleBroker(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, brokerStatefulSet *appsv1.StatefulSet, brokerService *corev1.Service, masterBrokerAddress string) (bool, error) {
+	current := *brokerStatefulSet.Spec.Replicas
+	desired := int32(cr.Spec.BrokerNum)
+	if current == desired {
+		return false, nil
+	}
+
+	setProgressing(cr, reasonScalingBroker, fmt.Sprintf("scaling brokers from %d to %d", current, desired))
+
+	if desired < current {
+		keptPods := make(map[string]bool)
+		for _, name := range genBrokerNames(cr.ObjectMeta.Name, int(desired)) {
+			keptPods[name] = true
+		}
+
+		pods, err := getStatefulSetPods(con.r.client, brokerStatefulSet)
+		if err != nil {
+			reqLogger.Error(err, "failed to list broker pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return true, err
+		}
+
+		masterRemoved := false
+		candidates := []*corev1.Pod{}
+		for i := range pods {
+			pod := &pods[i]
+			if !keptPods[pod.ObjectMeta.Name] {
+				if genBrokerAddressFromName(pod.ObjectMeta.Name, cr) == masterBrokerAddress {
+					masterRemoved = true
+				}
+				continue
+			}
+			candidates = append(candidates, pod)
+		}
+
+		if masterRemoved {
+			err := con.transferMaster(reqLogger, cr, masterBrokerAddress, pods, candidates, "scaling down")
+			// Change the replica number after the coordinators are pointed to the new master.
+			return true, err
+		}
+	}
+
+	err := con.updateBrokerReplicas(reqLogger, cr, brokerStatefulSet, desired)
+	if err != nil {
+		return true, err
+	}
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventScalingBroker,
+		"Scaling broker StatefulSet from %d to %d replicas", current, desired)
+	return true, nil
+}
+
+func (con *memBrokerController) updateBrokerReplicas(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, brokerStatefulSet *appsv1.StatefulSet, replicaNum int32) error {
+	brokerStatefulSet.Spec.Replicas = &replicaNum
+	err := con.r.client.Update(context.TODO(), brokerStatefulSet)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on updating broker StatefulSet. Try again.")
+			return errRetryReconciliation
+		}
+		reqLogger.Error(err, "failed to update broker StatefulSet", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	return nil
+}
+
+// The coordinators are stateless so they can be added or removed directly.
+// The failure quorum greater than the coordinator number is rejected
+// before reconciling so the broker config is never pushed with it.
+// Returns true if the scaling is still in progress.
+func (con *coordinatorController) scaleCoordinator(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, coordinatorStatefulSet *appsv1.StatefulSet) (bool, error) {
+	current := *coordinatorStatefulSet.Spec.Replicas
+	desired := int32(cr.Spec.CoordinatorNum)
+	if current == desired {
+		return false, nil
+	}
+
+	setProgressing(cr, reasonScalingCoordinator, fmt.Sprintf("scaling coordinators from %d to %d", current, desired))
+
+	coordinatorStatefulSet.Spec.Replicas = &desired
+	err := con.r.client.Update(context.TODO(), coordinatorStatefulSet)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on updating coordinator StatefulSet. Try again.")
+			return true, errRetryReconciliation
+		}
+		reqLogger.Error(err, "failed to update coordinator StatefulSet", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return true, err
+	}
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventScalingCoordinator,
+		"Scaling coordinator StatefulSet from %d to %d replicas", current, desired)
+	return true, nil
+}
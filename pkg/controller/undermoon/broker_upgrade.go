@@ -0,0 +1,196 @@
+package undermoon
+
+import (
+	"fmt"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The broker StatefulSet uses the OnDelete strategy so that the master broker is restarted last:
+// (1) delete the outdated replicas one by one,
+// (2) move the mastership to an upgraded replica which has caught up with the master,
+// (3) the old master becomes an outdated replica and gets deleted in (1)
+// after the coordinators are pointed to the new master in the next reconciliation.
+// Returns true if the upgrade is still in progress.
+func (con *memBrokerController) upgradeBroker(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, brokerStatefulSet *appsv1.StatefulSet, brokerService *corev1.Service, masterBrokerAddress string) (bool, error) {
+	targetRevision := brokerStatefulSet.Status.UpdateRevision
+	if targetRevision == "" {
+		return false, nil
+	}
+
+	pods, err := getStatefulSetPods(con.r.client, brokerStatefulSet)
+	if err != nil {
+		reqLogger.Error(err, "failed to list broker pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+
+	var outdatedMaster *corev1.Pod
+	outdatedReplicas := []*corev1.Pod{}
+	upgradedReplicas := []*corev1.Pod{}
+	for i := range pods {
+		pod := &pods[i]
+		isMaster := genBrokerAddressFromName(pod.ObjectMeta.Name, cr) == masterBrokerAddress
+		switch {
+		case isMaster && podOutdated(pod, targetRevision):
+			outdatedMaster = pod
+		case isMaster:
+		case podOutdated(pod, targetRevision):
+			outdatedReplicas = append(outdatedReplicas, pod)
+		default:
+			upgradedReplicas = append(upgradedReplicas, pod)
+		}
+	}
+
+	if outdatedMaster == nil && len(outdatedReplicas) == 0 {
+		return false, nil
+	}
+
+	outdatedNum := len(outdatedReplicas)
+	if outdatedMaster != nil {
+		outdatedNum++
+	}
+	setProgressing(cr, reasonUpgradingBroker, fmt.Sprintf("upgrading brokers, %d left", outdatedNum))
+
+	// Only restart one broker at a time.
+	allReady, err := con.brokerAllReady(brokerStatefulSet, brokerService)
+	if err != nil {
+		return true, err
+	}
+	if !allReady {
+		return true, nil
+	}
+
+	if len(outdatedReplicas) != 0 {
+		pod := outdatedReplicas[0]
+		err := deletePodForUpgrade(con.r.client, pod)
+		if err != nil {
+			reqLogger.Error(err, "failed to delete broker pod", "pod", pod.ObjectMeta.Name, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return true, err
+		}
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventBrokerPodDeleted, "Deleted broker replica %s for upgrading", pod.ObjectMeta.Name)
+		return true, nil
+	}
+
+	// There's no other broker to take over the mastership.
+	// The restarted master recovers the metadata from the file or the server proxies.
+	if len(pods) == 1 {
+		err := deletePodForUpgrade(con.r.client, outdatedMaster)
+		if err != nil {
+			reqLogger.Error(err, "failed to delete broker pod", "pod", outdatedMaster.ObjectMeta.Name, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return true, err
+		}
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventBrokerPodDeleted, "Deleted the only broker %s for upgrading", outdatedMaster.ObjectMeta.Name)
+		return true, nil
+	}
+
+	err = con.transferMaster(reqLogger, cr, masterBrokerAddress, pods, upgradedReplicas, "upgrading")
+	return true, err
+}
+
+// transferMaster moves the mastership to one of the candidates which has caught up with the master.
+func (con *memBrokerController) transferMaster(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, masterBrokerAddress string, pods []corev1.Pod, candidates []*corev1.Pod, purpose string) error {
+	masterEpoch, err := con.client.getEpoch(masterBrokerAddress)
+	if err != nil {
+		reqLogger.Error(err, "failed to get epoch from master broker", "masterBrokerAddress", masterBrokerAddress, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	newMasterAddress := ""
+	for _, pod := range candidates {
+		if !podIsReady(pod) {
+			continue
+		}
+		address := genBrokerAddressFromName(pod.ObjectMeta.Name, cr)
+		epoch, err := con.client.getEpoch(address)
+		if err != nil {
+			reqLogger.Info("failed to get epoch from broker replica", "address", address, "error", err)
+			continue
+		}
+		// The replica has not received the latest metadata yet.
+		if epoch < masterEpoch {
+			continue
+		}
+		newMasterAddress = address
+		break
+	}
+	if newMasterAddress == "" {
+		reqLogger.Info("waiting for a broker replica to catch up", "purpose", purpose, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return nil
+	}
+
+	replicaAddresses := []string{}
+	for _, pod := range pods {
+		address := genBrokerAddressFromName(pod.ObjectMeta.Name, cr)
+		if address == newMasterAddress {
+			continue
+		}
+		replicaAddresses = append(replicaAddresses, address)
+	}
+
+	// Demote the old master first so that there won't be two masters if the promotion fails.
+	// Without any master, getCurrentMaster picks the broker with the largest epoch in the next reconciliation.
+	err = con.client.setBrokerReplicas(masterBrokerAddress, []string{})
+	if err != nil {
+		reqLogger.Error(err, "failed to demote the old master broker", "masterBrokerAddress", masterBrokerAddress, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	err = con.client.setBrokerReplicas(newMasterAddress, replicaAddresses)
+	if err != nil {
+		reqLogger.Error(err, "failed to set replicas to the new master broker", "newMasterBrokerAddress", newMasterAddress, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	reqLogger.Info("moved master broker", "purpose", purpose, "oldMaster", masterBrokerAddress, "newMaster", newMasterAddress)
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventMasterBrokerChanged,
+		"Moved master broker from %q to %q for %s", masterBrokerAddress, newMasterAddress, purpose)
+	cr.Status.MasterBrokerAddress = newMasterAddress
+	return nil
+}
+
+// The coordinators are restarted one by one.
+// The recreated coordinator will be pointed to the master broker by configSetBroker.
+// Returns true if the upgrade is still in progress.
+func (con *coordinatorController) upgradeCoordinator(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, coordinatorStatefulSet *appsv1.StatefulSet, coordinatorService *corev1.Service) (bool, error) {
+	targetRevision := coordinatorStatefulSet.Status.UpdateRevision
+	if targetRevision == "" {
+		return false, nil
+	}
+
+	pods, err := getStatefulSetPods(con.r.client, coordinatorStatefulSet)
+	if err != nil {
+		reqLogger.Error(err, "failed to list coordinator pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+
+	outdatedPods := []*corev1.Pod{}
+	for i := range pods {
+		if podOutdated(&pods[i], targetRevision) {
+			outdatedPods = append(outdatedPods, &pods[i])
+		}
+	}
+	if len(outdatedPods) == 0 {
+		return false, nil
+	}
+
+	setProgressing(cr, reasonUpgradingCoordinator, fmt.Sprintf("upgrading coordinators, %d left", len(outdatedPods)))
+
+	allReady, err := con.coordiantorAllReady(coordinatorStatefulSet, coordinatorService)
+	if err != nil {
+		return true, err
+	}
+	if !allReady {
+		return true, nil
+	}
+
+	pod := outdatedPods[0]
+	err = deletePodForUpgrade(con.r.client, pod)
+	if err != nil {
+		reqLogger.Error(err, "failed to delete coordinator pod", "pod", pod.ObjectMeta.Name, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return true, err
+	}
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCoordinatorPodDeleted, "Deleted coordinator %s for upgrading", pod.ObjectMeta.Name)
+	return true, nil
+}
@@ -10,10 +10,8 @@ import (
 )
 
 const coordinatorPort = 6699
-const coordinatorNum int32 = 3
 const coordinatorContainerName = "coordinator"
 const undermoonServiceTypeCoordinator = "coordinator"
-const coordinatorTopologyKey = "undermoon-broker-topology-key"
 
 func createCoordinatorService(cr *undermoonv1alpha1.Undermoon) *corev1.Service {
 	undermoonName := cr.ObjectMeta.Name
@@ -86,6 +84,9 @@ func createCoordinatorStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.State
 			Value: "3",
 		},
 	}
+	// The coordinator authenticates its own clients
+	// and connects to the server proxies with the same password.
+	env = append(env, genAuthEnv(cr, "UNDERMOON_PASSWORD", "UNDERMOON_PROXY_PASSWORD")...)
 	container := corev1.Container{
 		Name:            coordinatorContainerName,
 		Image:           cr.Spec.UndermoonImage,
@@ -94,17 +95,34 @@ func createCoordinatorStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.State
 		Env:             env,
 		Resources:       cr.Spec.CoordinatorResources,
 	}
+	if cr.Spec.TLS != nil {
+		// The coordinator connects to the server proxies with TLS.
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  "UNDERMOON_PROXY_TLS_CA_FILE",
+			Value: fmt.Sprintf("%s/%s", tlsCAPath, tlsCAKey),
+		})
+		container.VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      tlsCAVolumeName,
+				MountPath: tlsCAPath,
+				ReadOnly:  true,
+			},
+		}
+	}
 	podSpec := corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels: labels,
 		},
 		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{container},
-			Affinity:   genAntiAffinity(labels, cr.ObjectMeta.Namespace, coordinatorTopologyKey),
+			Containers:                []corev1.Container{container},
+			Affinity:                  genAntiAffinity(labels, cr.ObjectMeta.Namespace, &cr.Spec.Placement),
+			TopologySpreadConstraints: genTopologySpreadConstraints(labels, &cr.Spec.Placement),
+			Volumes:                   genTLSCAVolumes(cr),
 		},
 	}
+	applyPodSettings(&podSpec, &cr.Spec.CoordinatorPod)
 
-	replicaNum := coordinatorNum
+	replicaNum := int32(cr.Spec.CoordinatorNum)
 
 	return &appsv1.StatefulSet{
 		TypeMeta: metav1.TypeMeta{
@@ -122,6 +140,10 @@ func createCoordinatorStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.State
 			Replicas:            &replicaNum,
 			Template:            podSpec,
 			PodManagementPolicy: appsv1.ParallelPodManagement,
+			// The coordinators are restarted one by one by the operator.
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.OnDeleteStatefulSetStrategyType,
+			},
 		},
 	}
 }
@@ -131,9 +153,9 @@ func CoordinatorStatefulSetName(undermoonName string) string {
 	return fmt.Sprintf("%s-cd-ss", undermoonName)
 }
 
-func genCoordinatorNames(undermoonName string) []string {
+func genCoordinatorNames(undermoonName string, replicas int) []string {
 	names := []string{}
-	for i := int32(0); i != coordinatorNum; i++ {
+	for i := 0; i != replicas; i++ {
 		name := fmt.Sprintf("%s-%d", CoordinatorStatefulSetName(undermoonName), i)
 		names = append(names, name)
 	}
@@ -147,7 +169,7 @@ func genCoordinatorFQDN(podName, undermoonName, namespace string) string {
 
 func genCoordinatorStatefulSetAddrs(cr *undermoonv1alpha1.Undermoon) []string {
 	addrs := []string{}
-	for _, name := range genCoordinatorNames(cr.ObjectMeta.Name) {
+	for _, name := range genCoordinatorNames(cr.ObjectMeta.Name, int(cr.Spec.CoordinatorNum)) {
 		addr := genCoordinatorAddressFromName(name, cr)
 		addrs = append(addrs, addr)
 	}
@@ -20,6 +20,19 @@ func (client *coordinatorClient) setBrokerAddress(brokerAddress string) error {
 	return err
 }
 
+// setPassword changes the password used to connect to the server proxies
+// before the one used to authenticate the clients.
+func (client *coordinatorClient) setPassword(password string) error {
+	for _, field := range []string{"proxy_password", "password"} {
+		cmd := redis.NewStringCmd(context.TODO(), "CONFIG", "SET", field, password)
+		err := client.redisClient.Process(context.TODO(), cmd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type coordinatorClientPool struct {
 	redisPool *redisClientPool
 }
@@ -30,14 +43,14 @@ func newCoordinatorClientPool() *coordinatorClientPool {
 	}
 }
 
-func (pool *coordinatorClientPool) getClient(coordAddress string) *coordinatorClient {
-	client := pool.redisPool.getClient(coordAddress)
+func (pool *coordinatorClientPool) getClient(coordAddress, password string) *coordinatorClient {
+	client := pool.redisPool.getClient(coordAddress, password)
 	return &coordinatorClient{
 		redisClient: client,
 	}
 }
 
-func (pool *coordinatorClientPool) setBrokerAddress(coordAddress, brokerAddress string) error {
-	c := pool.getClient(coordAddress)
+func (pool *coordinatorClientPool) setBrokerAddress(coordAddress, password, brokerAddress string) error {
+	c := pool.getClient(coordAddress, password)
 	return c.setBrokerAddress(brokerAddress)
 }
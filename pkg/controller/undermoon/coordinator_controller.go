@@ -48,9 +48,14 @@ func (con *coordinatorController) getOrCreateCoordinatorService(reqLogger logr.L
 	if err := controllerutil.SetControllerReference(cr, service, con.r.scheme); err != nil {
 		return nil, err
 	}
+	hash, err := serviceSpecHash(service)
+	if err != nil {
+		return nil, err
+	}
+	setSpecHashAnnotation(&service.ObjectMeta, hash)
 
 	found := &corev1.Service{}
-	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, found)
+	err = con.r.client.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		reqLogger.Info("Creating a new coordinator service", "Namespace", service.Namespace, "Name", service.Name)
 		err = con.r.client.Create(context.TODO(), service)
@@ -64,14 +69,23 @@ func (con *coordinatorController) getOrCreateCoordinatorService(reqLogger logr.L
 		}
 
 		reqLogger.Info("Successfully created a new coordinator service", "Namespace", service.Namespace, "Name", service.Name)
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCreatedService, "Created coordinator service %s", service.Name)
 		return service, nil
 	} else if err != nil {
 		reqLogger.Error(err, "failed to get coordinator service")
 		return nil, err
 	}
 
-	reqLogger.Info("Skip reconcile: coordinator service already exists", "Namespace", found.Namespace, "Name", found.Name)
-	return found, nil
+	updated, changed, err := updateServiceIfChanged(con.r.client, reqLogger, found, service)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventUpdatedService, "Updated coordinator service %s", found.Name)
+	} else {
+		reqLogger.Info("Skip reconcile: coordinator service already exists", "Namespace", found.Namespace, "Name", found.Name)
+	}
+	return updated, nil
 }
 
 func (con *coordinatorController) getOrCreateCoordinatorStatefulSet(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) (*appsv1.StatefulSet, error) {
@@ -81,10 +95,15 @@ func (con *coordinatorController) getOrCreateCoordinatorStatefulSet(reqLogger lo
 		reqLogger.Error(err, "SetControllerReference failed")
 		return nil, err
 	}
+	hash, err := statefulSetSpecHash(coordinator)
+	if err != nil {
+		return nil, err
+	}
+	setSpecHashAnnotation(&coordinator.ObjectMeta, hash)
 
 	// Check if this coordinator Statefulset already exists
 	found := &appsv1.StatefulSet{}
-	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: coordinator.Name, Namespace: coordinator.Namespace}, found)
+	err = con.r.client.Get(context.TODO(), types.NamespacedName{Name: coordinator.Name, Namespace: coordinator.Namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		reqLogger.Info("Creating a new coordinator statefulset", "Namespace", coordinator.Namespace, "Name", coordinator.Name)
 		err = con.r.client.Create(context.TODO(), coordinator)
@@ -98,6 +117,7 @@ func (con *coordinatorController) getOrCreateCoordinatorStatefulSet(reqLogger lo
 		}
 
 		// Statefulset created successfully - don't requeue
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCreatedStatefulSet, "Created coordinator statefulset %s", coordinator.Name)
 		return coordinator, nil
 	} else if err != nil {
 		reqLogger.Error(err, "failed to get coordinator statefulset")
@@ -105,8 +125,16 @@ func (con *coordinatorController) getOrCreateCoordinatorStatefulSet(reqLogger lo
 	}
 
 	// coordinator already exists - don't requeue
-	reqLogger.Info("Skip reconcile: coordinator statefulset already exists", "Namespace", found.Namespace, "Name", found.Name)
-	return found, nil
+	updated, changed, err := updateStatefulSetIfChanged(con.r.client, reqLogger, found, coordinator)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventUpdatedStatefulSet, "Updated coordinator statefulset %s", found.Name)
+	} else {
+		reqLogger.Info("Skip reconcile: coordinator statefulset already exists", "Namespace", found.Namespace, "Name", found.Name)
+	}
+	return updated, nil
 }
 
 func (con *coordinatorController) getServiceEndpointsNum(coordinatorService *corev1.Service) (int, error) {
@@ -131,6 +159,7 @@ func (con *coordinatorController) coordiantorAllReady(coordinatorStatefulSet *ap
 	if err != nil {
 		return false, err
 	}
+	coordinatorNum := *coordinatorStatefulSet.Spec.Replicas
 	ready := coordinatorStatefulSet.Status.ReadyReplicas >= coordinatorNum && n >= int(coordinatorNum)
 	return ready, nil
 }
@@ -141,14 +170,21 @@ func (con *coordinatorController) configSetBroker(reqLogger logr.Logger, cr *und
 		reqLogger.Error(err, "failed to get coordinator endpoints", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
 		return err
 	}
+	password, err := getAuthPassword(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get password", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
 
 	for _, endpoint := range endpoints {
 		address := genCoordinatorAddressFromName(endpoint.Hostname, cr)
-		err = con.coordPool.setBrokerAddress(address, masterBrokerAddress)
+		err = con.coordPool.setBrokerAddress(address, password, masterBrokerAddress)
 		if err != nil {
 			reqLogger.Error(err, "failed to set broker to coodinator",
 				"coordinatorAddress", address,
 				"Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventSetCoordinatorsFailed,
+				"Failed to set broker %s to coordinator %s: %s", masterBrokerAddress, address, err)
 		}
 	}
 	return err
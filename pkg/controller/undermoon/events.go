@@ -0,0 +1,69 @@
+package undermoon
+
+// Reasons of the events emitted on the Undermoon object.
+const (
+	eventCreatedService          = "CreatedService"
+	eventCreatedStatefulSet      = "CreatedStatefulSet"
+	eventUpdatedService          = "UpdatedService"
+	eventUpdatedStatefulSet      = "UpdatedStatefulSet"
+	eventMasterBrokerChanged     = "MasterBrokerChanged"
+	eventBrokerEpochRecovered    = "BrokerEpochRecovered"
+	eventProxyRegistered         = "ProxyRegistered"
+	eventProxyDeregistered       = "ProxyDeregistered"
+	eventClusterCreated          = "ClusterCreated"
+	eventScalingOut              = "ScalingOut"
+	eventScalingDown             = "ScalingDown"
+	eventChangingNodeNumber      = "ChangingNodeNumber"
+	eventWaitingForMigration     = "WaitingForMigration"
+	eventReconcileFailed         = "ReconcileFailed"
+	eventBrokerReplicasFailed    = "SetBrokerReplicasFailed"
+	eventProxyRegistryFailed     = "ProxyRegistryFailed"
+	eventSetCoordinatorsFailed   = "SetCoordinatorBrokerFailed"
+	eventStorageUpgradeStarted   = "StorageUpgradeStarted"
+	eventStorageUpgradeCompleted = "StorageUpgradeCompleted"
+	eventStorageFailover         = "StorageFailover"
+	eventStoragePodDeleted       = "StoragePodDeleted"
+	eventStoragePodUpgraded      = "StoragePodUpgraded"
+	eventCanarySoaking           = "CanarySoaking"
+	eventCanaryPassed            = "CanaryPassed"
+	eventCanaryHalted            = "CanaryHalted"
+	eventCanaryResumed           = "CanaryResumed"
+	eventNoReplica               = "NoConnectedReplica"
+	eventBrokerPodDeleted        = "BrokerPodDeleted"
+	eventCoordinatorPodDeleted   = "CoordinatorPodDeleted"
+	eventRestoreStarted          = "RestoreStarted"
+	eventRestoreLoadingData      = "RestoreLoadingData"
+	eventRestoreCompleted        = "RestoreCompleted"
+	eventRestoreFailed           = "RestoreFailed"
+	eventPasswordRotationStarted = "PasswordRotationStarted"
+	eventPasswordRotated         = "PasswordRotated"
+	eventPasswordRotationFailed  = "PasswordRotationFailed"
+	eventCreatedTLSSecret        = "CreatedTLSSecret"
+	eventBrokerConfigUpdated     = "BrokerConfigUpdated"
+	eventBrokerConfigFailed      = "SetBrokerConfigFailed"
+	eventScalingBroker           = "ScalingBroker"
+	eventScalingCoordinator      = "ScalingCoordinator"
+	eventCreatedPDB              = "CreatedPodDisruptionBudget"
+	eventUpdatedPDB              = "UpdatedPodDisruptionBudget"
+	eventRedisConfigUpdated      = "RedisConfigUpdated"
+	eventRedisConfigFailed       = "SetRedisConfigFailed"
+	eventMaxMemoryResized        = "MaxMemoryResized"
+	eventMaxMemoryRefused        = "MaxMemoryResizeRefused"
+	eventInvalidSpec             = "InvalidSpec"
+)
+
+// Reasons of the events emitted on the UndermoonBackup object.
+const (
+	eventBackupStarted   = "BackupStarted"
+	eventBackupCompleted = "BackupCompleted"
+	eventBackupFailed    = "BackupFailed"
+)
+
+// Reasons of the events emitted on the UndermoonBackupSchedule object.
+const (
+	eventBackupScheduled   = "BackupScheduled"
+	eventBackupSkipped     = "BackupSkipped"
+	eventBackupPruned      = "BackupPruned"
+	eventBackupPruneFailed = "BackupPruneFailed"
+	eventInvalidSchedule   = "InvalidSchedule"
+)
@@ -3,15 +3,17 @@ package undermoon
 import (
 	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 )
 
 type metaController struct {
+	r      *ReconcileUndermoon
 	client *brokerClient
 }
 
-func newMetaController() *metaController {
+func newMetaController(r *ReconcileUndermoon) *metaController {
 	client := newBrokerClient()
-	return &metaController{client: client}
+	return &metaController{r: r, client: client}
 }
 
 func (con *metaController) reconcileMeta(reqLogger logr.Logger, masterBrokerAddress string, replicaAddresses []string, proxies []serverProxyMeta, cr *undermoonv1alpha1.Undermoon, storageAllReady bool) (*clusterInfo, error) {
@@ -26,8 +28,12 @@ func (con *metaController) reconcileMeta(reqLogger logr.Logger, masterBrokerAddr
 	}
 
 	if !storageAllReady {
+		msg := "waiting for all the server proxies to be ready"
+		setCondition(cr, undermoonv1alpha1.UndermoonStorageAvailable, corev1.ConditionFalse, reasonStorageNotReady, msg)
+		setProgressing(cr, reasonStorageNotReady, msg)
 		return nil, errRetryReconciliation
 	}
+	setCondition(cr, undermoonv1alpha1.UndermoonStorageAvailable, corev1.ConditionTrue, reasonStorageReady, "all the server proxies are ready")
 
 	err = con.createCluster(reqLogger, masterBrokerAddress, cr)
 	if err != nil {
@@ -46,6 +52,7 @@ func (con *metaController) setBrokerReplicas(reqLogger logr.Logger, masterBroker
 	err := con.client.setBrokerReplicas(masterBrokerAddress, replicaAddresses)
 	if err != nil {
 		reqLogger.Error(err, "failed to set broker replicas", "masterBrokerAddress", masterBrokerAddress, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventBrokerReplicasFailed, "Failed to set replicas of master broker %s: %s", masterBrokerAddress, err)
 		return err
 	}
 
@@ -60,13 +67,27 @@ func (con *metaController) setBrokerReplicas(reqLogger logr.Logger, masterBroker
 }
 
 func (con *metaController) changeMeta(reqLogger logr.Logger, masterBrokerAddress string, cr *undermoonv1alpha1.Undermoon, info *clusterInfo) error {
+	// Only emit the events when the migration starts instead of on every requeue.
+	alreadyMigrating := conditionIs(cr, undermoonv1alpha1.UndermoonMigrating, corev1.ConditionTrue, reasonSlotsMigrating)
+
 	if info.IsMigrating {
+		if !alreadyMigrating {
+			con.r.recorder.Event(cr, corev1.EventTypeNormal, eventWaitingForMigration, "Waiting for the slot migration to finish")
+		}
+		setMigrating(cr)
 		return errRetryReconciliation
 	}
 
+	expectedNodeNumber := int(cr.Spec.ChunkNumber) * chunkNodeNumber
+	if info.NodeNumber != expectedNodeNumber && !alreadyMigrating {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventChangingNodeNumber,
+			"Changing node number from %d to %d", info.NodeNumber, expectedNodeNumber)
+	}
+
 	err := con.changeNodeNumber(reqLogger, masterBrokerAddress, cr)
 	if err != nil {
-		if err == errMigrationRunning {
+		if err == errMigrationRunning || err == errRetryReconciliation {
+			setMigrating(cr)
 			return errRetryReconciliation
 		}
 		return err
@@ -75,6 +96,12 @@ func (con *metaController) changeMeta(reqLogger logr.Logger, masterBrokerAddress
 	return nil
 }
 
+func setMigrating(cr *undermoonv1alpha1.Undermoon) {
+	msg := "waiting for the slot migration to finish"
+	setCondition(cr, undermoonv1alpha1.UndermoonMigrating, corev1.ConditionTrue, reasonSlotsMigrating, msg)
+	setProgressing(cr, reasonSlotsMigrating, msg)
+}
+
 func (con *metaController) reconcileServerProxyRegistry(reqLogger logr.Logger, masterBrokerAddress string, proxies []serverProxyMeta, cr *undermoonv1alpha1.Undermoon) error {
 	err := con.registerServerProxies(reqLogger, masterBrokerAddress, proxies, cr)
 	if err != nil {
@@ -90,10 +117,33 @@ func (con *metaController) reconcileServerProxyRegistry(reqLogger logr.Logger, m
 }
 
 func (con *metaController) registerServerProxies(reqLogger logr.Logger, masterBrokerAddress string, proxies []serverProxyMeta, cr *undermoonv1alpha1.Undermoon) error {
+	if len(proxies) == 0 {
+		return nil
+	}
+
+	// The existing proxies are only used to emit the events for the new ones,
+	// so still register the proxies if they can't be retrieved.
+	existingProxies, err := con.client.getServerProxies(masterBrokerAddress)
+	if err != nil {
+		reqLogger.Error(err, "failed to get server proxy addresses",
+			"Name", cr.ObjectMeta.Name,
+			"ClusterName", cr.Spec.ClusterName)
+	}
+	existingKnown := err == nil
+	existingSet := make(map[string]bool, len(existingProxies))
+	for _, address := range existingProxies {
+		existingSet[address] = true
+	}
+
 	for _, proxy := range proxies {
 		err := con.client.registerServerProxy(masterBrokerAddress, proxy)
 		if err != nil {
 			reqLogger.Error(err, "failed to register server proxy", "proxy", proxy, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventProxyRegistryFailed, "Failed to register server proxy %s: %s", proxy.ProxyAddress, err)
+			continue
+		}
+		if _, ok := existingSet[proxy.ProxyAddress]; !ok && existingKnown {
+			con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventProxyRegistered, "Registered server proxy %s", proxy.ProxyAddress)
 		}
 	}
 	return nil
@@ -132,7 +182,10 @@ func (con *metaController) deregisterServerProxies(reqLogger logr.Logger, master
 				"proxyAddress", deleteAddress,
 				"Name", cr.ObjectMeta.Name,
 				"ClusterName", cr.Spec.ClusterName)
+			con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventProxyRegistryFailed, "Failed to deregister server proxy %s: %s", deleteAddress, err)
+			continue
 		}
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventProxyDeregistered, "Deregistered server proxy %s", deleteAddress)
 	}
 
 	return nil
@@ -158,6 +211,7 @@ func (con *metaController) createCluster(reqLogger logr.Logger, masterBrokerAddr
 			"ClusterName", cr.Spec.ClusterName)
 		return err
 	}
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventClusterCreated, "Created cluster %s with %d chunks", cr.Spec.ClusterName, cr.Spec.ChunkNumber)
 	return nil
 }
 
@@ -215,10 +269,13 @@ func (con *metaController) fixBrokerEpoch(reqLogger logr.Logger, masterBrokerAdd
 		return err
 	}
 
+	cr.Status.GlobalEpoch = epoch
 	if epoch >= maxEpochFromServerProxy {
 		return nil
 	}
 
+	con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventBrokerEpochRecovered,
+		"Broker global epoch %d is behind server proxy epoch %d, recovering", epoch, maxEpochFromServerProxy)
 	err = con.client.fixEpoch(masterBrokerAddress)
 	if err != nil {
 		reqLogger.Error(err, "failed to fix broker global epoch",
@@ -227,5 +284,14 @@ func (con *metaController) fixBrokerEpoch(reqLogger logr.Logger, masterBrokerAdd
 		return err
 	}
 
+	epoch, err = con.client.getEpoch(masterBrokerAddress)
+	if err != nil {
+		reqLogger.Error(err, "failed to get global epoch from broker",
+			"Name", cr.ObjectMeta.Name,
+			"ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	cr.Status.GlobalEpoch = epoch
+
 	return nil
 }
@@ -0,0 +1,133 @@
+package undermoon
+
+import (
+	"context"
+	"fmt"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// BrokerPodDisruptionBudgetName defines the PodDisruptionBudget for the brokers.
+func BrokerPodDisruptionBudgetName(undermoonName string) string {
+	return fmt.Sprintf("%s-bk-pdb", undermoonName)
+}
+
+// CoordinatorPodDisruptionBudgetName defines the PodDisruptionBudget for the coordinators.
+func CoordinatorPodDisruptionBudgetName(undermoonName string) string {
+	return fmt.Sprintf("%s-cd-pdb", undermoonName)
+}
+
+// StoragePodDisruptionBudgetName defines the PodDisruptionBudget for the storage pods.
+func StoragePodDisruptionBudgetName(undermoonName string) string {
+	return fmt.Sprintf("%s-stg-pdb", undermoonName)
+}
+
+// genPodDisruptionBudgets only allows one pod of each component to be evicted at a time
+// so that a node drain can't remove two brokers or both the master and the replica of a shard.
+func genPodDisruptionBudgets(cr *undermoonv1alpha1.Undermoon) []*policyv1beta1.PodDisruptionBudget {
+	storageReplicas := int32(int(cr.Spec.ChunkNumber) * halfChunkNodeNumber)
+	return []*policyv1beta1.PodDisruptionBudget{
+		createPodDisruptionBudget(cr, BrokerPodDisruptionBudgetName(cr.ObjectMeta.Name), undermoonServiceTypeBroker, int32(cr.Spec.BrokerNum)),
+		createPodDisruptionBudget(cr, CoordinatorPodDisruptionBudgetName(cr.ObjectMeta.Name), undermoonServiceTypeCoordinator, int32(cr.Spec.CoordinatorNum)),
+		createPodDisruptionBudget(cr, StoragePodDisruptionBudgetName(cr.ObjectMeta.Name), undermoonServiceTypeStorage, storageReplicas),
+	}
+}
+
+func createPodDisruptionBudget(cr *undermoonv1alpha1.Undermoon, name, serviceType string, replicas int32) *policyv1beta1.PodDisruptionBudget {
+	labels := map[string]string{
+		"undermoonService":     serviceType,
+		"undermoonName":        cr.ObjectMeta.Name,
+		"undermoonClusterName": cr.Spec.ClusterName,
+	}
+
+	minAvailable := replicas - 1
+	if minAvailable < 0 {
+		minAvailable = 0
+	}
+	minAvailableValue := intstr.FromInt(int(minAvailable))
+
+	return &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailableValue,
+			Selector:     &metav1.LabelSelector{MatchLabels: labels},
+		},
+	}
+}
+
+func podDisruptionBudgetSpecHash(pdb *policyv1beta1.PodDisruptionBudget) (string, error) {
+	return computeHash(pdb.Spec)
+}
+
+// reconcilePodDisruptionBudgets keeps the PodDisruptionBudgets in sync
+// with the replica numbers of the components.
+func (r *ReconcileUndermoon) reconcilePodDisruptionBudgets(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) error {
+	for _, pdb := range genPodDisruptionBudgets(cr) {
+		err := r.getOrCreatePodDisruptionBudget(reqLogger, cr, pdb)
+		if err != nil {
+			reqLogger.Error(err, "failed to create PodDisruptionBudget", "pdb", pdb.Name, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ReconcileUndermoon) getOrCreatePodDisruptionBudget(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, pdb *policyv1beta1.PodDisruptionBudget) error {
+	if err := controllerutil.SetControllerReference(cr, pdb, r.scheme); err != nil {
+		return err
+	}
+	hash, err := podDisruptionBudgetSpecHash(pdb)
+	if err != nil {
+		return err
+	}
+	setSpecHashAnnotation(&pdb.ObjectMeta, hash)
+
+	found := &policyv1beta1.PodDisruptionBudget{}
+	err = r.client.Get(context.TODO(), types.NamespacedName{Name: pdb.Name, Namespace: pdb.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating a new PodDisruptionBudget", "Namespace", pdb.Namespace, "Name", pdb.Name)
+		err = r.client.Create(context.TODO(), pdb)
+		if err != nil {
+			if errors.IsAlreadyExists(err) {
+				return errRetryReconciliation
+			}
+			return err
+		}
+		r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCreatedPDB, "Created PodDisruptionBudget %s", pdb.Name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if found.ObjectMeta.Annotations[specHashAnnotation] == hash {
+		return nil
+	}
+
+	reqLogger.Info("Updating PodDisruptionBudget", "Namespace", found.Namespace, "Name", found.Name, "hash", hash)
+	found.ObjectMeta.Labels = pdb.ObjectMeta.Labels
+	setSpecHashAnnotation(&found.ObjectMeta, hash)
+	found.Spec = pdb.Spec
+	err = r.client.Update(context.TODO(), found)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on updating PodDisruptionBudget. Try again.", "Name", found.Name)
+			return errRetryReconciliation
+		}
+		return err
+	}
+	r.recorder.Eventf(cr, corev1.EventTypeNormal, eventUpdatedPDB,
+		"Updated PodDisruptionBudget %s to keep at least %s pods available", found.Name, found.Spec.MinAvailable.String())
+	return nil
+}
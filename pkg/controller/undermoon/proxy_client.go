@@ -2,6 +2,7 @@ package undermoon
 
 import (
 	"context"
+	"crypto/tls"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -30,14 +31,43 @@ func newServerProxyClientPool() *serverProxyClientPool {
 	}
 }
 
-func (pool *serverProxyClientPool) getClient(serverProxyAddress string) *serverProxyClient {
-	client := pool.redisPool.getClient(serverProxyAddress)
+func (pool *serverProxyClientPool) getClient(serverProxyAddress, password string, tlsConfig *tls.Config) *serverProxyClient {
+	client := pool.redisPool.getTLSClient(serverProxyAddress, password, tlsConfig)
 	return &serverProxyClient{
 		redisClient: client,
 	}
 }
 
-func (pool *serverProxyClientPool) getEpoch(serverProxyAddress string) (int64, error) {
-	c := pool.getClient(serverProxyAddress)
+func (pool *serverProxyClientPool) getEpoch(serverProxyAddress, password string, tlsConfig *tls.Config) (int64, error) {
+	c := pool.getClient(serverProxyAddress, password, tlsConfig)
 	return c.getEpoch()
 }
+
+// isReady checks whether the server proxy has received UMCTL SETCLUSTER.
+func (client *serverProxyClient) isReady() (bool, error) {
+	cmd := redis.NewIntCmd(context.TODO(), "UMCTL", "READY")
+	err := client.redisClient.Process(context.TODO(), cmd)
+	if err != nil {
+		return false, err
+	}
+	ready, err := cmd.Result()
+	return ready == 1, err
+}
+
+func (pool *serverProxyClientPool) isReady(serverProxyAddress, password string, tlsConfig *tls.Config) (bool, error) {
+	c := pool.getClient(serverProxyAddress, password, tlsConfig)
+	return c.isReady()
+}
+
+// setPassword changes the password used to connect to Redis
+// before the one used to authenticate the clients.
+func (client *serverProxyClient) setPassword(password string) error {
+	for _, field := range []string{"backend_password", "password"} {
+		cmd := redis.NewStringCmd(context.TODO(), "CONFIG", "SET", field, password)
+		err := client.redisClient.Process(context.TODO(), cmd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
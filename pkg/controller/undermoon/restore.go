@@ -0,0 +1,365 @@
+package undermoon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	pkgerrors "github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const restoreContainerName = "restore"
+const restoreMetadataContainerName = "metadata"
+const restoreSourceVolumeName = "restore-source"
+const restorePlanVolumeName = "restore-plan"
+const restoreSourcePath = "/restore-source"
+const restorePlanPath = "/restore-plan"
+const restoreMetadataSeparator = "--- cluster.json ---"
+const redisRDBFileName = "dump.rdb"
+
+// RestorePlanConfigMapName defines the ConfigMap telling each storage pod which RDB files to load.
+// It is deleted after the restore is done so that the recreated pods will not load the backup again.
+func RestorePlanConfigMapName(undermoonName string) string {
+	return fmt.Sprintf("%s-restore", undermoonName)
+}
+
+func restoreMetadataJobName(undermoonName string) string {
+	return fmt.Sprintf("%s-restore-metadata", undermoonName)
+}
+
+func restorePlanKey(podName string, port int) string {
+	return fmt.Sprintf("%s-%d", podName, port)
+}
+
+func restoreSourceDir(restoreFrom *undermoonv1alpha1.BackupDestination) string {
+	if s3 := restoreFrom.S3; s3 != nil {
+		return fmt.Sprintf("dest/%s", path.Join(s3.Bucket, s3.Prefix))
+	}
+	return restoreSourcePath
+}
+
+func restoreImage(cr *undermoonv1alpha1.Undermoon) string {
+	if cr.Spec.RestoreFrom.S3 != nil {
+		return DefaultBackupUploaderImage
+	}
+	return cr.Spec.RedisImage
+}
+
+// genRestoreCmd prepends the S3 alias setup to the commands.
+func genRestoreCmd(restoreFrom *undermoonv1alpha1.BackupDestination, cmds []string) string {
+	if restoreFrom.S3 != nil {
+		cmds = append([]string{s3AliasCmd}, cmds...)
+	}
+	return strings.Join(cmds, " && ")
+}
+
+func genRestoreSourceVolume(restoreFrom *undermoonv1alpha1.BackupDestination) (*corev1.Volume, *corev1.VolumeMount) {
+	pvc := restoreFrom.PersistentVolumeClaim
+	if pvc == nil {
+		return nil, nil
+	}
+	volume := &corev1.Volume{
+		Name: restoreSourceVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: pvc.ClaimName,
+				ReadOnly:  true,
+			},
+		},
+	}
+	mount := &corev1.VolumeMount{
+		Name:      restoreSourceVolumeName,
+		MountPath: restoreSourcePath,
+		SubPath:   pvc.Path,
+		ReadOnly:  true,
+	}
+	return volume, mount
+}
+
+// createRestoreMetadataJob prints the metadata snapshots in the backup.
+// The operator reads them from the logs.
+func createRestoreMetadataJob(cr *undermoonv1alpha1.Undermoon) *batchv1.Job {
+	restoreFrom := cr.Spec.RestoreFrom
+	catCmd := "cat"
+	if restoreFrom.S3 != nil {
+		catCmd = "mc cat"
+	}
+	sourceDir := restoreSourceDir(restoreFrom)
+	cmd := genRestoreCmd(restoreFrom, []string{
+		fmt.Sprintf("%s %s", catCmd, path.Join(sourceDir, backupMetadataKey)),
+		"echo",
+		fmt.Sprintf("echo '%s'", restoreMetadataSeparator),
+		fmt.Sprintf("%s %s", catCmd, path.Join(sourceDir, backupClusterMetaKey)),
+	})
+
+	container := corev1.Container{
+		Name:            restoreMetadataContainerName,
+		Image:           restoreImage(cr),
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", cmd},
+	}
+	volumes := []corev1.Volume{}
+	if restoreFrom.S3 != nil {
+		container.Env = genS3Env(restoreFrom.S3)
+	}
+	if volume, mount := genRestoreSourceVolume(restoreFrom); volume != nil {
+		volumes = append(volumes, *volume)
+		container.VolumeMounts = []corev1.VolumeMount{*mount}
+	}
+
+	labels := map[string]string{
+		"undermoonName":        cr.ObjectMeta.Name,
+		"undermoonClusterName": cr.Spec.ClusterName,
+	}
+	backoffLimit := backupJobBackoffLimit
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      restoreMetadataJobName(cr.ObjectMeta.Name),
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{container},
+					Volumes:       volumes,
+				},
+			},
+		},
+	}
+}
+
+// genRestoreInitContainer copies the RDB files to the data directories of the Redis
+// before they start, according to the restore plan.
+func genRestoreInitContainer(cr *undermoonv1alpha1.Undermoon) corev1.Container {
+	restoreFrom := cr.Spec.RestoreFrom
+	copyCmd := "cp"
+	if restoreFrom.S3 != nil {
+		copyCmd = "mc cp"
+	}
+	sourceDir := restoreSourceDir(restoreFrom)
+
+	cmds := []string{}
+	for i, port := range []int{redisPort1, redisPort2} {
+		dataDir := path.Join(redisDataPath, fmt.Sprintf("%s-%d", redisContainerName, i+1))
+		planFile := path.Join(restorePlanPath, restorePlanKey("${HOSTNAME}", port))
+		cmds = append(cmds, fmt.Sprintf(
+			"if [ -f %s ]; then mkdir -p %s && %s %s/$(cat %s) %s; fi",
+			planFile, dataDir, copyCmd, sourceDir, planFile, path.Join(dataDir, redisRDBFileName),
+		))
+	}
+
+	container := corev1.Container{
+		Name:            restoreContainerName,
+		Image:           restoreImage(cr),
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"sh", "-c", genRestoreCmd(restoreFrom, cmds)},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      redisDataVolumeName,
+				MountPath: redisDataPath,
+			},
+			{
+				Name:      restorePlanVolumeName,
+				MountPath: restorePlanPath,
+			},
+		},
+	}
+	if restoreFrom.S3 != nil {
+		container.Env = genS3Env(restoreFrom.S3)
+	}
+	if _, mount := genRestoreSourceVolume(restoreFrom); mount != nil {
+		container.VolumeMounts = append(container.VolumeMounts, *mount)
+	}
+	return container
+}
+
+func genRestoreVolumes(cr *undermoonv1alpha1.Undermoon) []corev1.Volume {
+	optional := true
+	volumes := []corev1.Volume{
+		{
+			Name: restorePlanVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: RestorePlanConfigMapName(cr.ObjectMeta.Name),
+					},
+					Optional: &optional,
+				},
+			},
+		},
+	}
+	// Without persistence, the RDB files are only kept until the pod is deleted.
+	if cr.Spec.Persistence == nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: redisDataVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+	if volume, _ := genRestoreSourceVolume(cr.Spec.RestoreFrom); volume != nil {
+		volumes = append(volumes, *volume)
+	}
+	return volumes
+}
+
+func createRestorePlanConfigMap(cr *undermoonv1alpha1.Undermoon, plan map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RestorePlanConfigMapName(cr.ObjectMeta.Name),
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"undermoonName":        cr.ObjectMeta.Name,
+				"undermoonClusterName": cr.Spec.ClusterName,
+			},
+		},
+		Data: plan,
+	}
+}
+
+// parseRestoreMetadata splits the output of the restore metadata job.
+func parseRestoreMetadata(output []byte) ([]byte, *clusterMeta, error) {
+	parts := bytes.SplitN(output, []byte("\n"+restoreMetadataSeparator+"\n"), 2)
+	if len(parts) != 2 {
+		return nil, nil, pkgerrors.Errorf("invalid output of the restore metadata job: %s", output)
+	}
+	metadata := bytes.TrimSpace(parts[0])
+	if !json.Valid(metadata) {
+		return nil, nil, pkgerrors.Errorf("invalid broker metadata in the backup: %s", metadata)
+	}
+	meta := &clusterMeta{}
+	err := json.Unmarshal(parts[1], meta)
+	if err != nil {
+		return nil, nil, pkgerrors.Wrap(err, "invalid cluster metadata in the backup")
+	}
+	if len(meta.Nodes) == 0 || len(meta.Nodes)%chunkNodeNumber != 0 {
+		return nil, nil, pkgerrors.Errorf("invalid node number %d in the backup", len(meta.Nodes))
+	}
+	return metadata, meta, nil
+}
+
+// The storage hosts are in the format of
+// <undermoon name>-stg-ss-<index>.<undermoon name>-stg-svc.<namespace>.svc.cluster.local
+func splitStorageHost(host string) (string, int, string, error) {
+	dot := strings.Index(host, ".")
+	if dot < 0 {
+		return "", 0, "", pkgerrors.Errorf("invalid storage host %s", host)
+	}
+	podName, domain := host[:dot], host[dot:]
+	dash := strings.LastIndex(podName, "-")
+	index, err := strconv.Atoi(podName[dash+1:])
+	if dash < 0 || err != nil {
+		return "", 0, "", pkgerrors.Errorf("invalid storage host %s", host)
+	}
+	return podName[:dash], index, domain, nil
+}
+
+// genRestorePlan maps the RDB file of each master in the backup to the Redis
+// with the same StatefulSet index and port in the new cluster.
+// The RDB files are named by the order of the masters in the cluster metadata.
+func genRestorePlan(cr *undermoonv1alpha1.Undermoon, meta *clusterMeta) (map[string]string, error) {
+	plan := map[string]string{}
+	shardIndex := 0
+	for _, node := range meta.Nodes {
+		if node.Repl.Role != nodeRoleMaster {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(node.Address)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || (port != redisPort1 && port != redisPort2) {
+			return nil, pkgerrors.Errorf("invalid Redis address %s", node.Address)
+		}
+		_, index, _, err := splitStorageHost(host)
+		if err != nil {
+			return nil, err
+		}
+		podName := storageStatefulSetPodName(cr.ObjectMeta.Name, index)
+		plan[restorePlanKey(podName, port)] = backupShardFileName(shardIndex)
+		shardIndex++
+	}
+	return plan, nil
+}
+
+// rewriteRestoreMetadata replaces the storage hosts and the cluster name in the broker metadata
+// with the ones of the new cluster while keeping the StatefulSet indices,
+// so that the slots are assigned to the Redis loading the corresponding RDB files.
+func rewriteRestoreMetadata(cr *undermoonv1alpha1.Undermoon, meta *clusterMeta, metadata []byte) ([]byte, error) {
+	host, _, err := net.SplitHostPort(meta.Nodes[0].Address)
+	if err != nil {
+		return nil, err
+	}
+	oldStatefulSetName, _, oldDomain, err := splitStorageHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(metadata))
+	// Keep the epochs as they are.
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, pkgerrors.Wrap(err, "invalid broker metadata in the backup")
+	}
+
+	rewriter := &restoreMetadataRewriter{
+		hostRegexp:     regexp.MustCompile(`^` + regexp.QuoteMeta(oldStatefulSetName) + `-([0-9]+)` + regexp.QuoteMeta(oldDomain)),
+		newHost:        StorageStatefulSetName(cr.ObjectMeta.Name) + `-${1}` + genStorageFQDNFromName("", cr),
+		oldClusterName: meta.Name,
+		newClusterName: cr.Spec.ClusterName,
+	}
+	return json.Marshal(rewriter.rewrite("", doc))
+}
+
+type restoreMetadataRewriter struct {
+	hostRegexp     *regexp.Regexp
+	newHost        string
+	oldClusterName string
+	newClusterName string
+}
+
+// rewrite replaces the storage hosts in all the keys and the values.
+// The cluster name is only replaced in the keys of "clusters"
+// and the "name" and "cluster" fields.
+func (w *restoreMetadataRewriter) rewrite(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		rewritten := make(map[string]interface{}, len(v))
+		for childKey, child := range v {
+			newKey := w.hostRegexp.ReplaceAllString(childKey, w.newHost)
+			if key == "clusters" && childKey == w.oldClusterName {
+				newKey = w.newClusterName
+			}
+			rewritten[newKey] = w.rewrite(childKey, child)
+		}
+		return rewritten
+	case []interface{}:
+		for i, child := range v {
+			v[i] = w.rewrite(key, child)
+		}
+		return v
+	case string:
+		if (key == "name" || key == "cluster") && v == w.oldClusterName {
+			return w.newClusterName
+		}
+		return w.hostRegexp.ReplaceAllString(v, w.newHost)
+	}
+	return value
+}
@@ -0,0 +1,260 @@
+package undermoon
+
+import (
+	"context"
+	"fmt"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	pkgerrors "github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+var errRestoreFailed = pkgerrors.New("RESTORE_FAILED")
+
+// restoreController creates the cluster from a backup:
+// (1) read the metadata snapshots from the backup by a Job,
+// (2) create the storage pods with the chunk number of the backup
+// and let them load the RDB files by the init container,
+// (3) restore the broker metadata with the new addresses
+// before the server proxies are registered in reconcileMeta.
+type restoreController struct {
+	r         *ReconcileUndermoon
+	client    *brokerClient
+	clientset kubernetes.Interface
+}
+
+func newRestoreController(r *ReconcileUndermoon, clientset kubernetes.Interface) *restoreController {
+	return &restoreController{
+		r:         r,
+		client:    newBrokerClient(),
+		clientset: clientset,
+	}
+}
+
+func restoring(cr *undermoonv1alpha1.Undermoon) bool {
+	if cr.Spec.RestoreFrom == nil {
+		return false
+	}
+	return cr.Status.Restore == nil || cr.Status.Restore.Phase != undermoonv1alpha1.RestoreCompleted
+}
+
+// prepareRestore needs to run before creating the resources.
+// It overrides the chunk number with the one of the backup until the restore is done.
+func (con *restoreController) prepareRestore(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) error {
+	if !restoring(cr) {
+		return nil
+	}
+
+	if cr.Status.Restore == nil {
+		cr.Status.Restore = &undermoonv1alpha1.RestoreStatus{
+			Phase: undermoonv1alpha1.RestoreLoadingMetadata,
+		}
+		con.r.recorder.Event(cr, corev1.EventTypeNormal, eventRestoreStarted, "Start restoring the cluster from the backup")
+	}
+
+	status := cr.Status.Restore
+	switch status.Phase {
+	case undermoonv1alpha1.RestoreFailed:
+		setDegraded(cr, reasonRestoreFailed, pkgerrors.New(status.Message))
+		return errRestoreFailed
+	case undermoonv1alpha1.RestoreLoadingMetadata:
+		err := con.loadRestoreMetadata(reqLogger, cr)
+		if err != nil {
+			return err
+		}
+	}
+
+	cr.Spec.ChunkNumber = status.ChunkNumber
+	setProgressing(cr, reasonRestoring, "waiting for the storage pods to load the RDB files")
+	return nil
+}
+
+func (con *restoreController) failRestore(cr *undermoonv1alpha1.Undermoon, message string) error {
+	cr.Status.Restore.Phase = undermoonv1alpha1.RestoreFailed
+	cr.Status.Restore.Message = message
+	setDegraded(cr, reasonRestoreFailed, pkgerrors.New(message))
+	con.r.recorder.Event(cr, corev1.EventTypeWarning, eventRestoreFailed, message)
+	return errRestoreFailed
+}
+
+func (con *restoreController) loadRestoreMetadata(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) error {
+	setProgressing(cr, reasonRestoring, "reading the metadata snapshots from the backup")
+
+	job := createRestoreMetadataJob(cr)
+	if err := controllerutil.SetControllerReference(cr, job, con.r.scheme); err != nil {
+		return err
+	}
+
+	found := &batchv1.Job{}
+	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating a new restore metadata job", "Namespace", job.Namespace, "Name", job.Name)
+		err = con.r.client.Create(context.TODO(), job)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			reqLogger.Error(err, "failed to create restore metadata job", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return err
+		}
+		return errRetryReconciliation
+	} else if err != nil {
+		reqLogger.Error(err, "failed to get restore metadata job", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	for _, cond := range found.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			return con.failRestore(cr, fmt.Sprintf("failed to read the metadata from the backup: job %s failed", found.Name))
+		}
+	}
+	if found.Status.Succeeded == 0 {
+		return errRetryReconciliation
+	}
+
+	output, err := con.getJobOutput(found)
+	if err != nil {
+		reqLogger.Error(err, "failed to get the output of the restore metadata job", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	metadata, meta, err := parseRestoreMetadata(output)
+	if err != nil {
+		return con.failRestore(cr, err.Error())
+	}
+	plan, err := genRestorePlan(cr, meta)
+	if err != nil {
+		return con.failRestore(cr, err.Error())
+	}
+	metadata, err = rewriteRestoreMetadata(cr, meta, metadata)
+	if err != nil {
+		return con.failRestore(cr, err.Error())
+	}
+	plan[backupMetadataKey] = string(metadata)
+
+	configMap := createRestorePlanConfigMap(cr, plan)
+	if err := controllerutil.SetControllerReference(cr, configMap, con.r.scheme); err != nil {
+		return err
+	}
+	err = con.r.client.Create(context.TODO(), configMap)
+	if err != nil && errors.IsAlreadyExists(err) {
+		err = con.r.client.Update(context.TODO(), configMap)
+	}
+	if err != nil {
+		reqLogger.Error(err, "failed to create restore plan ConfigMap", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	chunkNumber := uint32(len(meta.Nodes) / chunkNodeNumber)
+	cr.Status.Restore.Phase = undermoonv1alpha1.RestoreLoadingData
+	cr.Status.Restore.ChunkNumber = chunkNumber
+	cr.Status.Restore.Epoch = meta.Epoch
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventRestoreLoadingData,
+		"Loading %d shards of %s at epoch %d from the backup", len(meta.Nodes)/2, meta.Name, meta.Epoch)
+
+	err = con.r.client.Delete(context.TODO(), found, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		reqLogger.Error(err, "failed to delete restore metadata job", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+	}
+	return nil
+}
+
+func (con *restoreController) getJobOutput(job *batchv1.Job) ([]byte, error) {
+	podList := &corev1.PodList{}
+	err := con.r.client.List(
+		context.TODO(),
+		podList,
+		client.InNamespace(job.Namespace),
+		client.MatchingLabels{"job-name": job.Name},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+		req := con.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container: restoreMetadataContainerName,
+		})
+		return req.DoRaw()
+	}
+	return nil, pkgerrors.Errorf("no succeeded pod found for job %s", job.Name)
+}
+
+// restoreMetadata sends the broker metadata in the backup to the master broker
+// after all the storage pods have loaded the RDB files.
+func (con *restoreController) restoreMetadata(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, storageStatefulSet *appsv1.StatefulSet, masterBrokerAddress string) error {
+	if !restoring(cr) {
+		return nil
+	}
+
+	pods, err := getStatefulSetPods(con.r.client, storageStatefulSet)
+	if err != nil {
+		reqLogger.Error(err, "failed to list storage pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	if len(pods) != int(cr.Spec.ChunkNumber)*halfChunkNodeNumber {
+		return errRetryReconciliation
+	}
+	for i := range pods {
+		if !restoreInitContainerDone(&pods[i]) {
+			setProgressing(cr, reasonRestoring, fmt.Sprintf("waiting for %s to load the RDB files", pods[i].ObjectMeta.Name))
+			return errRetryReconciliation
+		}
+	}
+
+	// The metadata might have been restored but the status failed to be updated.
+	exists, err := con.client.clusterExists(masterBrokerAddress, cr.Spec.ClusterName)
+	if err != nil {
+		reqLogger.Error(err, "failed to check whether cluster exists", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	configMap := &corev1.ConfigMap{}
+	configMap.ObjectMeta.Name = RestorePlanConfigMapName(cr.ObjectMeta.Name)
+	configMap.ObjectMeta.Namespace = cr.Namespace
+	if !exists {
+		err = con.r.client.Get(context.TODO(), types.NamespacedName{Name: configMap.ObjectMeta.Name, Namespace: cr.Namespace}, configMap)
+		if err != nil {
+			reqLogger.Error(err, "failed to get restore plan ConfigMap", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return err
+		}
+
+		err = con.client.restoreMetadata(masterBrokerAddress, []byte(configMap.Data[backupMetadataKey]))
+		if err != nil {
+			reqLogger.Error(err, "failed to restore broker metadata", "masterBrokerAddress", masterBrokerAddress, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return err
+		}
+	}
+
+	cr.Status.Restore.Phase = undermoonv1alpha1.RestoreCompleted
+	cr.Status.Restore.Message = "restored the broker metadata"
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventRestoreCompleted,
+		"Restored the cluster from the backup at epoch %d", cr.Status.Restore.Epoch)
+
+	// The recreated pods should not load the backup again.
+	err = con.r.client.Delete(context.TODO(), configMap)
+	if err != nil && !errors.IsNotFound(err) {
+		reqLogger.Error(err, "failed to delete restore plan ConfigMap", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	return nil
+}
+
+func restoreInitContainerDone(pod *corev1.Pod) bool {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name != restoreContainerName {
+			continue
+		}
+		terminated := status.State.Terminated
+		return terminated != nil && terminated.ExitCode == 0
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package undermoon
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestRestoreUndermoon(name, clusterName string) *undermoonv1alpha1.Undermoon {
+	return &undermoonv1alpha1.Undermoon{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "restored",
+		},
+		Spec: undermoonv1alpha1.UndermoonSpec{
+			ClusterName: clusterName,
+			ChunkNumber: 1,
+		},
+	}
+}
+
+// The nodes of a chunk in the backup of the Undermoon "old" in the namespace "backup".
+func newTestBackupClusterMeta(clusterName string) *clusterMeta {
+	redisAddress := func(index, port int) string {
+		return fmt.Sprintf("old-stg-ss-%d.old-stg-svc.backup.svc.cluster.local:%d", index, port)
+	}
+	return &clusterMeta{
+		Name:  clusterName,
+		Epoch: 7,
+		Nodes: []clusterNode{
+			{Address: redisAddress(0, redisPort1), Repl: replMeta{Role: nodeRoleMaster}},
+			{Address: redisAddress(0, redisPort2), Repl: replMeta{Role: "replica"}},
+			{Address: redisAddress(1, redisPort1), Repl: replMeta{Role: "replica"}},
+			{Address: redisAddress(1, redisPort2), Repl: replMeta{Role: nodeRoleMaster}},
+		},
+	}
+}
+
+func TestGenRestorePlan(t *testing.T) {
+	cr := newTestRestoreUndermoon("new", "mycluster")
+	invalidPort := newTestBackupClusterMeta("mycluster")
+	invalidPort.Nodes[0].Address = "old-stg-ss-0.old-stg-svc.backup.svc.cluster.local:6379"
+	invalidHost := newTestBackupClusterMeta("mycluster")
+	invalidHost.Nodes[3].Address = "localhost:7002"
+
+	cases := []struct {
+		name     string
+		meta     *clusterMeta
+		expected map[string]string
+		err      bool
+	}{
+		{
+			name: "masters on both ports",
+			meta: newTestBackupClusterMeta("mycluster"),
+			expected: map[string]string{
+				restorePlanKey("new-stg-ss-0", redisPort1): backupShardFileName(0),
+				restorePlanKey("new-stg-ss-1", redisPort2): backupShardFileName(1),
+			},
+		},
+		{name: "invalid port", meta: invalidPort, err: true},
+		{name: "invalid host", meta: invalidHost, err: true},
+	}
+
+	for _, c := range cases {
+		plan, err := genRestorePlan(cr, c.meta)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", c.name, plan)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(plan, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, plan)
+		}
+	}
+}
+
+// The cluster name also shows up in the values not referring to the cluster,
+// which should be kept.
+func genTestBrokerMetadata(host, clusterName string) string {
+	return fmt.Sprintf(`{
+		"global_epoch": 9007199254740993,
+		"clusters": {
+			"%[2]s": {
+				"name": "%[2]s",
+				"epoch": 7,
+				"config": {"comment": "mycluster"},
+				"chunks": [{"proxy_addresses": ["%[1]s:5299"], "nodes": ["%[1]s:7001", "%[1]s:7002"]}]
+			}
+		},
+		"all_proxies": {
+			"%[1]s:5299": {"proxy_address": "%[1]s:5299", "cluster": "%[2]s", "node_addresses": ["%[1]s:7001"]}
+		},
+		"failed_proxies": ["mycluster"]
+	}`, host, clusterName)
+}
+
+func TestRewriteRestoreMetadata(t *testing.T) {
+	oldHost := "old-stg-ss-1.old-stg-svc.backup.svc.cluster.local"
+	newHost := "new-stg-ss-1.new-stg-svc.restored.svc.cluster.local"
+	metadata := genTestBrokerMetadata(oldHost, "mycluster")
+
+	cases := []struct {
+		name        string
+		clusterName string
+	}{
+		{name: "rename cluster", clusterName: "restored"},
+		{name: "keep cluster name", clusterName: "mycluster"},
+	}
+
+	for _, c := range cases {
+		cr := newTestRestoreUndermoon("new", c.clusterName)
+		rewritten, err := rewriteRestoreMetadata(cr, newTestBackupClusterMeta("mycluster"), []byte(metadata))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		assertJSONEqual(t, c.name, genTestBrokerMetadata(newHost, c.clusterName), string(rewritten))
+		if !strings.Contains(string(rewritten), "9007199254740993") {
+			t.Errorf("%s: expected the epoch to be kept, got %s", c.name, rewritten)
+		}
+	}
+
+	_, err := rewriteRestoreMetadata(newTestRestoreUndermoon("new", "restored"), newTestBackupClusterMeta("mycluster"), []byte("{"))
+	if err == nil {
+		t.Errorf("expected error for the invalid metadata")
+	}
+}
+
+func assertJSONEqual(t *testing.T, name, expected, got string) {
+	var expectedDoc, gotDoc interface{}
+	if err := json.Unmarshal([]byte(expected), &expectedDoc); err != nil {
+		t.Fatalf("%s: invalid expected JSON: %v", name, err)
+	}
+	if err := json.Unmarshal([]byte(got), &gotDoc); err != nil {
+		t.Fatalf("%s: invalid JSON %s: %v", name, got, err)
+	}
+	if !reflect.DeepEqual(expectedDoc, gotDoc) {
+		t.Errorf("%s: expected %s, got %s", name, expected, got)
+	}
+}
+
+func TestParseRestoreMetadata(t *testing.T) {
+	meta, err := json.Marshal(newTestBackupClusterMeta("mycluster"))
+	if err != nil {
+		t.Fatalf("failed to marshal cluster meta: %v", err)
+	}
+	emptyMeta, err := json.Marshal(&clusterMeta{Name: "mycluster"})
+	if err != nil {
+		t.Fatalf("failed to marshal cluster meta: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		output string
+		err    bool
+	}{
+		{name: "valid", output: "{\"clusters\": {}}\n" + restoreMetadataSeparator + "\n" + string(meta)},
+		{name: "no separator", output: "{\"clusters\": {}}\n" + string(meta), err: true},
+		{name: "invalid broker metadata", output: "{\n" + restoreMetadataSeparator + "\n" + string(meta), err: true},
+		{name: "no nodes", output: "{}\n" + restoreMetadataSeparator + "\n" + string(emptyMeta), err: true},
+	}
+
+	for _, c := range cases {
+		metadata, parsed, err := parseRestoreMetadata([]byte(c.output))
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if string(metadata) != "{\"clusters\": {}}" {
+			t.Errorf("%s: unexpected broker metadata %s", c.name, metadata)
+		}
+		if !reflect.DeepEqual(parsed, newTestBackupClusterMeta("mycluster")) {
+			t.Errorf("%s: unexpected cluster meta %+v", c.name, parsed)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package undermoon
+
+import (
+	"context"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	reasonReconcileFailed      = "ReconcileFailed"
+	reasonBrokerNotReady       = "BrokerNotReady"
+	reasonBrokerReady          = "BrokerReady"
+	reasonCoordinatorNotReady  = "CoordinatorNotReady"
+	reasonStorageNotReady      = "StorageNotReady"
+	reasonStorageReady         = "StorageReady"
+	reasonStorageNotStable     = "StorageNotStable"
+	reasonSlotsMigrating       = "SlotsMigrating"
+	reasonNoMigration          = "NoMigration"
+	reasonWaitingForSlots      = "WaitingForSlotMigration"
+	reasonWaitingForScalingOut = "WaitingForScalingOut"
+	reasonClusterReady         = "ClusterReady"
+	reasonReconcileSucceeded   = "ReconcileSucceeded"
+	reasonWaitingForReconcile  = "WaitingForReconcile"
+	reasonUpgradingStorage     = "UpgradingStorage"
+	reasonCanarySoaking        = "CanarySoaking"
+	reasonCanaryFailed         = "CanaryFailed"
+	reasonWaitingForReplica    = "WaitingForReplica"
+	reasonNoReplica            = "NoConnectedReplica"
+	reasonUpgradingBroker      = "UpgradingBroker"
+	reasonUpgradingCoordinator = "UpgradingCoordinator"
+	reasonRestoring            = "Restoring"
+	reasonRestoreFailed        = "RestoreFailed"
+	reasonRotatingPassword     = "RotatingPassword"
+	reasonScalingBroker        = "ScalingBroker"
+	reasonScalingCoordinator   = "ScalingCoordinator"
+	reasonInvalidSpec          = "InvalidSpec"
+	reasonMaxMemoryTooSmall    = "MaxMemoryTooSmall"
+)
+
+func getCondition(status *undermoonv1alpha1.UndermoonStatus, condType undermoonv1alpha1.UndermoonConditionType) *undermoonv1alpha1.UndermoonCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition only changes LastTransitionTime when the status of the condition changes.
+func setCondition(cr *undermoonv1alpha1.Undermoon, condType undermoonv1alpha1.UndermoonConditionType, status corev1.ConditionStatus, reason, message string) {
+	cond := getCondition(&cr.Status, condType)
+	if cond == nil {
+		cr.Status.Conditions = append(cr.Status.Conditions, undermoonv1alpha1.UndermoonCondition{
+			Type:               condType,
+			Status:             status,
+			LastTransitionTime: metav1.Now(),
+			Reason:             reason,
+			Message:            message,
+		})
+		return
+	}
+
+	if cond.Status != status {
+		cond.LastTransitionTime = metav1.Now()
+	}
+	cond.Status = status
+	cond.Reason = reason
+	cond.Message = message
+}
+
+// setProgressing marks the cluster as not ready yet and explains why we need to requeue.
+func setProgressing(cr *undermoonv1alpha1.Undermoon, reason, message string) {
+	setCondition(cr, undermoonv1alpha1.UndermoonProgressing, corev1.ConditionTrue, reason, message)
+	setCondition(cr, undermoonv1alpha1.UndermoonReady, corev1.ConditionFalse, reason, message)
+}
+
+// conditionIs is used to only emit the events on the transitions of the conditions.
+func conditionIs(cr *undermoonv1alpha1.Undermoon, condType undermoonv1alpha1.UndermoonConditionType, status corev1.ConditionStatus, reason string) bool {
+	cond := getCondition(&cr.Status, condType)
+	return cond != nil && cond.Status == status && cond.Reason == reason
+}
+
+func setDegraded(cr *undermoonv1alpha1.Undermoon, reason string, err error) {
+	setCondition(cr, undermoonv1alpha1.UndermoonDegraded, corev1.ConditionTrue, reason, err.Error())
+	setCondition(cr, undermoonv1alpha1.UndermoonReady, corev1.ConditionFalse, reason, err.Error())
+}
+
+func setClusterReady(cr *undermoonv1alpha1.Undermoon) {
+	msg := "the cluster has reached the desired state"
+	setCondition(cr, undermoonv1alpha1.UndermoonReady, corev1.ConditionTrue, reasonClusterReady, msg)
+	setCondition(cr, undermoonv1alpha1.UndermoonProgressing, corev1.ConditionFalse, reasonReconcileSucceeded, msg)
+	setCondition(cr, undermoonv1alpha1.UndermoonMigrating, corev1.ConditionFalse, reasonNoMigration, "no slot migration is running")
+	setCondition(cr, undermoonv1alpha1.UndermoonDegraded, corev1.ConditionFalse, reasonReconcileSucceeded, msg)
+	setCondition(cr, undermoonv1alpha1.UndermoonBrokerAvailable, corev1.ConditionTrue, reasonBrokerReady, "the master broker is available")
+	setCondition(cr, undermoonv1alpha1.UndermoonStorageAvailable, corev1.ConditionTrue, reasonStorageReady, "all the server proxies are ready")
+}
+
+func setClusterInfoStatus(cr *undermoonv1alpha1.Undermoon, info *clusterInfo) {
+	cr.Status.NodeNumber = info.NodeNumber
+	cr.Status.NodeNumberWithSlots = info.NodeNumberWithSlots
+	cr.Status.IsMigrating = info.IsMigrating
+	cr.Status.CurrentChunkNumber = uint32(info.NodeNumberWithSlots / chunkNodeNumber)
+}
+
+// initConditions makes sure all the conditions show up in the status
+// even before the first reconciliation finishes.
+func initConditions(cr *undermoonv1alpha1.Undermoon) {
+	condTypes := []undermoonv1alpha1.UndermoonConditionType{
+		undermoonv1alpha1.UndermoonReady,
+		undermoonv1alpha1.UndermoonProgressing,
+		undermoonv1alpha1.UndermoonMigrating,
+		undermoonv1alpha1.UndermoonDegraded,
+		undermoonv1alpha1.UndermoonBrokerAvailable,
+		undermoonv1alpha1.UndermoonStorageAvailable,
+	}
+	for _, condType := range condTypes {
+		if getCondition(&cr.Status, condType) == nil {
+			setCondition(cr, condType, corev1.ConditionUnknown, reasonWaitingForReconcile, "waiting for the operator to reconcile the cluster")
+		}
+	}
+}
+
+func (r *ReconcileUndermoon) updateStatus(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, originalStatus *undermoonv1alpha1.UndermoonStatus) error {
+	cr.Status.ObservedGeneration = cr.ObjectMeta.Generation
+	if equality.Semantic.DeepEqual(&cr.Status, originalStatus) {
+		return nil
+	}
+
+	err := r.client.Status().Update(context.TODO(), cr)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on updating undermoon status. Try again.", "error", err)
+			return errRetryReconciliation
+		}
+		reqLogger.Error(err, "Failed to update undermoon status", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	return nil
+}
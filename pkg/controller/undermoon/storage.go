@@ -2,22 +2,32 @@ package undermoon
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // DefaultServerProxyPort is the port for clients to connect to.
-const DefaultServerProxyPort = 5299
+const DefaultServerProxyPort = undermoonv1alpha1.DefaultServerProxyPort
 const redisPort1 = 7001
 const redisPort2 = 7002
 const serverProxyContainerName = "server-proxy"
 const redisContainerName = "redis"
 const undermoonServiceTypeStorage = "storage"
-const storageTopologyKey = "undermoon-storage-topology-key"
+const redisDataVolumeName = "redis-data"
+const redisDataPath = "/data"
+const redisConfigVolumeName = "redis-config"
+const redisConfigPath = "/undermoon-redis-config"
+const redisConfigFileName = "redis.conf"
+
+// The default save points of Redis.
+var redisSaveArgs = []string{"--save", "900", "1", "--save", "300", "10", "--save", "60", "10000"}
 
 // This service is only used internally for getting the created server proxies
 // which have not received UMCTL SETCLUSTER.
@@ -112,10 +122,6 @@ func createStorageStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulS
 
 	env := []corev1.EnvVar{
 		podNameEnv(),
-		{
-			Name:  "RUST_LOG",
-			Value: "undermoon=info,server_proxy=info",
-		},
 		{
 			Name:  "UNDERMOON_ADDRESS",
 			Value: fmt.Sprintf("0.0.0.0:%d", cr.Spec.Port),
@@ -126,40 +132,8 @@ func createStorageStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulS
 			Value: "true",
 		},
 		{
-			Name:  "UNDERMOON_SLOWLOG_LEN",
-			Value: "1024",
-		},
-		{
-			Name:  "UNDERMOON_SLOWLOG_LOG_SLOWER_THAN",
-			Value: "10000",
-		},
-		{
-			Name:  "UNDERMOON_SLOWLOG_SAMPLE_RATE",
-			Value: "1000",
-		},
-		{
-			Name:  "UNDERMOON_SESSION_CHANNEL_SIZE",
-			Value: "4096",
-		},
-		{
-			Name:  "UNDERMOON_BACKEND_CHANNEL_SIZE",
-			Value: "4096",
-		},
-		{
-			Name:  "UNDERMOON_BACKEND_BATCH_MIN_TIME",
-			Value: "20000",
-		},
-		{
-			Name:  "UNDERMOON_BACKEND_BATCH_MAX_TIME",
-			Value: "400000",
-		},
-		{
-			Name:  "UNDERMOON_SESSION_BATCH_MIN_TIME",
-			Value: "20000",
-		},
-		{
-			Name:  "UNDERMOON_SESSION_BATCH_MAX_TIME",
-			Value: "400000",
+			Name:  "UNDERMOON_THREAD_NUMBER",
+			Value: strconv.FormatUint(uint64(cr.Spec.ProxyThreads), 10),
 		},
 		{
 			Name:  "UNDERMOON_ACTIVE_REDIRECTION",
@@ -170,6 +144,11 @@ func createStorageStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulS
 			Value: firstProxyAddress,
 		},
 	}
+	env = append(env, genServerProxyConfigEnv(&cr.Spec.ProxyConfig)...)
+	// The clients need to authenticate with the password
+	// and the server proxy uses it to connect to Redis.
+	env = append(env, genAuthEnv(cr, redisPasswordEnvName, "UNDERMOON_PASSWORD", "UNDERMOON_BACKEND_PASSWORD")...)
+	env = append(env, genServerProxyTLSEnv(cr)...)
 
 	fqdn := genStorageFQDNFromName(podNameStr, cr)
 	serverProxyContainer := corev1.Container{
@@ -185,24 +164,25 @@ func createStorageStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulS
 		Resources: cr.Spec.ProxyResources,
 		Lifecycle: genPreStopHookLifeCycle([]string{"sleep", "10"}),
 	}
-	redisContainer1 := genRedisContainer(1, cr.Spec.RedisImage, cr.Spec.MaxMemory, redisPort1, cr)
-	redisContainer2 := genRedisContainer(2, cr.Spec.RedisImage, cr.Spec.MaxMemory, redisPort2, cr)
-
-	checkCmd := []string{
-		"bash",
-		"-c",
-		// Checks whether the server proxy has received UMCTL SETCLUSTER.
-		// Send UMCTL READY to server proxy and
-		// see whether it returns `:1\r\n`.
-		fmt.Sprintf(
-			"[ \"$(exec 5<>/dev/tcp/localhost/%d; printf '*2\r\n$5\r\nUMCTL\r\n$5\r\nREADY\r\n' >&5; head -c 2 <&5)\" == ':1' ]",
-			cr.Spec.Port,
-		),
+	if cr.Spec.TLS != nil {
+		serverProxyContainer.VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      tlsVolumeName,
+				MountPath: tlsPath,
+				ReadOnly:  true,
+			},
+		}
 	}
+	// The readiness probe reads the password from the files refreshed by the kubelet.
+	serverProxyContainer.VolumeMounts = append(serverProxyContainer.VolumeMounts, genAuthVolumeMounts(cr)...)
+	// The maxMemory in the spec is only used after it's applied to the running Redis.
+	redisContainer1 := genRedisContainer(1, cr.Spec.RedisImage, cr.Status.MaxMemory, redisPort1, cr)
+	redisContainer2 := genRedisContainer(2, cr.Spec.RedisImage, cr.Status.MaxMemory, redisPort2, cr)
+
 	serverProxyContainer.ReadinessProbe = &corev1.Probe{
 		Handler: corev1.Handler{
 			Exec: &corev1.ExecAction{
-				Command: checkCmd,
+				Command: genServerProxyCheckCmd(cr),
 			},
 		},
 		PeriodSeconds:    1,
@@ -220,9 +200,18 @@ func createStorageStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulS
 				redisContainer1,
 				redisContainer2,
 			},
-			Affinity: genAntiAffinity(labels, cr.ObjectMeta.Namespace, storageTopologyKey),
+			Affinity:                  genAntiAffinity(labels, cr.ObjectMeta.Namespace, &cr.Spec.Placement),
+			TopologySpreadConstraints: genTopologySpreadConstraints(labels, &cr.Spec.Placement),
 		},
 	}
+	if cr.Spec.RestoreFrom != nil {
+		podSpec.Spec.InitContainers = []corev1.Container{genRestoreInitContainer(cr)}
+		podSpec.Spec.Volumes = genRestoreVolumes(cr)
+	}
+	podSpec.Spec.Volumes = append(podSpec.Spec.Volumes, genTLSVolumes(cr)...)
+	podSpec.Spec.Volumes = append(podSpec.Spec.Volumes, genAuthVolumes(cr)...)
+	podSpec.Spec.Volumes = append(podSpec.Spec.Volumes, genRedisConfigVolume(cr))
+	applyPodSettings(&podSpec, &cr.Spec.StoragePod)
 
 	replicaNum := int32(int(cr.Spec.ChunkNumber) * halfChunkNodeNumber)
 
@@ -242,32 +231,284 @@ func createStorageStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulS
 			Replicas:            &replicaNum,
 			Template:            podSpec,
 			PodManagementPolicy: appsv1.ParallelPodManagement,
+			// The pods are upgraded by the operator one by one
+			// after failing over the masters inside them.
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.OnDeleteStatefulSetStrategyType,
+			},
+			VolumeClaimTemplates: genRedisVolumeClaimTemplates(cr),
 		},
 	}
 }
 
+func genServerProxyConfigEnv(config *undermoonv1alpha1.ProxyConfig) []corev1.EnvVar {
+	slowlogLogSlowerThan := int64(undermoonv1alpha1.DefaultProxySlowlogLogSlowerThan)
+	if config.SlowlogLogSlowerThan != nil {
+		slowlogLogSlowerThan = *config.SlowlogLogSlowerThan
+	}
+	return []corev1.EnvVar{
+		{
+			Name:  "RUST_LOG",
+			Value: config.LogLevel,
+		},
+		{
+			Name:  "UNDERMOON_SLOWLOG_LEN",
+			Value: strconv.FormatUint(uint64(config.SlowlogLen), 10),
+		},
+		{
+			Name:  "UNDERMOON_SLOWLOG_LOG_SLOWER_THAN",
+			Value: strconv.FormatInt(slowlogLogSlowerThan, 10),
+		},
+		{
+			Name:  "UNDERMOON_SLOWLOG_SAMPLE_RATE",
+			Value: strconv.FormatUint(uint64(config.SlowlogSampleRate), 10),
+		},
+		{
+			Name:  "UNDERMOON_SESSION_CHANNEL_SIZE",
+			Value: strconv.FormatUint(uint64(config.SessionChannelSize), 10),
+		},
+		{
+			Name:  "UNDERMOON_BACKEND_CHANNEL_SIZE",
+			Value: strconv.FormatUint(uint64(config.BackendChannelSize), 10),
+		},
+		{
+			Name:  "UNDERMOON_BACKEND_BATCH_MIN_TIME",
+			Value: strconv.FormatUint(config.BackendBatchMinTime, 10),
+		},
+		{
+			Name:  "UNDERMOON_BACKEND_BATCH_MAX_TIME",
+			Value: strconv.FormatUint(config.BackendBatchMaxTime, 10),
+		},
+		{
+			Name:  "UNDERMOON_SESSION_BATCH_MIN_TIME",
+			Value: strconv.FormatUint(config.SessionBatchMinTime, 10),
+		},
+		{
+			Name:  "UNDERMOON_SESSION_BATCH_MAX_TIME",
+			Value: strconv.FormatUint(config.SessionBatchMaxTime, 10),
+		},
+	}
+}
+
+// genServerProxyCheckCmd checks whether the server proxy has received UMCTL SETCLUSTER.
+// Send UMCTL READY to server proxy and see whether it returns `:1\r\n`.
+func genServerProxyCheckCmd(cr *undermoonv1alpha1.Undermoon) []string {
+	request := "*2\r\n$5\r\nUMCTL\r\n$5\r\nREADY\r\n"
+	printArgs := ""
+	response := "head -c 2"
+	if cr.Spec.Auth != nil {
+		// Send AUTH first and skip its `+OK\r\n`.
+		// The length of the password is counted in bytes.
+		request = "*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n" + request
+		printArgs = " \"${#1}\" \"$1\""
+		response = "head -c 7 | tail -c 2"
+	}
+
+	cmd := fmt.Sprintf(
+		"exec 5<>/dev/tcp/localhost/%d; printf '%s'%s >&5; { %s; } <&5",
+		cr.Spec.Port, request, printArgs, response,
+	)
+	if cr.Spec.TLS != nil {
+		// Run openssl as a coprocess so that its stdin is kept open until the response is read,
+		// and kill it afterwards since it ignores the EOF in the quiet mode.
+		cmd = fmt.Sprintf(
+			"coproc TLSCONN { openssl s_client -quiet -verify_return_error -connect localhost:%d"+
+				" -CAfile %s/%s -cert %s/%s -key %s/%s 2>/dev/null; }; "+
+				"printf '%s'%s >&${TLSCONN[1]}; { %s; } <&${TLSCONN[0]}; kill $TLSCONN_PID 2>/dev/null",
+			cr.Spec.Port, tlsPath, tlsCAKey, tlsPath, corev1.TLSCertKey, tlsPath, corev1.TLSPrivateKeyKey,
+			request, printArgs, response,
+		)
+	}
+	if cr.Spec.Auth == nil {
+		return []string{"bash", "-c", fmt.Sprintf("LC_ALL=C; [ \"$(%s)\" == ':1' ]", cmd)}
+	}
+
+	// The password in the env is not changed after the rotation.
+	// Read it from the mounted Secrets instead, trying the new password before the old one.
+	// The trailing x keeps the trailing newlines of the password.
+	return []string{"bash", "-c", fmt.Sprintf(
+		"LC_ALL=C; check() { %s; }; "+
+			"for f in %s; do pw=\"$(cat \"$f\" 2>/dev/null && echo x)\" || continue; "+
+			"[ \"$(check \"${pw%%x}\")\" == ':1' ] && exit 0; done; exit 1",
+		cmd, strings.Join(genAuthPasswordFiles(cr), " "),
+	)}
+}
+
+func genRedisVolumeClaimTemplates(cr *undermoonv1alpha1.Undermoon) []corev1.PersistentVolumeClaim {
+	persistence := cr.Spec.Persistence
+	if persistence == nil {
+		return nil
+	}
+	return []corev1.PersistentVolumeClaim{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: redisDataVolumeName,
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				StorageClassName: persistence.StorageClassName,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: persistence.Size,
+					},
+				},
+			},
+		},
+	}
+}
+
+func genRedisPersistenceArgs(persistence *undermoonv1alpha1.PersistenceSpec) []string {
+	if persistence == nil {
+		return nil
+	}
+
+	args := []string{"--dir", redisDataPath}
+	switch persistence.Mode {
+	case undermoonv1alpha1.AOFPersistenceMode:
+		// Disable RDB snapshots.
+		args = append(args, "--save", "", "--appendonly", "yes")
+	case undermoonv1alpha1.RDBAndAOFPersistenceMode:
+		args = append(args, redisSaveArgs...)
+		args = append(args, "--appendonly", "yes")
+	default:
+		args = append(args, redisSaveArgs...)
+		args = append(args, "--appendonly", "no")
+	}
+	args = append(args, "--appendfsync", string(persistence.AppendFsync))
+	return args
+}
+
+// Redis needs more memory than maxmemory for the replication buffers,
+// the client buffers and the memory fragmentation.
+// The request is derived from the applied maxMemory
+// so that it follows the changes of maxMemory.
+func genRedisResources(specResources corev1.ResourceRequirements, maxMemory uint32) corev1.ResourceRequirements {
+	resources := *specResources.DeepCopy()
+	if _, ok := resources.Requests[corev1.ResourceMemory]; ok {
+		return resources
+	}
+	// The request defaults to the limit if the limit is specified.
+	if _, ok := resources.Limits[corev1.ResourceMemory]; ok {
+		return resources
+	}
+	if resources.Requests == nil {
+		resources.Requests = corev1.ResourceList{}
+	}
+	request := int64(maxMemory) * 3 / 2
+	resources.Requests[corev1.ResourceMemory] = *resource.NewQuantity(request*1024*1024, resource.BinarySI)
+	return resources
+}
+
 func genRedisContainer(index uint32, redisImage string, maxMemory, port uint32, cr *undermoonv1alpha1.Undermoon) corev1.Container {
 	portStr := fmt.Sprintf("%d", port)
-	return corev1.Container{
-		Name:            fmt.Sprintf("%s-%d", redisContainerName, index),
+	name := fmt.Sprintf("%s-%d", redisContainerName, index)
+	// The config file needs to be the first argument.
+	// The config managed by the operator below overrides it.
+	args := []string{
+		fmt.Sprintf("%s/%s", redisConfigPath, redisConfigFileName),
+		"--maxmemory",
+		fmt.Sprintf("%dMB", maxMemory),
+		"--port",
+		portStr,
+		"--slave-announce-port",
+		portStr,
+		"--slave-announce-ip",
+		podIPEnvStr,
+	}
+	args = append(args, genRedisPersistenceArgs(cr.Spec.Persistence)...)
+	args = append(args, genRedisAuthArgs(cr)...)
+	if cr.Spec.Persistence == nil && cr.Spec.RestoreFrom != nil {
+		// Load the RDB file copied by the restore init container.
+		args = append(args, "--dir", redisDataPath)
+	}
+
+	container := corev1.Container{
+		Name:            name,
 		Image:           redisImage,
 		ImagePullPolicy: corev1.PullIfNotPresent,
 		Command:         []string{"redis-server"},
-		Args: []string{
-			"--maxmemory",
-			fmt.Sprintf("%dMB", maxMemory),
-			"--port",
-			portStr,
-			"--slave-announce-port",
-			portStr,
-			"--slave-announce-ip",
-			podIPEnvStr,
-			"--maxmemory-policy",
-			"allkeys-lru",
+		Args:            args,
+		Env:             append([]corev1.EnvVar{podIPEnv()}, genAuthEnv(cr, redisPasswordEnvName)...),
+		Resources:       genRedisResources(cr.Spec.RedisResources, maxMemory),
+		Lifecycle:       genPreStopHookLifeCycle([]string{"sleep", "10"}),
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      redisConfigVolumeName,
+				MountPath: redisConfigPath,
+				ReadOnly:  true,
+			},
+		},
+	}
+	if cr.Spec.Persistence != nil || cr.Spec.RestoreFrom != nil {
+		// The two Redis share the same volume with different directories.
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      redisDataVolumeName,
+			MountPath: redisDataPath,
+			SubPath:   name,
+		})
+	}
+	return container
+}
+
+// RedisConfigMapName defines the ConfigMap for the config file of Redis.
+// Changing it does not restart the storage pods.
+func RedisConfigMapName(undermoonName string) string {
+	return fmt.Sprintf("%s-redis-config", undermoonName)
+}
+
+func createRedisConfigMap(cr *undermoonv1alpha1.Undermoon) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      RedisConfigMapName(cr.ObjectMeta.Name),
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"undermoonService":     undermoonServiceTypeStorage,
+				"undermoonName":        cr.ObjectMeta.Name,
+				"undermoonClusterName": cr.Spec.ClusterName,
+			},
+		},
+		Data: map[string]string{
+			redisConfigFileName: genRedisConfigFile(cr.Spec.RedisConfig),
+		},
+	}
+}
+
+// The config managed by the operator is skipped
+// in case the spec is not checked by the webhook.
+func sortedRedisConfigNames(config map[string]string) []string {
+	names := []string{}
+	for name := range config {
+		if undermoonv1alpha1.IsManagedRedisConfig(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func genRedisConfigFile(config map[string]string) string {
+	var builder strings.Builder
+	for _, name := range sortedRedisConfigNames(config) {
+		value := config[name]
+		if value == "" {
+			value = `""`
+		}
+		builder.WriteString(fmt.Sprintf("%s %s\n", name, value))
+	}
+	return builder.String()
+}
+
+func genRedisConfigVolume(cr *undermoonv1alpha1.Undermoon) corev1.Volume {
+	return corev1.Volume{
+		Name: redisConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: RedisConfigMapName(cr.ObjectMeta.Name),
+				},
+			},
 		},
-		Env:       []corev1.EnvVar{podIPEnv()},
-		Resources: cr.Spec.RedisResources,
-		Lifecycle: genPreStopHookLifeCycle([]string{"sleep", "10"}),
 	}
 }
 
@@ -294,6 +535,11 @@ func genStorageFQDN(podName, undermoonName, namespace string) string {
 	return fmt.Sprintf("%s.%s.%s.svc.cluster.local", podName, StorageServiceName(undermoonName), namespace)
 }
 
+func genStoragePublicServiceAddress(cr *undermoonv1alpha1.Undermoon) string {
+	host := fmt.Sprintf("%s.%s.svc.cluster.local", StoragePublicServiceName(cr.ObjectMeta.Name), cr.ObjectMeta.Namespace)
+	return fmt.Sprintf("%s:%d", host, cr.Spec.Port)
+}
+
 func genStorageFQDNFromName(name string, cr *undermoonv1alpha1.Undermoon) string {
 	host := genStorageFQDN(name, cr.ObjectMeta.Name, cr.ObjectMeta.Namespace)
 	return host
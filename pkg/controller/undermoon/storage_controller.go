@@ -2,11 +2,15 @@ package undermoon
 
 import (
 	"context"
+	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 
 	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
 	"github.com/go-logr/logr"
+	"github.com/go-redis/redis/v8"
+	pkgerrors "github.com/pkg/errors"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -15,13 +19,20 @@ import (
 )
 
 type storageController struct {
-	r         *ReconcileUndermoon
-	proxyPool *serverProxyClientPool
+	r            *ReconcileUndermoon
+	proxyPool    *serverProxyClientPool
+	brokerClient *brokerClient
+	redisPool    *redisClientPool
 }
 
 func newStorageController(r *ReconcileUndermoon) *storageController {
 	pool := newServerProxyClientPool()
-	return &storageController{r: r, proxyPool: pool}
+	return &storageController{
+		r:            r,
+		proxyPool:    pool,
+		brokerClient: newBrokerClient(),
+		redisPool:    newRedisClientPool(),
+	}
 }
 
 func (con *storageController) createStorage(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) (*appsv1.StatefulSet, *corev1.Service, error) {
@@ -38,6 +49,16 @@ func (con *storageController) createStorage(reqLogger logr.Logger, cr *undermoon
 		return nil, nil, err
 	}
 
+	// The certificate needs to be created before the pods mounting it.
+	err = con.createTLS(reqLogger, cr)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = con.createOrUpdateRedisConfigMap(reqLogger, cr)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	storage, err := createStatefulSetGuard(func() (*appsv1.StatefulSet, error) {
 		return con.getOrCreateStorageStatefulSet(reqLogger, cr)
 	})
@@ -48,6 +69,8 @@ func (con *storageController) createStorage(reqLogger logr.Logger, cr *undermoon
 
 	// Only update replica number here for scaling out.
 	if int32(cr.Spec.ChunkNumber)*2 > *storage.Spec.Replicas {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventScalingOut,
+			"Scaling out storage StatefulSet from %d to %d replicas", *storage.Spec.Replicas, int32(cr.Spec.ChunkNumber)*2)
 		storage, err = con.updateStorageStatefulSet(reqLogger, cr, storage)
 		if err != nil {
 			if err != errRetryReconciliation {
@@ -60,13 +83,165 @@ func (con *storageController) createStorage(reqLogger logr.Logger, cr *undermoon
 	return storage, storageService, nil
 }
 
+func (con *storageController) createOrUpdateRedisConfigMap(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) error {
+	configMap := createRedisConfigMap(cr)
+	if err := controllerutil.SetControllerReference(cr, configMap, con.r.scheme); err != nil {
+		return err
+	}
+
+	found := &corev1.ConfigMap{}
+	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: configMap.Name, Namespace: configMap.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating a new Redis config ConfigMap", "Namespace", configMap.Namespace, "Name", configMap.Name)
+		err = con.r.client.Create(context.TODO(), configMap)
+	} else if err == nil && !reflect.DeepEqual(found.Data, configMap.Data) {
+		found.Data = configMap.Data
+		err = con.r.client.Update(context.TODO(), found)
+	}
+	if err != nil {
+		reqLogger.Error(err, "failed to create or update Redis config ConfigMap", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	return nil
+}
+
+// reconcileRedisConfig applies redisConfig to the running Redis by CONFIG SET
+// since the config file is only loaded when Redis starts.
+// The config removed from redisConfig is not reset until the pods are restarted.
+func (con *storageController) reconcileRedisConfig(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, storageStatefulSet *appsv1.StatefulSet) error {
+	hash, err := computeHash(cr.Spec.RedisConfig)
+	if err != nil {
+		return err
+	}
+	if cr.Status.RedisConfigHash == hash {
+		return nil
+	}
+
+	password, err := getAuthPassword(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get password", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	pods, err := getStatefulSetPods(con.r.client, storageStatefulSet)
+	if err != nil {
+		reqLogger.Error(err, "failed to list storage pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	names := sortedRedisConfigNames(cr.Spec.RedisConfig)
+	// Some config can't be changed at runtime
+	// and only takes effect after the pods are restarted.
+	rejected := map[string]string{}
+	addresses := genStorageRedisAddresses(pods, cr)
+	for _, address := range addresses {
+		client := con.redisPool.getClient(address, password)
+		for _, name := range names {
+			err := client.ConfigSet(context.TODO(), name, cr.Spec.RedisConfig[name]).Err()
+			if _, ok := err.(redis.Error); ok {
+				rejected[name] = err.Error()
+				continue
+			}
+			if err != nil {
+				reqLogger.Error(err, "failed to set Redis config", "redisAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+				con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventRedisConfigFailed, "Failed to set the config of Redis %s: %s", address, err)
+				return err
+			}
+		}
+	}
+
+	for _, name := range sortedRedisConfigNames(rejected) {
+		con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventRedisConfigFailed,
+			"Redis rejected CONFIG SET %s: %s. It only takes effect after the storage pods are restarted", name, rejected[name])
+	}
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventRedisConfigUpdated, "Applied redisConfig to %d Redis", len(addresses))
+	cr.Status.RedisConfigHash = hash
+	return nil
+}
+
+// resizeMaxMemory applies the maxMemory in the spec to the running Redis by CONFIG SET.
+// The storage StatefulSet only uses the new maxMemory after that
+// so that the restarted Redis keep it.
+// Returns true if it refuses to shrink maxMemory below the used memory of any Redis.
+// The maxMemory not less than the memory limit has already been rejected by ValidateSpec in Reconcile.
+func (con *storageController) resizeMaxMemory(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, storageStatefulSet *appsv1.StatefulSet) (bool, error) {
+	maxMemory := cr.Spec.MaxMemory
+	if cr.Status.MaxMemory == maxMemory {
+		return false, nil
+	}
+
+	password, err := getAuthPassword(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get password", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	pods, err := getStatefulSetPods(con.r.client, storageStatefulSet)
+	if err != nil {
+		reqLogger.Error(err, "failed to list storage pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	addresses := genStorageRedisAddresses(pods, cr)
+
+	// Check all the Redis before changing any of them.
+	if maxMemory < cr.Status.MaxMemory {
+		for _, address := range addresses {
+			infoStr, err := con.redisPool.getClient(address, password).Info(context.TODO(), "memory").Result()
+			if err != nil {
+				reqLogger.Error(err, "failed to get Redis memory info", "redisAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+				return false, err
+			}
+			usedMemory, err := parseUsedMemory(infoStr)
+			if err != nil {
+				return false, err
+			}
+			if usedMemory >= int64(maxMemory)*1024*1024 {
+				err := pkgerrors.Errorf(
+					"Redis %s uses %d bytes which is not less than the new maxMemory %dMB, change maxMemory back to continue",
+					address, usedMemory, maxMemory,
+				)
+				setDegraded(cr, reasonMaxMemoryTooSmall, err)
+				con.r.recorder.Event(cr, corev1.EventTypeWarning, eventMaxMemoryRefused, err.Error())
+				return true, nil
+			}
+		}
+	}
+
+	for _, address := range addresses {
+		err := con.redisPool.getClient(address, password).ConfigSet(context.TODO(), "maxmemory", fmt.Sprintf("%dMB", maxMemory)).Err()
+		if err != nil {
+			reqLogger.Error(err, "failed to set Redis maxmemory", "redisAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return false, err
+		}
+	}
+
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventMaxMemoryResized,
+		"Resized the maxmemory of %d Redis from %dMB to %dMB", len(addresses), cr.Status.MaxMemory, maxMemory)
+	cr.Status.MaxMemory = maxMemory
+	return false, nil
+}
+
+func genStorageRedisAddresses(pods []corev1.Pod, cr *undermoonv1alpha1.Undermoon) []string {
+	addresses := []string{}
+	for _, pod := range pods {
+		host := genStorageFQDNFromName(pod.ObjectMeta.Name, cr)
+		for _, port := range []int{redisPort1, redisPort2} {
+			addresses = append(addresses, fmt.Sprintf("%s:%d", host, port))
+		}
+	}
+	return addresses
+}
+
 func (con *storageController) getOrCreateStorageService(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, service *corev1.Service) (*corev1.Service, error) {
 	if err := controllerutil.SetControllerReference(cr, service, con.r.scheme); err != nil {
 		return nil, err
 	}
+	hash, err := serviceSpecHash(service)
+	if err != nil {
+		return nil, err
+	}
+	setSpecHashAnnotation(&service.ObjectMeta, hash)
 
 	found := &corev1.Service{}
-	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, found)
+	err = con.r.client.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		reqLogger.Info("Creating a new storage service", "Namespace", service.Namespace, "Name", service.Name)
 		err = con.r.client.Create(context.TODO(), service)
@@ -80,14 +255,23 @@ func (con *storageController) getOrCreateStorageService(reqLogger logr.Logger, c
 		}
 
 		reqLogger.Info("Successfully created a new storage service", "Namespace", service.Namespace, "Name", service.Name)
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCreatedService, "Created storage service %s", service.Name)
 		return service, nil
 	} else if err != nil {
 		reqLogger.Error(err, "failed to get storage service")
 		return nil, err
 	}
 
-	reqLogger.Info("Skip reconcile: storage service already exists", "Namespace", found.Namespace, "Name", found.Name)
-	return found, nil
+	updated, changed, err := updateServiceIfChanged(con.r.client, reqLogger, found, service)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventUpdatedService, "Updated storage service %s", found.Name)
+	} else {
+		reqLogger.Info("Skip reconcile: storage service already exists", "Namespace", found.Namespace, "Name", found.Name)
+	}
+	return updated, nil
 }
 
 func (con *storageController) getOrCreateStorageStatefulSet(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) (*appsv1.StatefulSet, error) {
@@ -97,10 +281,15 @@ func (con *storageController) getOrCreateStorageStatefulSet(reqLogger logr.Logge
 		reqLogger.Error(err, "SetControllerReference failed")
 		return nil, err
 	}
+	hash, err := statefulSetSpecHash(storage)
+	if err != nil {
+		return nil, err
+	}
+	setSpecHashAnnotation(&storage.ObjectMeta, hash)
 
 	// Check if this storage StatefulSet already exists
 	found := &appsv1.StatefulSet{}
-	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: storage.Name, Namespace: storage.Namespace}, found)
+	err = con.r.client.Get(context.TODO(), types.NamespacedName{Name: storage.Name, Namespace: storage.Namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		reqLogger.Info("Creating a new storage StatefulSet", "Namespace", storage.Namespace, "Name", storage.Name)
 		err = con.r.client.Create(context.TODO(), storage)
@@ -114,6 +303,7 @@ func (con *storageController) getOrCreateStorageStatefulSet(reqLogger logr.Logge
 		}
 
 		// StatefulSet created successfully - don't requeue
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCreatedStatefulSet, "Created storage StatefulSet %s", storage.Name)
 		return storage, nil
 	} else if err != nil {
 		reqLogger.Error(err, "failed to get storage StatefulSet", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
@@ -121,22 +311,48 @@ func (con *storageController) getOrCreateStorageStatefulSet(reqLogger logr.Logge
 	}
 
 	// storage already exists - don't requeue
-	reqLogger.Info("Skip reconcile: storage StatefulSet already exists", "Namespace", found.Namespace, "Name", found.Name)
-	return found, nil
+	updated, changed, err := updateStatefulSetIfChanged(con.r.client, reqLogger, found, storage)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventUpdatedStatefulSet, "Updated storage StatefulSet %s", found.Name)
+	} else {
+		reqLogger.Info("Skip reconcile: storage StatefulSet already exists", "Namespace", found.Namespace, "Name", found.Name)
+	}
+	return updated, nil
 }
 
 func (con *storageController) scaleDownStorageStatefulSet(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, storage *appsv1.StatefulSet, info *clusterInfo) (*appsv1.StatefulSet, error) {
 	expectedNodeNumber := int(cr.Spec.ChunkNumber) * chunkNodeNumber
 	if info.NodeNumberWithSlots > expectedNodeNumber {
 		reqLogger.Info("Need to wait for slot migration to scale down storage", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		msg := fmt.Sprintf(
+			"waiting for slot migration to scale down storage: %d nodes with slots, expected %d",
+			info.NodeNumberWithSlots, expectedNodeNumber,
+		)
+		if !conditionIs(cr, undermoonv1alpha1.UndermoonProgressing, corev1.ConditionTrue, reasonWaitingForSlots) {
+			con.r.recorder.Event(cr, corev1.EventTypeNormal, eventWaitingForMigration, msg)
+		}
+		setProgressing(cr, reasonWaitingForSlots, msg)
 		return storage, errRetryReconciliation
 	}
 
 	if info.NodeNumberWithSlots < expectedNodeNumber {
 		reqLogger.Info("Need to scale up", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		setProgressing(cr, reasonWaitingForScalingOut, fmt.Sprintf(
+			"waiting for scaling out: %d nodes with slots, expected %d",
+			info.NodeNumberWithSlots, expectedNodeNumber,
+		))
 		return storage, errRetryReconciliation
 	}
 
+	replicaNum := int32(int(cr.Spec.ChunkNumber) * halfChunkNodeNumber)
+	if *storage.Spec.Replicas > replicaNum {
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventScalingDown,
+			"Scaling down storage StatefulSet from %d to %d replicas", *storage.Spec.Replicas, replicaNum)
+	}
+
 	storage, err := con.updateStorageStatefulSet(reqLogger, cr, storage)
 	if err != nil {
 		return nil, err
@@ -169,6 +385,15 @@ func (con *storageController) getServiceEndpointsNum(storageService *corev1.Serv
 	return len(endpoints), nil
 }
 
+// Only the server proxies which have received the metadata will show up in the public service.
+func (con *storageController) getReadyProxyNumber(cr *undermoonv1alpha1.Undermoon) (int, error) {
+	endpoints, err := getEndpoints(con.r.client, StoragePublicServiceName(cr.ObjectMeta.Name), cr.Namespace)
+	if err != nil {
+		return 0, err
+	}
+	return len(endpoints), nil
+}
+
 func (con *storageController) storageReady(storageService *corev1.Service, cr *undermoonv1alpha1.Undermoon) (bool, error) {
 	n, err := con.getServiceEndpointsNum(storageService)
 	if err != nil {
@@ -239,6 +464,16 @@ func (con *storageController) getMaxEpoch(reqLogger logr.Logger, storageService
 		reqLogger.Error(err, "Failed to get endpoints of server proxies", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
 		return 0, err
 	}
+	password, err := getAuthPassword(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "Failed to get password", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return 0, err
+	}
+	tlsConfig, err := getProxyTLSConfig(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "Failed to get TLS config", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return 0, err
+	}
 
 	// Filter the proxies being deleted
 	sets := make(map[string]bool)
@@ -252,7 +487,7 @@ func (con *storageController) getMaxEpoch(reqLogger logr.Logger, storageService
 		if _, ok := sets[address]; !ok {
 			continue
 		}
-		epoch, err := con.proxyPool.getEpoch(address)
+		epoch, err := con.proxyPool.getEpoch(address, password, tlsConfig)
 		if err != nil {
 			reqLogger.Error(err, "Failed to get epoch from server proxy", "proxyAddress", address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
 		}
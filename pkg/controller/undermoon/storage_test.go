@@ -0,0 +1,282 @@
+package undermoon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestSortedRedisConfigNames(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   map[string]string
+		expected []string
+	}{
+		{name: "empty", config: nil, expected: []string{}},
+		{
+			name: "sorted",
+			config: map[string]string{
+				"timeout":          "300",
+				"maxmemory-policy": "allkeys-lru",
+				"hz":               "20",
+			},
+			expected: []string{"hz", "maxmemory-policy", "timeout"},
+		},
+		{
+			name: "skip managed config",
+			config: map[string]string{
+				"maxmemory-policy": "volatile-lru",
+				"maxmemory":        "1GB",
+				"port":             "6379",
+				"SLAVEOF":          "10.0.0.1 6379",
+				"rename-command":   "CONFIG \"\"",
+			},
+			expected: []string{"maxmemory-policy"},
+		},
+	}
+
+	for _, c := range cases {
+		names := sortedRedisConfigNames(c.config)
+		if !reflect.DeepEqual(names, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, names)
+		}
+	}
+}
+
+func TestGenRedisConfigFile(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   map[string]string
+		expected string
+	}{
+		{name: "empty", config: map[string]string{}, expected: ""},
+		{
+			name: "lines",
+			config: map[string]string{
+				"notify-keyspace-events": "",
+				"maxmemory-policy":       "allkeys-lru",
+				"dir":                    "/tmp",
+			},
+			expected: "maxmemory-policy allkeys-lru\nnotify-keyspace-events \"\"\n",
+		},
+	}
+
+	for _, c := range cases {
+		file := genRedisConfigFile(c.config)
+		if file != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, file)
+		}
+	}
+}
+
+func TestGenRedisResources(t *testing.T) {
+	cases := []struct {
+		name      string
+		resources corev1.ResourceRequirements
+		maxMemory uint32
+		expected  corev1.ResourceList
+	}{
+		{
+			name:      "derived from maxMemory",
+			maxMemory: 100,
+			expected:  corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("150Mi")},
+		},
+		{
+			name: "keep other requests",
+			resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+			},
+			maxMemory: 64,
+			expected: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("96Mi"),
+			},
+		},
+		{
+			name: "specified request",
+			resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			},
+			maxMemory: 100,
+			expected:  corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+		},
+		{
+			// The request defaults to the limit.
+			name: "specified limit",
+			resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			},
+			maxMemory: 100,
+			expected:  nil,
+		},
+	}
+
+	for _, c := range cases {
+		specResources := *c.resources.DeepCopy()
+		resources := genRedisResources(c.resources, c.maxMemory)
+		if len(resources.Requests) != len(c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, resources.Requests)
+			continue
+		}
+		for name, quantity := range c.expected {
+			got := resources.Requests[name]
+			if got.Cmp(quantity) != 0 {
+				t.Errorf("%s: expected %s %s, got %s", c.name, name, quantity.String(), got.String())
+			}
+		}
+		if !reflect.DeepEqual(c.resources, specResources) {
+			t.Errorf("%s: the resources in the spec should not be modified", c.name)
+		}
+	}
+}
+
+// newTestServerProxy only serves AUTH and UMCTL READY with the password.
+func newTestServerProxy(t *testing.T, password string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestServerProxy(conn, password)
+		}
+	}()
+	return listener
+}
+
+func serveTestServerProxy(conn net.Conn, password string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := false
+	for {
+		args, err := readTestCommand(reader)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			authed = len(args) == 2 && args[1] == password
+			if authed {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-ERR invalid password\r\n")
+			}
+		case "UMCTL":
+			if authed {
+				fmt.Fprint(conn, ":1\r\n")
+			} else {
+				fmt.Fprint(conn, "-NOAUTH authentication required\r\n")
+			}
+		}
+	}
+}
+
+func readTestCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+func TestServerProxyCheckCmdAfterRotation(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not found")
+	}
+
+	cases := []struct {
+		name            string
+		proxyPassword   string
+		newPassword     string
+		appliedPassword *string
+		ready           bool
+	}{
+		{name: "created", proxyPassword: "pw1", newPassword: "pw1", ready: true},
+		{name: "applied", proxyPassword: "pw1", newPassword: "pw1", appliedPassword: strPtr("pw1"), ready: true},
+		// The Secret is changed but the server proxy has not been rotated.
+		{name: "before rotation", proxyPassword: "pw1", newPassword: "pw 2", appliedPassword: strPtr("pw1"), ready: true},
+		// The server proxy has been rotated but the applied Secret has not been updated.
+		{name: "during rotation", proxyPassword: "pw 2", newPassword: "pw 2", appliedPassword: strPtr("pw1"), ready: true},
+		{name: "after rotation", proxyPassword: "pw 2", newPassword: "pw 2", appliedPassword: strPtr("pw 2"), ready: true},
+		{name: "trailing newline", proxyPassword: "pw\n", newPassword: "pw\n", ready: true},
+		{name: "wrong password", proxyPassword: "pw3", newPassword: "pw 2", appliedPassword: strPtr("pw1"), ready: false},
+	}
+
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "auth")
+		if err != nil {
+			t.Fatalf("failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		listener := newTestServerProxy(t, c.proxyPassword)
+		defer listener.Close()
+
+		cr := newTestUndermoon()
+		cr.Spec.Port = uint32(listener.Addr().(*net.TCPAddr).Port)
+		cr.Spec.Auth = &undermoonv1alpha1.AuthSpec{
+			SecretRef: undermoonv1alpha1.AuthSecretReference{Name: "password", Key: "mykey"},
+		}
+
+		files := genAuthPasswordFiles(cr)
+		passwords := []*string{&c.newPassword, c.appliedPassword}
+		cmd := genServerProxyCheckCmd(cr)
+		script := cmd[len(cmd)-1]
+		for i, file := range files {
+			localFile := filepath.Join(dir, strconv.Itoa(i))
+			script = strings.Replace(script, file, localFile, 1)
+			if passwords[i] == nil {
+				continue
+			}
+			if err := ioutil.WriteFile(localFile, []byte(*passwords[i]), 0600); err != nil {
+				t.Fatalf("failed to write password: %v", err)
+			}
+		}
+
+		err = exec.Command(cmd[0], append(cmd[1:len(cmd)-1], script)...).Run()
+		if (err == nil) != c.ready {
+			t.Errorf("%s: expected ready %v, got %v", c.name, c.ready, err)
+		}
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,542 @@
+package undermoon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/go-redis/redis/v8"
+	pkgerrors "github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The writes to the masters are paused for this time
+// while the replicas catch up and the broker switches the roles.
+const failoverPauseTime = 15 * time.Second
+
+// The failover is retried in the next reconciliation
+// if the replicas can't catch up with the paused masters within this time.
+const maxReplicaCatchUpTime = 3 * time.Second
+
+const replicaCatchUpCheckInterval = 100 * time.Millisecond
+
+// The cluster is marked as degraded when no replica connects to the masters
+// of the pod being upgraded within this time.
+const maxReplicaWaitTime = 5 * time.Minute
+
+var errNoConnectedReplica = pkgerrors.New("no connected replica")
+
+// Setting this annotation to the target revision of the halted canary upgrade
+// resumes the upgrade after the canary pods are checked manually.
+const resumeUpgradeAnnotation = "undermoon.operator.api/resume-upgrade"
+
+// The storage StatefulSet uses the OnDelete strategy so that the operator
+// can upgrade the pods one by one:
+// (1) fail over the masters inside the pod to their peers after the replicas caught up,
+// (2) delete the pod,
+// (3) wait for the recreated pod to be ready and registered in the broker.
+// Returns true if the upgrade is still in progress.
+func (con *storageController) upgradeStorage(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, storage *appsv1.StatefulSet, masterBrokerAddress string, info *clusterInfo) (bool, error) {
+	targetRevision := storage.Status.UpdateRevision
+	if targetRevision == "" {
+		return false, nil
+	}
+
+	pods, err := getStatefulSetPods(con.r.client, storage)
+	if err != nil {
+		reqLogger.Error(err, "failed to list storage pods", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+
+	outdatedPods := []corev1.Pod{}
+	for _, pod := range pods {
+		if podOutdated(&pod, targetRevision) {
+			outdatedPods = append(outdatedPods, pod)
+		}
+	}
+
+	upgrade := cr.Status.StorageUpgrade
+	if upgrade == nil || upgrade.TargetRevision != targetRevision {
+		if len(outdatedPods) == 0 {
+			// The upgrade halted on the previous revision is dropped after rolling back.
+			if upgrade != nil && upgrade.Phase != undermoonv1alpha1.StorageUpgradeCompleted {
+				cr.Status.StorageUpgrade = &undermoonv1alpha1.StorageUpgradeStatus{
+					TargetRevision: targetRevision,
+					Phase:          undermoonv1alpha1.StorageUpgradeCompleted,
+					UpdatedPods:    int32(len(pods)),
+					TotalPods:      int32(len(pods)),
+				}
+			}
+			return false, nil
+		}
+		upgrade = &undermoonv1alpha1.StorageUpgradeStatus{TargetRevision: targetRevision}
+		cr.Status.StorageUpgrade = upgrade
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventStorageUpgradeStarted,
+			"Start upgrading %d storage pods to revision %s", len(outdatedPods), targetRevision)
+	}
+	upgrade.TotalPods = int32(len(pods))
+	upgrade.UpdatedPods = int32(len(pods) - len(outdatedPods))
+
+	if upgrade.Phase == undermoonv1alpha1.StorageUpgradeHalted {
+		if cr.ObjectMeta.Annotations[resumeUpgradeAnnotation] != targetRevision {
+			setDegraded(cr, reasonCanaryFailed, pkgerrors.Errorf("the canary upgrade is halted: %s", upgrade.HaltReason))
+			return true, nil
+		}
+		upgrade.Phase = ""
+		upgrade.HaltReason = ""
+		upgrade.CanaryPassed = true
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCanaryResumed, "Resumed the halted upgrade to revision %s", targetRevision)
+	}
+
+	canary := cr.Spec.UpgradeStrategy != nil && cr.Spec.UpgradeStrategy.Type == undermoonv1alpha1.CanaryUpgradeStrategyType
+	canaryPod := ""
+	if upgrade.CurrentPod == "" && canary && !upgrade.CanaryPassed && len(upgrade.CanaryPods) > 0 {
+		meta, err := con.brokerClient.getClusterMeta(masterBrokerAddress, cr.Spec.ClusterName)
+		if err != nil {
+			reqLogger.Error(err, "failed to get cluster meta", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return true, err
+		}
+		pod, ok := pickCanaryPod(cr, upgrade.CanaryPods[0], outdatedPods, meta)
+		if !ok {
+			passed := con.soakCanary(reqLogger, cr, upgrade)
+			if !passed {
+				return true, nil
+			}
+		}
+		canaryPod = pod
+	}
+
+	if upgrade.CurrentPod == "" {
+		if len(outdatedPods) == 0 {
+			if upgrade.Phase != undermoonv1alpha1.StorageUpgradeCompleted {
+				upgrade.Phase = undermoonv1alpha1.StorageUpgradeCompleted
+				con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventStorageUpgradeCompleted,
+					"All the storage pods have been upgraded to revision %s", targetRevision)
+			}
+			return false, nil
+		}
+		// Wait for the slot migration before failing over any node.
+		if info.IsMigrating {
+			setProgressing(cr, reasonSlotsMigrating, "waiting for the slot migration to finish before upgrading storage pods")
+			return true, nil
+		}
+		nextPod := outdatedPods[0].ObjectMeta.Name
+		// The pods of the first chunk being upgraded are the canary.
+		if canary && !upgrade.CanaryPassed {
+			if len(upgrade.CanaryPods) > 0 {
+				nextPod = canaryPod
+			}
+			upgrade.CanaryPods = append(upgrade.CanaryPods, nextPod)
+		}
+		upgrade.CurrentPod = nextPod
+		upgrade.Phase = undermoonv1alpha1.StorageUpgradeFailingOver
+	}
+
+	setProgressing(cr, reasonUpgradingStorage, fmt.Sprintf(
+		"upgrading storage pod %s (%s), %d/%d pods upgraded",
+		upgrade.CurrentPod, upgrade.Phase, upgrade.UpdatedPods, upgrade.TotalPods,
+	))
+
+	switch upgrade.Phase {
+	case undermoonv1alpha1.StorageUpgradeFailingOver:
+		done, err := con.failoverPodMasters(reqLogger, cr, upgrade.CurrentPod, masterBrokerAddress)
+		if err == errNoConnectedReplica {
+			con.waitForReplica(cr, upgrade)
+			return true, nil
+		}
+		upgrade.ReplicaWaitStartTime = nil
+		if err != nil {
+			return true, err
+		}
+		if done {
+			upgrade.Phase = undermoonv1alpha1.StorageUpgradeDeletingPod
+		}
+	case undermoonv1alpha1.StorageUpgradeDeletingPod:
+		err := con.deleteOutdatedPod(reqLogger, cr, upgrade.CurrentPod, targetRevision)
+		if err != nil {
+			return true, err
+		}
+		upgrade.Phase = undermoonv1alpha1.StorageUpgradeWaitingForPod
+	case undermoonv1alpha1.StorageUpgradeWaitingForPod:
+		ready, err := con.upgradedPodReady(reqLogger, cr, upgrade.CurrentPod, targetRevision, masterBrokerAddress)
+		if err != nil {
+			return true, err
+		}
+		if ready {
+			con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventStoragePodUpgraded, "Storage pod %s has been upgraded", upgrade.CurrentPod)
+			upgrade.CurrentPod = ""
+			upgrade.Phase = ""
+			upgrade.UpdatedPods++
+		}
+	default:
+		upgrade.Phase = undermoonv1alpha1.StorageUpgradeFailingOver
+	}
+
+	return true, nil
+}
+
+// pickCanaryPod returns the outdated pod in the same chunk as the first canary pod
+// so that the canary pods are the peers of a single chunk.
+// The chunk is found by the peers of the first canary pod in the cluster metadata
+// instead of the pod ordinals, which don't always match the chunks allocated by the broker.
+// Returns false if all the pods of the canary chunk have been upgraded.
+func pickCanaryPod(cr *undermoonv1alpha1.Undermoon, firstCanaryPod string, outdatedPods []corev1.Pod, meta *clusterMeta) (string, bool) {
+	canaryAddress := genStorageAddressFromName(firstCanaryPod, cr)
+	peerAddresses := make(map[string]bool)
+	for _, node := range meta.Nodes {
+		if node.ProxyAddress != canaryAddress {
+			continue
+		}
+		for _, peer := range node.Repl.Peers {
+			peerAddresses[peer.ProxyAddress] = true
+		}
+	}
+	for _, pod := range outdatedPods {
+		if peerAddresses[genStorageAddressFromName(pod.ObjectMeta.Name, cr)] {
+			return pod.ObjectMeta.Name, true
+		}
+	}
+	return "", false
+}
+
+// waitForReplica keeps the masters in the pod until any replica connects,
+// which may happen when the peer pod is also restarting.
+// Deleting the pod now would lose the data so the operator only waits
+// and marks the cluster as degraded after maxReplicaWaitTime.
+func (con *storageController) waitForReplica(cr *undermoonv1alpha1.Undermoon, upgrade *undermoonv1alpha1.StorageUpgradeStatus) {
+	if upgrade.ReplicaWaitStartTime == nil {
+		now := metav1.Now()
+		upgrade.ReplicaWaitStartTime = &now
+	}
+	elapsed := time.Since(upgrade.ReplicaWaitStartTime.Time)
+	if elapsed < maxReplicaWaitTime {
+		setProgressing(cr, reasonWaitingForReplica, fmt.Sprintf(
+			"waiting for the replicas of the masters in storage pod %s to connect", upgrade.CurrentPod,
+		))
+		return
+	}
+
+	err := pkgerrors.Errorf(
+		"no replica has connected to the masters in storage pod %s for %s, check its peer pod",
+		upgrade.CurrentPod, elapsed.Round(time.Second),
+	)
+	if !conditionIs(cr, undermoonv1alpha1.UndermoonDegraded, corev1.ConditionTrue, reasonNoReplica) {
+		con.r.recorder.Event(cr, corev1.EventTypeWarning, eventNoReplica, err.Error())
+	}
+	setDegraded(cr, reasonNoReplica, err)
+}
+
+// soakCanary checks the health of the cluster after the canary chunk is upgraded
+// and halts the upgrade if the check fails.
+// Returns true when the canary chunk survives the whole soak time.
+func (con *storageController) soakCanary(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, upgrade *undermoonv1alpha1.StorageUpgradeStatus) bool {
+	if upgrade.Phase != undermoonv1alpha1.StorageUpgradeSoaking || upgrade.CanaryStartTime == nil {
+		now := metav1.Now()
+		upgrade.Phase = undermoonv1alpha1.StorageUpgradeSoaking
+		upgrade.CanaryStartTime = &now
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCanarySoaking,
+			"Canary pods %s have been upgraded, checking the cluster", strings.Join(upgrade.CanaryPods, ","))
+	}
+
+	err := con.checkCanaryHealth(cr, upgrade.CanaryPods)
+	if err != nil {
+		reqLogger.Error(err, "canary health check failed", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		upgrade.Phase = undermoonv1alpha1.StorageUpgradeHalted
+		upgrade.HaltReason = err.Error()
+		con.r.recorder.Eventf(cr, corev1.EventTypeWarning, eventCanaryHalted, "Halted the upgrade: %s", err)
+		setDegraded(cr, reasonCanaryFailed, pkgerrors.Errorf("the canary upgrade is halted: %s", err))
+		return false
+	}
+
+	soakTime := time.Duration(cr.Spec.UpgradeStrategy.Canary.SoakSeconds) * time.Second
+	elapsed := time.Since(upgrade.CanaryStartTime.Time)
+	if elapsed < soakTime {
+		setProgressing(cr, reasonCanarySoaking, fmt.Sprintf(
+			"checking the canary pods %s, %s left",
+			strings.Join(upgrade.CanaryPods, ","), (soakTime-elapsed).Round(time.Second),
+		))
+		return false
+	}
+
+	upgrade.CanaryPassed = true
+	upgrade.Phase = ""
+	con.r.recorder.Event(cr, corev1.EventTypeNormal, eventCanaryPassed, "Canary pods passed the health check, continue upgrading")
+	return true
+}
+
+// checkCanaryHealth checks the data plane through the public service
+// and the readiness of the upgraded server proxies.
+func (con *storageController) checkCanaryHealth(cr *undermoonv1alpha1.Undermoon, canaryPods []string) error {
+	password, err := getAuthPassword(con.r.client, cr)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := getProxyTLSConfig(con.r.client, cr)
+	if err != nil {
+		return err
+	}
+	for _, podName := range canaryPods {
+		proxyAddress := genStorageAddressFromName(podName, cr)
+		ready, err := con.proxyPool.isReady(proxyAddress, password, tlsConfig)
+		if err != nil {
+			return pkgerrors.Wrapf(err, "failed to send UMCTL READY to %s", proxyAddress)
+		}
+		if !ready {
+			return pkgerrors.Errorf("server proxy %s is not ready", proxyAddress)
+		}
+	}
+
+	clusterClient := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:     []string{genStoragePublicServiceAddress(cr)},
+		Password:  password,
+		TLSConfig: tlsConfig,
+	})
+	defer clusterClient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := clusterClient.Ping(ctx).Err(); err != nil {
+		return pkgerrors.Wrap(err, "PING failed")
+	}
+	key := fmt.Sprintf("undermoon-operator:canary:%s", cr.ObjectMeta.Name)
+	value := fmt.Sprintf("%d", time.Now().UnixNano())
+	if err := clusterClient.Set(ctx, key, value, time.Minute).Err(); err != nil {
+		return pkgerrors.Wrap(err, "SET failed")
+	}
+	got, err := clusterClient.Get(ctx, key).Result()
+	if err != nil {
+		return pkgerrors.Wrap(err, "GET failed")
+	}
+	if got != value {
+		return pkgerrors.Errorf("GET returned %s but expected %s", got, value)
+	}
+	return nil
+}
+
+// Returns true when the pod does not own any master.
+func (con *storageController) failoverPodMasters(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, podName, masterBrokerAddress string) (bool, error) {
+	proxyAddress := genStorageAddressFromName(podName, cr)
+	meta, err := con.brokerClient.getClusterMeta(masterBrokerAddress, cr.Spec.ClusterName)
+	if err != nil {
+		reqLogger.Error(err, "failed to get cluster meta", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+
+	masters := []clusterNode{}
+	for _, node := range meta.Nodes {
+		if node.ProxyAddress == proxyAddress && node.Repl.Role == nodeRoleMaster {
+			masters = append(masters, node)
+		}
+	}
+	if len(masters) == 0 {
+		return true, nil
+	}
+
+	password, err := getAuthPassword(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get password", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	// Don't pause the writes when the failover can't be done.
+	for _, master := range masters {
+		replInfo, err := con.getReplicationInfo(master.Address, password)
+		if err != nil {
+			reqLogger.Error(err, "failed to get replication info", "redisAddress", master.Address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return false, err
+		}
+		if len(replInfo.replicaOffsets) == 0 || len(master.Repl.Peers) == 0 {
+			return false, errNoConnectedReplica
+		}
+	}
+
+	// Pause the writes so that the replicas can fully catch up
+	// and nothing written to the masters is lost after they are promoted.
+	for _, master := range masters {
+		pausedOffset, err := con.pauseWrites(master.Address, password)
+		if err != nil {
+			reqLogger.Error(err, "failed to pause writes", "redisAddress", master.Address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return false, err
+		}
+		replicaAddresses := []string{}
+		for _, peer := range master.Repl.Peers {
+			replicaAddresses = append(replicaAddresses, peer.NodeAddress)
+		}
+		caughtUp, err := con.waitForReplicasCaughtUp(replicaAddresses, password, pausedOffset)
+		if err != nil {
+			reqLogger.Error(err, "failed to check replication offset", "redisAddress", master.Address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return false, err
+		}
+		if !caughtUp {
+			reqLogger.Info("waiting for replicas to catch up", "redisAddress", master.Address, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return false, nil
+		}
+	}
+
+	err = con.brokerClient.failoverServerProxy(masterBrokerAddress, proxyAddress)
+	if err != nil {
+		if err == errMigrationRunning {
+			return false, nil
+		}
+		reqLogger.Error(err, "failed to fail over server proxy", "proxyAddress", proxyAddress, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventStorageFailover, "Failing over the masters of server proxy %s before upgrading", proxyAddress)
+
+	// Check the meta again in the next reconciliation.
+	return false, nil
+}
+
+func (con *storageController) getReplicationInfo(redisAddress, password string) (*replicationInfo, error) {
+	infoStr, err := con.redisPool.getClient(redisAddress, password).Info(context.TODO(), "replication").Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseReplicationInfo(infoStr)
+}
+
+// pauseWrites pauses the clients of the master for failoverPauseTime
+// and returns the replication offset when the pause starts.
+// The offset is read in the same transaction since the paused Redis does not reply to INFO.
+func (con *storageController) pauseWrites(redisAddress, password string) (int64, error) {
+	ctx := context.TODO()
+	pipe := con.redisPool.getClient(redisAddress, password).TxPipeline()
+	pipe.ClientPause(ctx, failoverPauseTime)
+	info := pipe.Info(ctx, "replication")
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	replInfo, err := parseReplicationInfo(info.Val())
+	if err != nil {
+		return 0, err
+	}
+	return replInfo.masterReplOffset, nil
+}
+
+// waitForReplicasCaughtUp requires the replicas to catch up with the paused master
+// on two consecutive checks.
+func (con *storageController) waitForReplicasCaughtUp(replicaAddresses []string, password string, pausedOffset int64) (bool, error) {
+	deadline := time.Now().Add(maxReplicaCatchUpTime)
+	caughtUpChecks := 0
+	for {
+		offsets := []int64{}
+		for _, address := range replicaAddresses {
+			replInfo, err := con.getReplicationInfo(address, password)
+			if err != nil {
+				return false, err
+			}
+			if replInfo.role != "slave" {
+				return false, pkgerrors.Errorf("%s is not a replica", address)
+			}
+			offsets = append(offsets, replInfo.masterReplOffset)
+		}
+
+		if replicasCaughtUp(offsets, pausedOffset) {
+			caughtUpChecks++
+			if caughtUpChecks == 2 {
+				return true, nil
+			}
+		} else {
+			caughtUpChecks = 0
+		}
+
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(replicaCatchUpCheckInterval)
+	}
+}
+
+// replicasCaughtUp checks whether the replicas have received all the data before the master is paused.
+// The offsets of the replicas could be greater than the paused offset
+// since the master still sends PING to the replicas.
+func replicasCaughtUp(replicaOffsets []int64, pausedOffset int64) bool {
+	if len(replicaOffsets) == 0 {
+		return false
+	}
+	for _, offset := range replicaOffsets {
+		if offset < pausedOffset {
+			return false
+		}
+	}
+	return true
+}
+
+func (con *storageController) deleteOutdatedPod(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, podName, targetRevision string) error {
+	pod := &corev1.Pod{}
+	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: podName, Namespace: cr.Namespace}, pod)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		reqLogger.Error(err, "failed to get storage pod", "pod", podName, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	if !podOutdated(pod, targetRevision) || pod.ObjectMeta.DeletionTimestamp != nil {
+		return nil
+	}
+
+	err = deletePodForUpgrade(con.r.client, pod)
+	if err != nil {
+		reqLogger.Error(err, "failed to delete storage pod", "pod", podName, "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventStoragePodDeleted, "Deleted storage pod %s for upgrading", podName)
+	return nil
+}
+
+func (con *storageController) upgradedPodReady(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon, podName, targetRevision, masterBrokerAddress string) (bool, error) {
+	pod := &corev1.Pod{}
+	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: podName, Namespace: cr.Namespace}, pod)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if podOutdated(pod, targetRevision) || !podIsReady(pod) {
+		return false, nil
+	}
+
+	password, err := getAuthPassword(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get password", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	tlsConfig, err := getProxyTLSConfig(con.r.client, cr)
+	if err != nil {
+		reqLogger.Error(err, "failed to get TLS config", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	proxyAddress := genStorageAddressFromName(podName, cr)
+	ready, err := con.proxyPool.isReady(proxyAddress, password, tlsConfig)
+	if err != nil {
+		reqLogger.Info("failed to check server proxy readiness", "proxyAddress", proxyAddress, "error", err)
+		return false, nil
+	}
+	if !ready {
+		return false, nil
+	}
+
+	proxyAddresses, err := con.brokerClient.getServerProxies(masterBrokerAddress)
+	if err != nil {
+		reqLogger.Error(err, "failed to get server proxy addresses", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return false, err
+	}
+	for _, address := range proxyAddresses {
+		if address == proxyAddress {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,467 @@
+package undermoon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const testUpgradeRevision = "rev-2"
+
+func newTestUndermoon() *undermoonv1alpha1.Undermoon {
+	return &undermoonv1alpha1.Undermoon{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+		},
+		Spec: undermoonv1alpha1.UndermoonSpec{
+			ClusterName: "test-cluster",
+			ChunkNumber: 2,
+			Port:        DefaultServerProxyPort,
+		},
+	}
+}
+
+func newTestStorageStatefulSet(cr *undermoonv1alpha1.Undermoon) *appsv1.StatefulSet {
+	replicas := int32(int(cr.Spec.ChunkNumber) * halfChunkNodeNumber)
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      StorageStatefulSetName(cr.ObjectMeta.Name),
+			Namespace: cr.Namespace,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"undermoonName": cr.ObjectMeta.Name},
+			},
+		},
+		Status: appsv1.StatefulSetStatus{
+			UpdateRevision: testUpgradeRevision,
+		},
+	}
+}
+
+func newTestStoragePod(cr *undermoonv1alpha1.Undermoon, index int, revision string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      storageStatefulSetPodName(cr.ObjectMeta.Name, index),
+			Namespace: cr.Namespace,
+			Labels: map[string]string{
+				"undermoonName":                 cr.ObjectMeta.Name,
+				appsv1.StatefulSetRevisionLabel: revision,
+			},
+		},
+	}
+}
+
+func newTestStorageController(objs ...runtime.Object) *storageController {
+	r := &ReconcileUndermoon{
+		client:   fake.NewFakeClientWithScheme(scheme.Scheme, objs...),
+		scheme:   scheme.Scheme,
+		recorder: record.NewFakeRecorder(100),
+	}
+	return newStorageController(r)
+}
+
+// The broker returns the cluster meta without any master in the storage pods.
+func newTestBroker(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/api/v2/clusters/meta/") {
+			t.Errorf("unexpected broker request %s %s", req.Method, req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"cluster":{"name":"test-cluster","epoch":1,"nodes":[]}}`))
+	}))
+}
+
+func TestUpgradeStorageNoOutdatedPods(t *testing.T) {
+	cr := newTestUndermoon()
+	storage := newTestStorageStatefulSet(cr)
+	objs := []runtime.Object{}
+	for i := 0; i < 4; i++ {
+		objs = append(objs, newTestStoragePod(cr, i, testUpgradeRevision))
+	}
+	con := newTestStorageController(objs...)
+
+	upgrading, err := con.upgradeStorage(logf.Log, cr, storage, "", &clusterInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if upgrading {
+		t.Errorf("expected no upgrade")
+	}
+	if cr.Status.StorageUpgrade != nil {
+		t.Errorf("expected no upgrade status, got %+v", cr.Status.StorageUpgrade)
+	}
+}
+
+func TestUpgradeStoragePhases(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.Close()
+	brokerAddress := strings.TrimPrefix(broker.URL, "http://")
+
+	cr := newTestUndermoon()
+	storage := newTestStorageStatefulSet(cr)
+	objs := []runtime.Object{}
+	for i := 0; i < 4; i++ {
+		objs = append(objs, newTestStoragePod(cr, i, "rev-1"))
+	}
+	con := newTestStorageController(objs...)
+	lastPod := storageStatefulSetPodName(cr.ObjectMeta.Name, 3)
+
+	steps := []struct {
+		name       string
+		info       *clusterInfo
+		currentPod string
+		phase      undermoonv1alpha1.StorageUpgradePhase
+		totalPods  int32
+	}{
+		// Wait for the slot migration before picking any pod.
+		{"migrating", &clusterInfo{IsMigrating: true}, "", "", 4},
+		// The pod with the largest ordinal is upgraded first and it does not own any master.
+		{"failing over", &clusterInfo{}, lastPod, undermoonv1alpha1.StorageUpgradeDeletingPod, 4},
+		{"deleting pod", &clusterInfo{}, lastPod, undermoonv1alpha1.StorageUpgradeWaitingForPod, 4},
+		// The recreated pod does not exist yet.
+		{"waiting for pod", &clusterInfo{}, lastPod, undermoonv1alpha1.StorageUpgradeWaitingForPod, 3},
+	}
+
+	for _, step := range steps {
+		upgrading, err := con.upgradeStorage(logf.Log, cr, storage, brokerAddress, step.info)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if !upgrading {
+			t.Fatalf("%s: expected the upgrade in progress", step.name)
+		}
+		upgrade := cr.Status.StorageUpgrade
+		if upgrade == nil || upgrade.TargetRevision != testUpgradeRevision {
+			t.Fatalf("%s: unexpected upgrade status %+v", step.name, upgrade)
+		}
+		if upgrade.CurrentPod != step.currentPod || upgrade.Phase != step.phase {
+			t.Errorf("%s: expected pod %q in phase %q, got pod %q in phase %q",
+				step.name, step.currentPod, step.phase, upgrade.CurrentPod, upgrade.Phase)
+		}
+		if upgrade.TotalPods != step.totalPods || upgrade.UpdatedPods != 0 {
+			t.Errorf("%s: unexpected pod numbers %d/%d", step.name, upgrade.UpdatedPods, upgrade.TotalPods)
+		}
+	}
+
+	pod := &corev1.Pod{}
+	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: lastPod, Namespace: cr.Namespace}, pod)
+	if !errors.IsNotFound(err) {
+		t.Errorf("expected pod %s to be deleted, got %v", lastPod, err)
+	}
+}
+
+func TestWaitForReplica(t *testing.T) {
+	cr := newTestUndermoon()
+	con := newTestStorageController()
+	upgrade := &undermoonv1alpha1.StorageUpgradeStatus{
+		TargetRevision: testUpgradeRevision,
+		CurrentPod:     storageStatefulSetPodName(cr.ObjectMeta.Name, 0),
+		Phase:          undermoonv1alpha1.StorageUpgradeFailingOver,
+	}
+
+	con.waitForReplica(cr, upgrade)
+	if upgrade.ReplicaWaitStartTime == nil {
+		t.Fatalf("expected the wait start time to be recorded")
+	}
+	if !conditionIs(cr, undermoonv1alpha1.UndermoonProgressing, corev1.ConditionTrue, reasonWaitingForReplica) {
+		t.Errorf("expected Progressing with %s, got %+v", reasonWaitingForReplica, cr.Status.Conditions)
+	}
+	if conditionIs(cr, undermoonv1alpha1.UndermoonDegraded, corev1.ConditionTrue, reasonNoReplica) {
+		t.Errorf("expected not degraded before the timeout")
+	}
+
+	expired := metav1.NewTime(time.Now().Add(-maxReplicaWaitTime - time.Second))
+	upgrade.ReplicaWaitStartTime = &expired
+	con.waitForReplica(cr, upgrade)
+	if !conditionIs(cr, undermoonv1alpha1.UndermoonDegraded, corev1.ConditionTrue, reasonNoReplica) {
+		t.Errorf("expected Degraded with %s, got %+v", reasonNoReplica, cr.Status.Conditions)
+	}
+	if !upgrade.ReplicaWaitStartTime.Equal(&expired) {
+		t.Errorf("expected the wait start time to be kept")
+	}
+}
+
+func TestPickCanaryPod(t *testing.T) {
+	cr := newTestUndermoon()
+	podsOf := func(indices ...int) []corev1.Pod {
+		pods := []corev1.Pod{}
+		for _, i := range indices {
+			pods = append(pods, *newTestStoragePod(cr, i, "rev-1"))
+		}
+		return pods
+	}
+	podName := func(index int) string {
+		return storageStatefulSetPodName(cr.ObjectMeta.Name, index)
+	}
+	// The chunks allocated by the broker don't follow the pod ordinals:
+	// pod 0 is the peer of pod 3 and pod 1 is the peer of pod 2.
+	peers := map[int]int{0: 3, 3: 0, 1: 2, 2: 1}
+	meta := &clusterMeta{Name: "test-cluster", Epoch: 1}
+	for i := 0; i < 4; i++ {
+		proxyAddress := genStorageAddressFromName(podName(i), cr)
+		peerAddress := genStorageAddressFromName(podName(peers[i]), cr)
+		for j := 0; j < halfChunkNodeNumber; j++ {
+			meta.Nodes = append(meta.Nodes, clusterNode{
+				Address:      fmt.Sprintf("%s-%d:6379", podName(i), j),
+				ProxyAddress: proxyAddress,
+				ClusterName:  "test-cluster",
+				Repl: replMeta{
+					Role:  nodeRoleMaster,
+					Peers: []replPeer{{NodeAddress: fmt.Sprintf("%s-%d:6379", podName(peers[i]), j), ProxyAddress: peerAddress}},
+				},
+			})
+		}
+	}
+
+	cases := []struct {
+		name         string
+		firstCanary  string
+		outdatedPods []corev1.Pod
+		expected     string
+		found        bool
+	}{
+		{"peer of pod 3", podName(3), podsOf(2, 1, 0), podName(0), true},
+		{"peer of pod 1", podName(1), podsOf(3, 2, 0), podName(2), true},
+		// The pod with the adjacent ordinal belongs to another chunk.
+		{"skip other chunks", podName(0), podsOf(2, 1), "", false},
+		{"chunk upgraded", podName(2), podsOf(3, 0), "", false},
+		{"not in the cluster", "invalid", podsOf(1, 0), "", false},
+	}
+
+	for _, c := range cases {
+		pod, found := pickCanaryPod(cr, c.firstCanary, c.outdatedPods, meta)
+		if pod != c.expected || found != c.found {
+			t.Errorf("%s: expected (%q, %v), got (%q, %v)", c.name, c.expected, c.found, pod, found)
+		}
+	}
+}
+
+func newTestHaltedUpgrade(cr *undermoonv1alpha1.Undermoon) *undermoonv1alpha1.StorageUpgradeStatus {
+	return &undermoonv1alpha1.StorageUpgradeStatus{
+		TargetRevision: testUpgradeRevision,
+		Phase:          undermoonv1alpha1.StorageUpgradeHalted,
+		CanaryPods: []string{
+			storageStatefulSetPodName(cr.ObjectMeta.Name, 3),
+			storageStatefulSetPodName(cr.ObjectMeta.Name, 2),
+		},
+		HaltReason: "PING failed",
+	}
+}
+
+func newTestCanaryStorage(cr *undermoonv1alpha1.Undermoon, updatedPods int) *storageController {
+	objs := []runtime.Object{}
+	for i := 0; i < 4; i++ {
+		revision := "rev-1"
+		if i >= 4-updatedPods {
+			revision = testUpgradeRevision
+		}
+		objs = append(objs, newTestStoragePod(cr, i, revision))
+	}
+	return newTestStorageController(objs...)
+}
+
+func TestUpgradeStorageHalted(t *testing.T) {
+	cr := newTestUndermoon()
+	cr.Spec.UpgradeStrategy = &undermoonv1alpha1.UpgradeStrategy{Type: undermoonv1alpha1.CanaryUpgradeStrategyType}
+	cr.Status.StorageUpgrade = newTestHaltedUpgrade(cr)
+	storage := newTestStorageStatefulSet(cr)
+	con := newTestCanaryStorage(cr, 2)
+
+	for i := 0; i < 2; i++ {
+		upgrading, err := con.upgradeStorage(logf.Log, cr, storage, "", &clusterInfo{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !upgrading {
+			t.Fatalf("expected the halted upgrade to block the reconciliation")
+		}
+		if cr.Status.StorageUpgrade.Phase != undermoonv1alpha1.StorageUpgradeHalted {
+			t.Fatalf("expected the upgrade to stay halted, got %+v", cr.Status.StorageUpgrade)
+		}
+		if !conditionIs(cr, undermoonv1alpha1.UndermoonDegraded, corev1.ConditionTrue, reasonCanaryFailed) {
+			t.Errorf("expected Degraded with %s, got %+v", reasonCanaryFailed, cr.Status.Conditions)
+		}
+	}
+
+	// The annotation for another revision does not resume the upgrade.
+	cr.ObjectMeta.Annotations = map[string]string{resumeUpgradeAnnotation: "rev-1"}
+	_, err := con.upgradeStorage(logf.Log, cr, storage, "", &clusterInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cr.Status.StorageUpgrade.Phase != undermoonv1alpha1.StorageUpgradeHalted {
+		t.Fatalf("expected the upgrade to stay halted, got %+v", cr.Status.StorageUpgrade)
+	}
+}
+
+func TestUpgradeStorageResume(t *testing.T) {
+	cr := newTestUndermoon()
+	cr.Spec.UpgradeStrategy = &undermoonv1alpha1.UpgradeStrategy{Type: undermoonv1alpha1.CanaryUpgradeStrategyType}
+	cr.Status.StorageUpgrade = newTestHaltedUpgrade(cr)
+	cr.ObjectMeta.Annotations = map[string]string{resumeUpgradeAnnotation: testUpgradeRevision}
+	storage := newTestStorageStatefulSet(cr)
+	con := newTestCanaryStorage(cr, 2)
+
+	// Stop before failing over the next pod.
+	upgrading, err := con.upgradeStorage(logf.Log, cr, storage, "", &clusterInfo{IsMigrating: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !upgrading {
+		t.Fatalf("expected the upgrade in progress")
+	}
+	upgrade := cr.Status.StorageUpgrade
+	if upgrade.Phase != "" || upgrade.HaltReason != "" || !upgrade.CanaryPassed {
+		t.Errorf("expected the upgrade to be resumed, got %+v", upgrade)
+	}
+	if upgrade.UpdatedPods != 2 {
+		t.Errorf("expected 2 updated pods, got %d", upgrade.UpdatedPods)
+	}
+}
+
+func TestUpgradeStorageRollBackHalted(t *testing.T) {
+	cr := newTestUndermoon()
+	cr.Spec.UpgradeStrategy = &undermoonv1alpha1.UpgradeStrategy{Type: undermoonv1alpha1.CanaryUpgradeStrategyType}
+	cr.Status.StorageUpgrade = newTestHaltedUpgrade(cr)
+	storage := newTestStorageStatefulSet(cr)
+	// The canary pods have been rolled back to the previous revision by the StatefulSet.
+	storage.Status.UpdateRevision = "rev-1"
+	con := newTestCanaryStorage(cr, 0)
+
+	upgrading, err := con.upgradeStorage(logf.Log, cr, storage, "", &clusterInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if upgrading {
+		t.Errorf("expected the halted upgrade to be dropped")
+	}
+	upgrade := cr.Status.StorageUpgrade
+	if upgrade.TargetRevision != "rev-1" || upgrade.Phase != undermoonv1alpha1.StorageUpgradeCompleted {
+		t.Errorf("expected the completed upgrade to rev-1, got %+v", upgrade)
+	}
+}
+
+func TestReplicasCaughtUp(t *testing.T) {
+	cases := []struct {
+		name     string
+		offsets  []int64
+		expected bool
+	}{
+		{name: "no replica", offsets: nil, expected: false},
+		{name: "caught up", offsets: []int64{100, 100}, expected: true},
+		{name: "lagging by one byte", offsets: []int64{100, 99}, expected: false},
+		// The master sends PING to the replicas after the pause.
+		{name: "ping after pause", offsets: []int64{114}, expected: true},
+	}
+
+	for _, c := range cases {
+		caughtUp := replicasCaughtUp(c.offsets, 100)
+		if caughtUp != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, caughtUp)
+		}
+	}
+}
+
+// newTestReplica replies to INFO replication with the offsets in order
+// and keeps replying the last one.
+func newTestReplica(t *testing.T, role string, offsets ...int64) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	replies := make(chan int64, len(offsets))
+	for _, offset := range offsets {
+		replies <- offset
+	}
+	last := offsets[len(offsets)-1]
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					if _, err := readTestCommand(reader); err != nil {
+						return
+					}
+					offset := last
+					select {
+					case offset = <-replies:
+					default:
+					}
+					info := fmt.Sprintf("# Replication\r\nrole:%s\r\nmaster_repl_offset:%d\r\n", role, offset)
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(info), info)
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestWaitForReplicasCaughtUp(t *testing.T) {
+	cases := []struct {
+		name     string
+		role     string
+		offsets  []int64
+		expected bool
+		err      bool
+	}{
+		{name: "caught up", role: "slave", offsets: []int64{100}, expected: true},
+		{name: "catching up", role: "slave", offsets: []int64{90, 95, 100}, expected: true},
+		// A single check is not enough.
+		{name: "caught up once", role: "slave", offsets: []int64{100, 99}, expected: false},
+		{name: "lagging", role: "slave", offsets: []int64{99}, expected: false},
+		{name: "not replica", role: "master", offsets: []int64{100}, err: true},
+	}
+
+	con := newTestStorageController()
+	for _, c := range cases {
+		replica := newTestReplica(t, c.role, c.offsets...)
+		defer replica.Close()
+
+		start := time.Now()
+		caughtUp, err := con.waitForReplicasCaughtUp([]string{replica.Addr().String()}, "", 100)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if caughtUp != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, caughtUp)
+		}
+		if !caughtUp && time.Since(start) < maxReplicaCatchUpTime {
+			t.Errorf("%s: expected to wait for %v", c.name, maxReplicaCatchUpTime)
+		}
+	}
+}
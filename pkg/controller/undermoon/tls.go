@@ -0,0 +1,328 @@
+package undermoon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
+	pkgerrors "github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const tlsVolumeName = "tls"
+const tlsPath = "/etc/undermoon/tls"
+const tlsCAVolumeName = "tls-ca"
+const tlsCAPath = "/etc/undermoon/tls-ca"
+const tlsCAKey = "ca.crt"
+const tlsCertValidity = 10 * 365 * 24 * time.Hour
+
+// TLSSecretName defines the Secret generated by the operator
+// when tls.secretName is not specified.
+func TLSSecretName(undermoonName string) string {
+	return fmt.Sprintf("%s-tls", undermoonName)
+}
+
+// TLSCAConfigMapName defines the ConfigMap exposing the CA certificate to the clients.
+func TLSCAConfigMapName(undermoonName string) string {
+	return fmt.Sprintf("%s-tls-ca", undermoonName)
+}
+
+func tlsSecretName(cr *undermoonv1alpha1.Undermoon) string {
+	if cr.Spec.TLS.SecretName != "" {
+		return cr.Spec.TLS.SecretName
+	}
+	return TLSSecretName(cr.ObjectMeta.Name)
+}
+
+func tlsLabels(cr *undermoonv1alpha1.Undermoon) map[string]string {
+	return map[string]string{
+		"undermoonName":        cr.ObjectMeta.Name,
+		"undermoonClusterName": cr.Spec.ClusterName,
+	}
+}
+
+func genTLSVolumes(cr *undermoonv1alpha1.Undermoon) []corev1.Volume {
+	if cr.Spec.TLS == nil {
+		return nil
+	}
+	return []corev1.Volume{
+		{
+			Name: tlsVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: tlsSecretName(cr),
+				},
+			},
+		},
+	}
+}
+
+func genTLSCAVolumes(cr *undermoonv1alpha1.Undermoon) []corev1.Volume {
+	if cr.Spec.TLS == nil {
+		return nil
+	}
+	return []corev1.Volume{
+		{
+			Name: tlsCAVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: TLSCAConfigMapName(cr.ObjectMeta.Name),
+					},
+				},
+			},
+		},
+	}
+}
+
+// genServerProxyTLSEnv enables TLS on the port of the server proxy.
+func genServerProxyTLSEnv(cr *undermoonv1alpha1.Undermoon) []corev1.EnvVar {
+	if cr.Spec.TLS == nil {
+		return nil
+	}
+	return []corev1.EnvVar{
+		{
+			Name:  "UNDERMOON_TLS_CERT_FILE",
+			Value: fmt.Sprintf("%s/%s", tlsPath, corev1.TLSCertKey),
+		},
+		{
+			Name:  "UNDERMOON_TLS_KEY_FILE",
+			Value: fmt.Sprintf("%s/%s", tlsPath, corev1.TLSPrivateKeyKey),
+		},
+	}
+}
+
+// genSelfSignedTLSSecret generates a CA and a certificate signed by it
+// for the services and the pods of the storage StatefulSet.
+func genSelfSignedTLSSecret(cr *undermoonv1alpha1.Undermoon) (*corev1.Secret, error) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("%s-ca", cr.ObjectMeta.Name)},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(tlsCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	publicHost := StoragePublicServiceName(cr.ObjectMeta.Name)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano() + 1),
+		Subject:      pkix.Name{CommonName: publicHost},
+		DNSNames: []string{
+			publicHost,
+			fmt.Sprintf("%s.%s", publicHost, cr.Namespace),
+			fmt.Sprintf("%s.%s.svc", publicHost, cr.Namespace),
+			fmt.Sprintf("%s.%s.svc.cluster.local", publicHost, cr.Namespace),
+			// The addresses of the server proxies returned by CLUSTER NODES and CLUSTER SLOTS.
+			genStorageFQDNFromName("*", cr),
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(tlsCertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      TLSSecretName(cr.ObjectMeta.Name),
+			Namespace: cr.Namespace,
+			Labels:    tlsLabels(cr),
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+			corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+			tlsCAKey:                pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		},
+	}, nil
+}
+
+func createTLSCAConfigMap(cr *undermoonv1alpha1.Undermoon, ca []byte) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      TLSCAConfigMapName(cr.ObjectMeta.Name),
+			Namespace: cr.Namespace,
+			Labels:    tlsLabels(cr),
+		},
+		Data: map[string]string{
+			tlsCAKey: string(ca),
+		},
+	}
+}
+
+// createTLS generates the certificate Secret if it's not specified
+// and copies the CA certificate to the ConfigMap for the clients.
+func (con *storageController) createTLS(reqLogger logr.Logger, cr *undermoonv1alpha1.Undermoon) error {
+	if cr.Spec.TLS == nil {
+		return nil
+	}
+
+	secret := &corev1.Secret{}
+	err := con.r.client.Get(context.TODO(), types.NamespacedName{Name: tlsSecretName(cr), Namespace: cr.Namespace}, secret)
+	if err != nil && errors.IsNotFound(err) && cr.Spec.TLS.SecretName == "" {
+		secret, err = genSelfSignedTLSSecret(cr)
+		if err != nil {
+			reqLogger.Error(err, "failed to generate TLS certificates", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return err
+		}
+		if err := controllerutil.SetControllerReference(cr, secret, con.r.scheme); err != nil {
+			return err
+		}
+		reqLogger.Info("Creating a new TLS secret", "Namespace", secret.Namespace, "Name", secret.Name)
+		err = con.r.client.Create(context.TODO(), secret)
+		if err != nil {
+			reqLogger.Error(err, "failed to create TLS secret", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+			return err
+		}
+		con.r.recorder.Eventf(cr, corev1.EventTypeNormal, eventCreatedTLSSecret, "Created self-signed TLS secret %s", secret.Name)
+	} else if err != nil {
+		reqLogger.Error(err, "failed to get TLS secret", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+
+	// The operator and the readiness probe verify the server proxies with the CA in the Secret.
+	for _, key := range []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey, tlsCAKey} {
+		if len(secret.Data[key]) == 0 {
+			return pkgerrors.Errorf("TLS secret %s does not contain %s", secret.Name, key)
+		}
+	}
+	if _, err := genTLSConfig(secret.Data[tlsCAKey]); err != nil {
+		return pkgerrors.Wrapf(err, "invalid %s in TLS secret %s", tlsCAKey, secret.Name)
+	}
+
+	configMap := createTLSCAConfigMap(cr, secret.Data[tlsCAKey])
+	if err := controllerutil.SetControllerReference(cr, configMap, con.r.scheme); err != nil {
+		return err
+	}
+	found := &corev1.ConfigMap{}
+	err = con.r.client.Get(context.TODO(), types.NamespacedName{Name: configMap.Name, Namespace: configMap.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		err = con.r.client.Create(context.TODO(), configMap)
+	} else if err == nil && found.Data[tlsCAKey] != configMap.Data[tlsCAKey] {
+		found.Data = configMap.Data
+		err = con.r.client.Update(context.TODO(), found)
+	}
+	if err != nil {
+		reqLogger.Error(err, "failed to create TLS CA ConfigMap", "Name", cr.ObjectMeta.Name, "ClusterName", cr.Spec.ClusterName)
+		return err
+	}
+	return nil
+}
+
+type tlsConfigCache struct {
+	lock    sync.Mutex
+	configs map[string]*tls.Config
+}
+
+// The clients are recreated when the tls.Config changes,
+// so the same tls.Config needs to be returned for the same CA.
+var proxyTLSConfigCache = &tlsConfigCache{
+	lock:    sync.Mutex{},
+	configs: make(map[string]*tls.Config),
+}
+
+func (cache *tlsConfigCache) get(ca string) (*tls.Config, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if config, ok := cache.configs[ca]; ok {
+		return config, nil
+	}
+
+	config, err := genTLSConfig([]byte(ca))
+	if err != nil {
+		return nil, err
+	}
+	cache.configs[ca] = config
+	return config, nil
+}
+
+// genTLSConfig verifies the certificate chain with the CA but not the host name
+// because the operator connects to the server proxies through different addresses.
+func genTLSConfig(ca []byte) (*tls.Config, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, pkgerrors.New("invalid CA certificate")
+	}
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			if len(certs) == 0 {
+				return pkgerrors.New("no certificate from the server")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}, nil
+}
+
+// getProxyTLSConfig returns nil if TLS is disabled.
+func getProxyTLSConfig(c client.Client, cr *undermoonv1alpha1.Undermoon) (*tls.Config, error) {
+	if cr.Spec.TLS == nil {
+		return nil, nil
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: TLSCAConfigMapName(cr.ObjectMeta.Name), Namespace: cr.Namespace}, configMap)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "failed to get TLS CA ConfigMap")
+	}
+	return proxyTLSConfigCache.get(configMap.Data[tlsCAKey])
+}
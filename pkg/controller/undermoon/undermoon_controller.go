@@ -7,9 +7,13 @@ import (
 	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
 	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
@@ -35,13 +39,16 @@ func Add(mgr manager.Manager) error {
 // newReconciler returns a new reconcile.Reconciler
 func newReconciler(mgr manager.Manager) reconcile.Reconciler {
 	r := &ReconcileUndermoon{
-		client: mgr.GetClient(),
-		scheme: mgr.GetScheme(),
+		client:   mgr.GetClient(),
+		scheme:   mgr.GetScheme(),
+		recorder: mgr.GetEventRecorderFor("undermoon-controller"),
 	}
 	r.brokerCon = newBrokerController(r)
 	r.coodinatorCon = newCoordinatorController(r)
 	r.storageCon = newStorageController(r)
-	r.metaCon = newMetaController()
+	r.metaCon = newMetaController(r)
+	r.restoreCon = newRestoreController(r, kubernetes.NewForConfigOrDie(mgr.GetConfig()))
+	r.authCon = newAuthController(r)
 	return r
 }
 
@@ -69,6 +76,43 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	// The jobs reading the metadata snapshots for restoring the cluster.
+	err = c.Watch(&source.Kind{Type: &batchv1.Job{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &undermoonv1alpha1.Undermoon{},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Rotate the password after the Secret in auth is changed.
+	client := mgr.GetClient()
+	err = c.Watch(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(obj handler.MapObject) []reconcile.Request {
+			return undermoonsUsingSecret(client, obj.Meta.GetNamespace(), obj.Meta.GetName())
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Services need to be watched to revert the changes not made by the operator.
+	err = c.Watch(&source.Kind{Type: &corev1.Service{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &undermoonv1alpha1.Undermoon{},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &policyv1beta1.PodDisruptionBudget{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &undermoonv1alpha1.Undermoon{},
+	})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -81,10 +125,13 @@ type ReconcileUndermoon struct {
 	// that reads objects from the cache and writes to the apiserver
 	client        client.Client
 	scheme        *runtime.Scheme
+	recorder      record.EventRecorder
 	brokerCon     *memBrokerController
 	coodinatorCon *coordinatorController
 	storageCon    *storageController
 	metaCon       *metaController
+	restoreCon    *restoreController
+	authCon       *authController
 }
 
 // Reconcile reads that state of the cluster for a Undermoon object and makes changes based on the state read
@@ -112,14 +159,94 @@ func (r *ReconcileUndermoon) Reconcile(request reconcile.Request) (reconcile.Res
 		return reconcile.Result{}, err
 	}
 
-	resource, err := r.createResources(reqLogger, instance)
+	originalStatus := instance.Status.DeepCopy()
+
+	// The defaulting webhook may not be enabled.
+	resolveDefaultImages(instance)
+	instance.Default()
+
+	initConditions(instance)
+
+	// The validating webhook may not be enabled either.
+	// Don't apply anything from an invalid spec, e.g. a failure quorum greater than the coordinator number
+	// or a changed clusterName, and keep the cluster running with the current config until the spec is fixed.
+	err = instance.ValidateSpec()
+	if err == nil && instance.Status.AppliedImmutableSpec != nil {
+		err = instance.ValidateImmutableSpec(instance.Status.AppliedImmutableSpec)
+	}
 	if err != nil {
-		if err == errRetryReconciliation {
-			return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
+		if !conditionIs(instance, undermoonv1alpha1.UndermoonDegraded, corev1.ConditionTrue, reasonInvalidSpec) {
+			r.recorder.Event(instance, corev1.EventTypeWarning, eventInvalidSpec, err.Error())
+		}
+		setDegraded(instance, reasonInvalidSpec, err)
+		return reconcile.Result{}, r.updateStatus(reqLogger, instance, originalStatus)
+	}
+	// The existing clusters are running with the current spec.
+	if instance.Status.AppliedImmutableSpec == nil {
+		instance.Status.AppliedImmutableSpec = instance.GenImmutableSpec()
+	}
+
+	result, err := r.reconcileUndermoon(reqLogger, instance)
+	if err != nil && err != errRetryReconciliation {
+		setDegraded(instance, reasonReconcileFailed, err)
+		r.recorder.Event(instance, corev1.EventTypeWarning, eventReconcileFailed, err.Error())
+	}
+
+	statusErr := r.updateStatus(reqLogger, instance, originalStatus)
+	if err == nil && statusErr != nil {
+		err = statusErr
+	}
+	if err == errRetryReconciliation {
+		return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
+	}
+	return result, err
+}
+
+// The spec defaulted here is not persisted,
+// so the default images are kept in the status to avoid restarting the pods
+// after the default images of the operator are changed.
+func resolveDefaultImages(cr *undermoonv1alpha1.Undermoon) {
+	if cr.Spec.UndermoonImage == "" {
+		if cr.Status.DefaultUndermoonImage == "" {
+			cr.Status.DefaultUndermoonImage = undermoonv1alpha1.DefaultUndermoonImage
 		}
+		cr.Spec.UndermoonImage = cr.Status.DefaultUndermoonImage
+	}
+	if cr.Spec.RedisImage == "" {
+		if cr.Status.DefaultRedisImage == "" {
+			cr.Status.DefaultRedisImage = undermoonv1alpha1.DefaultRedisImage
+		}
+		cr.Spec.RedisImage = cr.Status.DefaultRedisImage
+	}
+}
+
+func (r *ReconcileUndermoon) reconcileUndermoon(reqLogger logr.Logger, instance *undermoonv1alpha1.Undermoon) (reconcile.Result, error) {
+	err := r.restoreCon.prepareRestore(reqLogger, instance)
+	if err == errRestoreFailed {
+		// Don't create the cluster from a broken backup.
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
 		return reconcile.Result{}, err
 	}
 
+	// The existing clusters are running with the maxMemory in the spec.
+	if instance.Status.MaxMemory == 0 {
+		instance.Status.MaxMemory = instance.Spec.MaxMemory
+	}
+
+	resource, err := r.createResources(reqLogger, instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	instance.Status.DesiredChunkNumber = instance.Spec.ChunkNumber
+	readyProxyNumber, err := r.storageCon.getReadyProxyNumber(instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	instance.Status.ReadyProxyNumber = readyProxyNumber
+
 	ready, err := r.brokerAndCoordinatorReady(resource, reqLogger, instance)
 	if err != nil {
 		return reconcile.Result{}, err
@@ -130,12 +257,23 @@ func (r *ReconcileUndermoon) Reconcile(request reconcile.Request) (reconcile.Res
 
 	masterBrokerAddress, replicaAddresses, err := r.brokerCon.reconcileMaster(reqLogger, instance, resource.brokerService)
 	if err != nil {
-		if err == errRetryReconciliation {
-			return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
-		}
 		return reconcile.Result{}, err
 	}
 
+	err = r.brokerCon.reconcileConfig(reqLogger, instance, resource.brokerService)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// The operator clients below use the old password until the rotation is done.
+	rotating, err := r.authCon.rotatePassword(reqLogger, instance, resource.storageStatefulSet, resource.coordinatorService)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if rotating {
+		return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
+	}
+
 	err = r.coodinatorCon.configSetBroker(reqLogger, instance, resource.coordinatorService, masterBrokerAddress)
 	if err != nil {
 		return reconcile.Result{}, err
@@ -161,13 +299,71 @@ func (r *ReconcileUndermoon) Reconcile(request reconcile.Request) (reconcile.Res
 		return reconcile.Result{}, err
 	}
 
+	// The broker metadata needs to be restored before registering the server proxies.
+	err = r.restoreCon.restoreMetadata(reqLogger, instance, resource.storageStatefulSet, masterBrokerAddress)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
 	info, err := r.metaCon.reconcileMeta(reqLogger, masterBrokerAddress, replicaAddresses, proxies, instance, storageAllReady)
 	if err != nil {
-		if err == errRetryReconciliation {
-			return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
+		return reconcile.Result{}, err
+	}
+	setClusterInfoStatus(instance, info)
+
+	// The pods being created or restarted load the new config file by themselves.
+	if storageAllReady {
+		err = r.storageCon.reconcileRedisConfig(reqLogger, instance, resource.storageStatefulSet)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		refused, err := r.storageCon.resizeMaxMemory(reqLogger, instance, resource.storageStatefulSet)
+		if err != nil {
+			return reconcile.Result{}, err
 		}
+		if refused {
+			return reconcile.Result{Requeue: true, RequeueAfter: 10 * time.Second}, nil
+		}
+	}
+
+	// Upgrade the control plane before the storage.
+	upgrading, err := r.brokerCon.upgradeBroker(reqLogger, instance, resource.brokerStatefulSet, resource.brokerService, masterBrokerAddress)
+	if err != nil {
 		return reconcile.Result{}, err
 	}
+	if upgrading {
+		return reconcile.Result{Requeue: true, RequeueAfter: 5 * time.Second}, nil
+	}
+	upgrading, err = r.coodinatorCon.upgradeCoordinator(reqLogger, instance, resource.coordinatorStatefulSet, resource.coordinatorService)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if upgrading {
+		return reconcile.Result{Requeue: true, RequeueAfter: 5 * time.Second}, nil
+	}
+
+	scaling, err := r.brokerCon.scaleBroker(reqLogger, instance, resource.brokerStatefulSet, resource.brokerService, masterBrokerAddress)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if scaling {
+		return reconcile.Result{Requeue: true, RequeueAfter: 5 * time.Second}, nil
+	}
+	scaling, err = r.coodinatorCon.scaleCoordinator(reqLogger, instance, resource.coordinatorStatefulSet)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if scaling {
+		return reconcile.Result{Requeue: true, RequeueAfter: 5 * time.Second}, nil
+	}
+
+	upgrading, err = r.storageCon.upgradeStorage(reqLogger, instance, resource.storageStatefulSet, masterBrokerAddress, info)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if upgrading {
+		return reconcile.Result{Requeue: true, RequeueAfter: 5 * time.Second}, nil
+	}
 
 	// Before scaling, we need to wait for those TERMINATING pods to be killed completely.
 	storageAllReadyAndStable, err := r.storageCon.storageAllReadyAndStable(resource.storageService, resource.storageStatefulSet, instance)
@@ -175,14 +371,12 @@ func (r *ReconcileUndermoon) Reconcile(request reconcile.Request) (reconcile.Res
 		return reconcile.Result{}, err
 	}
 	if !storageAllReadyAndStable {
+		setProgressing(instance, reasonStorageNotStable, "waiting for the storage StatefulSet to become stable")
 		return reconcile.Result{Requeue: true, RequeueAfter: 10 * time.Second}, nil
 	}
 
 	err = r.metaCon.changeMeta(reqLogger, masterBrokerAddress, instance, info)
 	if err != nil {
-		if err == errRetryReconciliation {
-			return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
-		}
 		return reconcile.Result{}, err
 	}
 
@@ -190,20 +384,16 @@ func (r *ReconcileUndermoon) Reconcile(request reconcile.Request) (reconcile.Res
 	proxies = []serverProxyMeta{}
 	info, err = r.metaCon.reconcileMeta(reqLogger, masterBrokerAddress, replicaAddresses, proxies, instance, storageAllReady)
 	if err != nil {
-		if err == errRetryReconciliation {
-			return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
-		}
 		return reconcile.Result{}, err
 	}
+	setClusterInfoStatus(instance, info)
 
 	resource.storageStatefulSet, err = r.storageCon.scaleDownStorageStatefulSet(reqLogger, instance, resource.storageStatefulSet, info)
 	if err != nil {
-		if err == errRetryReconciliation {
-			return reconcile.Result{Requeue: true, RequeueAfter: 3 * time.Second}, nil
-		}
 		return reconcile.Result{}, err
 	}
 
+	setClusterReady(instance)
 	return reconcile.Result{}, nil
 }
 
@@ -235,6 +425,11 @@ func (r *ReconcileUndermoon) createResources(reqLogger logr.Logger, instance *un
 		return nil, err
 	}
 
+	err = r.reconcilePodDisruptionBudgets(reqLogger, instance)
+	if err != nil {
+		return nil, err
+	}
+
 	return &umResource{
 		brokerStatefulSet:      brokerStatefulSet,
 		coordinatorStatefulSet: coordinatorStatefulSet,
@@ -253,8 +448,12 @@ func (r *ReconcileUndermoon) brokerAndCoordinatorReady(resource *umResource, req
 	}
 	if !ready {
 		reqLogger.Info("broker statefulset not ready", "Name", instance.ObjectMeta.Name, "ClusterName", instance.Spec.ClusterName)
+		msg := "waiting for the broker statefulset to be ready"
+		setCondition(instance, undermoonv1alpha1.UndermoonBrokerAvailable, corev1.ConditionFalse, reasonBrokerNotReady, msg)
+		setProgressing(instance, reasonBrokerNotReady, msg)
 		return false, nil
 	}
+	setCondition(instance, undermoonv1alpha1.UndermoonBrokerAvailable, corev1.ConditionTrue, reasonBrokerReady, "the broker statefulset is ready")
 
 	ready, err = r.coodinatorCon.coordinatorReady(resource.coordinatorStatefulSet, resource.coordinatorService)
 	if err != nil {
@@ -263,6 +462,7 @@ func (r *ReconcileUndermoon) brokerAndCoordinatorReady(resource *umResource, req
 	}
 	if !ready {
 		reqLogger.Info("coordinator statefulset not ready", "Name", instance.ObjectMeta.Name, "ClusterName", instance.Spec.ClusterName)
+		setProgressing(instance, reasonCoordinatorNotReady, "waiting for the coordinator statefulset to be ready")
 		return false, nil
 	}
 
@@ -0,0 +1,125 @@
+package undermoon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/doyoubi/undermoon-operator/pkg/apis"
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func newTestReconciler(t *testing.T, objs ...runtime.Object) *ReconcileUndermoon {
+	s := runtime.NewScheme()
+	if err := scheme.AddToScheme(s); err != nil {
+		t.Fatalf("failed to add scheme: %v", err)
+	}
+	if err := apis.AddToScheme(s); err != nil {
+		t.Fatalf("failed to add undermoon scheme: %v", err)
+	}
+	r := &ReconcileUndermoon{
+		client:   fake.NewFakeClientWithScheme(s, objs...),
+		scheme:   s,
+		recorder: record.NewFakeRecorder(100),
+	}
+	r.brokerCon = newBrokerController(r)
+	r.coodinatorCon = newCoordinatorController(r)
+	r.storageCon = newStorageController(r)
+	r.metaCon = newMetaController(r)
+	r.restoreCon = newRestoreController(r, kubefake.NewSimpleClientset())
+	r.authCon = newAuthController(r)
+	return r
+}
+
+func TestReconcileImmutableSpecChanged(t *testing.T) {
+	size := resource.MustParse("1Gi")
+	cases := []struct {
+		name   string
+		modify func(spec *undermoonv1alpha1.UndermoonSpec)
+	}{
+		{name: "clusterName", modify: func(spec *undermoonv1alpha1.UndermoonSpec) { spec.ClusterName = "renamed" }},
+		{name: "port", modify: func(spec *undermoonv1alpha1.UndermoonSpec) { spec.Port = 6379 }},
+		{
+			name: "persistence",
+			modify: func(spec *undermoonv1alpha1.UndermoonSpec) {
+				spec.Persistence = &undermoonv1alpha1.PersistenceSpec{Size: size}
+			},
+		},
+		{name: "tls", modify: func(spec *undermoonv1alpha1.UndermoonSpec) { spec.TLS = &undermoonv1alpha1.TLSSpec{} }},
+	}
+
+	for _, c := range cases {
+		cr := newTestUndermoon()
+		cr.Default()
+		cr.Status.AppliedImmutableSpec = cr.GenImmutableSpec()
+		c.modify(&cr.Spec)
+
+		r := newTestReconciler(t, cr)
+		request := reconcile.Request{NamespacedName: types.NamespacedName{Name: cr.ObjectMeta.Name, Namespace: cr.Namespace}}
+		if _, err := r.Reconcile(request); err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+
+		found := &undermoonv1alpha1.Undermoon{}
+		if err := r.client.Get(context.TODO(), request.NamespacedName, found); err != nil {
+			t.Fatalf("%s: failed to get undermoon: %v", c.name, err)
+		}
+		if !conditionIs(found, undermoonv1alpha1.UndermoonDegraded, corev1.ConditionTrue, reasonInvalidSpec) {
+			t.Errorf("%s: expected Degraded with %s, got %+v", c.name, reasonInvalidSpec, found.Status.Conditions)
+		}
+		if found.Status.AppliedImmutableSpec.ClusterName != "test-cluster" {
+			t.Errorf("%s: expected the applied spec to be kept, got %+v", c.name, found.Status.AppliedImmutableSpec)
+		}
+
+		// Nothing should be generated from the changed spec.
+		storage := &appsv1.StatefulSet{}
+		err := r.client.Get(context.TODO(), types.NamespacedName{Name: StorageStatefulSetName(cr.ObjectMeta.Name), Namespace: cr.Namespace}, storage)
+		if !errors.IsNotFound(err) {
+			t.Errorf("%s: expected the storage StatefulSet not to be created, got %v", c.name, err)
+		}
+	}
+}
+
+func TestReconcileRecordImmutableSpec(t *testing.T) {
+	cr := newTestUndermoon()
+	// Stop the reconciliation before creating the resources.
+	cr.Spec.BrokerConfig.FailureQuorum = 10
+
+	r := newTestReconciler(t, cr)
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Name: cr.ObjectMeta.Name, Namespace: cr.Namespace}}
+	if _, err := r.Reconcile(request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	found := &undermoonv1alpha1.Undermoon{}
+	if err := r.client.Get(context.TODO(), request.NamespacedName, found); err != nil {
+		t.Fatalf("failed to get undermoon: %v", err)
+	}
+	if found.Status.AppliedImmutableSpec != nil {
+		t.Errorf("expected the invalid spec not to be recorded, got %+v", found.Status.AppliedImmutableSpec)
+	}
+
+	found.Spec.BrokerConfig.FailureQuorum = 0
+	if err := r.client.Update(context.TODO(), found); err != nil {
+		t.Fatalf("failed to update undermoon: %v", err)
+	}
+	// The reconciliation can't go further since the brokers are not running in the test.
+	_, _ = r.Reconcile(request)
+	if err := r.client.Get(context.TODO(), request.NamespacedName, found); err != nil {
+		t.Fatalf("failed to get undermoon: %v", err)
+	}
+	applied := found.Status.AppliedImmutableSpec
+	if applied == nil || applied.ClusterName != "test-cluster" || applied.Port != DefaultServerProxyPort {
+		t.Errorf("expected the applied spec to be recorded, got %+v", applied)
+	}
+}
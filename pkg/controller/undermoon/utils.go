@@ -2,13 +2,23 @@ package undermoon
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
+	undermoonv1alpha1 "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	"github.com/go-logr/logr"
 	"github.com/go-redis/redis/v8"
 	pkgerrors "github.com/pkg/errors"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -52,6 +62,126 @@ func createStatefulSetGuard(createFunc func() (*appsv1.StatefulSet, error)) (*ap
 	return nil, err
 }
 
+// This annotation stores the hash of the generated spec
+// so that we can tell whether the owned objects need to be updated.
+const specHashAnnotation = "undermoon.operator.api/spec-hash"
+
+func computeHash(obj interface{}) (string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	hasher := fnv.New64a()
+	_, err = hasher.Write(data)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(hasher.Sum64(), 16), nil
+}
+
+func setSpecHashAnnotation(meta *metav1.ObjectMeta, hash string) {
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[specHashAnnotation] = hash
+}
+
+// Only the pod template and the update strategy of the StatefulSet are allowed to be updated.
+// The replica number is left to the scaling logic.
+func statefulSetSpecHash(ss *appsv1.StatefulSet) (string, error) {
+	return computeHash(struct {
+		Template       corev1.PodTemplateSpec
+		UpdateStrategy appsv1.StatefulSetUpdateStrategy
+	}{
+		Template:       ss.Spec.Template,
+		UpdateStrategy: ss.Spec.UpdateStrategy,
+	})
+}
+
+func serviceSpecHash(svc *corev1.Service) (string, error) {
+	return computeHash(struct {
+		Ports                    []corev1.ServicePort
+		Selector                 map[string]string
+		PublishNotReadyAddresses bool
+	}{
+		Ports:                    svc.Spec.Ports,
+		Selector:                 svc.Spec.Selector,
+		PublishNotReadyAddresses: svc.Spec.PublishNotReadyAddresses,
+	})
+}
+
+// The apiserver fills in the default values,
+// so only the fields set in the generated objects are compared to find the changes not made by the operator.
+func statefulSetDrifted(found, desired *appsv1.StatefulSet) bool {
+	return !equality.Semantic.DeepDerivative(desired.Spec.Template, found.Spec.Template) ||
+		!equality.Semantic.DeepDerivative(desired.Spec.UpdateStrategy, found.Spec.UpdateStrategy)
+}
+
+func serviceDrifted(found, desired *corev1.Service) bool {
+	return len(desired.Spec.Ports) != len(found.Spec.Ports) ||
+		!equality.Semantic.DeepDerivative(desired.Spec.Ports, found.Spec.Ports) ||
+		!reflect.DeepEqual(desired.Spec.Selector, found.Spec.Selector) ||
+		desired.Spec.PublishNotReadyAddresses != found.Spec.PublishNotReadyAddresses
+}
+
+// updateStatefulSetIfChanged patches the existing StatefulSet when the generated one differs
+// or it has been changed manually.
+// The desired StatefulSet should already have the spec hash annotation.
+func updateStatefulSetIfChanged(c client.Client, reqLogger logr.Logger, found, desired *appsv1.StatefulSet) (*appsv1.StatefulSet, bool, error) {
+	desiredHash := desired.ObjectMeta.Annotations[specHashAnnotation]
+	if found.ObjectMeta.Annotations[specHashAnnotation] == desiredHash && !statefulSetDrifted(found, desired) {
+		return found, false, nil
+	}
+
+	reqLogger.Info("Updating statefulset", "Namespace", found.Namespace, "Name", found.Name, "hash", desiredHash)
+	updated := found.DeepCopy()
+	updated.ObjectMeta.Labels = desired.ObjectMeta.Labels
+	setSpecHashAnnotation(&updated.ObjectMeta, desiredHash)
+	updated.Spec.Template = desired.Spec.Template
+	updated.Spec.UpdateStrategy = desired.Spec.UpdateStrategy
+
+	err := c.Update(context.TODO(), updated)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on updating statefulset. Try again.", "Name", found.Name)
+			return nil, false, errRetryReconciliation
+		}
+		reqLogger.Error(err, "failed to update statefulset", "Name", found.Name)
+		return nil, false, err
+	}
+	return updated, true, nil
+}
+
+// updateServiceIfChanged patches the existing Service when the generated one differs
+// or it has been changed manually.
+// The desired Service should already have the spec hash annotation.
+func updateServiceIfChanged(c client.Client, reqLogger logr.Logger, found, desired *corev1.Service) (*corev1.Service, bool, error) {
+	desiredHash := desired.ObjectMeta.Annotations[specHashAnnotation]
+	if found.ObjectMeta.Annotations[specHashAnnotation] == desiredHash && !serviceDrifted(found, desired) {
+		return found, false, nil
+	}
+
+	reqLogger.Info("Updating service", "Namespace", found.Namespace, "Name", found.Name, "hash", desiredHash)
+	updated := found.DeepCopy()
+	updated.ObjectMeta.Labels = desired.ObjectMeta.Labels
+	setSpecHashAnnotation(&updated.ObjectMeta, desiredHash)
+	// ClusterIP is immutable and might be allocated by the apiserver.
+	updated.Spec.Ports = desired.Spec.Ports
+	updated.Spec.Selector = desired.Spec.Selector
+	updated.Spec.PublishNotReadyAddresses = desired.Spec.PublishNotReadyAddresses
+
+	err := c.Update(context.TODO(), updated)
+	if err != nil {
+		if errors.IsConflict(err) {
+			reqLogger.Info("Conflict on updating service. Try again.", "Name", found.Name)
+			return nil, false, errRetryReconciliation
+		}
+		reqLogger.Error(err, "failed to update service", "Name", found.Name)
+		return nil, false, err
+	}
+	return updated, true, nil
+}
+
 func getEndpoints(client client.Client, serviceName, namespace string) ([]corev1.EndpointAddress, error) {
 	endpoints := &corev1.Endpoints{}
 	// The endpoints names are the same as serviceName
@@ -108,40 +238,99 @@ func newRedisClientPool() *redisClientPool {
 	}
 }
 
-func (pool *redisClientPool) getClient(redisAddress string) *redis.Client {
+func (pool *redisClientPool) getClient(redisAddress, password string) *redis.Client {
+	return pool.getTLSClient(redisAddress, password, nil)
+}
+
+// getTLSClient uses TLS if tlsConfig is not nil.
+func (pool *redisClientPool) getTLSClient(redisAddress, password string, tlsConfig *tls.Config) *redis.Client {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
 	if client, ok := pool.clients[redisAddress]; ok {
-		return client
+		options := client.Options()
+		if options.Password == password && options.TLSConfig == tlsConfig {
+			return client
+		}
+		// The connections authenticated with the old password can't be reused.
+		client.Close()
 	}
 
 	client := redis.NewClient(&redis.Options{
-		Addr: redisAddress,
+		Addr:      redisAddress,
+		Password:  password,
+		TLSConfig: tlsConfig,
 	})
 	pool.clients[redisAddress] = client
 	return client
 }
 
-func genAntiAffinity(labels map[string]string, namespace, topologyKey string) *corev1.Affinity {
+// genAntiAffinity spreads the pods with the same labels according to the placement.
+func genAntiAffinity(labels map[string]string, namespace string, placement *undermoonv1alpha1.PlacementSpec) *corev1.Affinity {
+	term := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{
+			MatchLabels: labels,
+		},
+		Namespaces:  []string{namespace},
+		TopologyKey: placement.AntiAffinityTopologyKey,
+	}
+	if placement.AntiAffinityMode == undermoonv1alpha1.RequiredAntiAffinity {
+		return &corev1.Affinity{
+			PodAntiAffinity: &corev1.PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{term},
+			},
+		}
+	}
 	return &corev1.Affinity{
 		PodAntiAffinity: &corev1.PodAntiAffinity{
 			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
 				{
-					Weight: 2,
-					PodAffinityTerm: corev1.PodAffinityTerm{
-						LabelSelector: &metav1.LabelSelector{
-							MatchLabels: labels,
-						},
-						Namespaces:  []string{namespace},
-						TopologyKey: topologyKey,
-					},
+					Weight:          2,
+					PodAffinityTerm: term,
 				},
 			},
 		},
 	}
 }
 
+func genTopologySpreadConstraints(labels map[string]string, placement *undermoonv1alpha1.PlacementSpec) []corev1.TopologySpreadConstraint {
+	if len(placement.TopologySpreadConstraints) == 0 {
+		return nil
+	}
+	constraints := []corev1.TopologySpreadConstraint{}
+	for _, constraint := range placement.TopologySpreadConstraints {
+		constraints = append(constraints, corev1.TopologySpreadConstraint{
+			MaxSkew:           constraint.MaxSkew,
+			TopologyKey:       constraint.TopologyKey,
+			WhenUnsatisfiable: constraint.WhenUnsatisfiable,
+			LabelSelector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+		})
+	}
+	return constraints
+}
+
+// applyPodSettings sets the scheduling and the metadata of the pod settings to the pod template.
+// The labels of the operator take precedence over the extra ones.
+func applyPodSettings(template *corev1.PodTemplateSpec, settings *undermoonv1alpha1.PodSettings) {
+	labels := map[string]string{}
+	for k, v := range settings.Labels {
+		labels[k] = v
+	}
+	for k, v := range template.ObjectMeta.Labels {
+		labels[k] = v
+	}
+	template.ObjectMeta.Labels = labels
+	template.ObjectMeta.Annotations = settings.Annotations
+
+	template.Spec.NodeSelector = settings.NodeSelector
+	template.Spec.Tolerations = settings.Tolerations
+	template.Spec.PriorityClassName = settings.PriorityClassName
+	template.Spec.ImagePullSecrets = settings.ImagePullSecrets
+	template.Spec.ServiceAccountName = settings.ServiceAccountName
+}
+
 func genPreStopHookLifeCycle(cmd []string) *corev1.Lifecycle {
 	return &corev1.Lifecycle{
 		PreStop: &corev1.Handler{
@@ -149,3 +338,128 @@ func genPreStopHookLifeCycle(cmd []string) *corev1.Lifecycle {
 		},
 	}
 }
+
+type replicationInfo struct {
+	role             string
+	masterReplOffset int64
+	replicaOffsets   []int64
+}
+
+// parseReplicationInfo parses the result of `INFO replication`.
+func parseReplicationInfo(info string) (*replicationInfo, error) {
+	replInfo := &replicationInfo{}
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], kv[1]
+		switch {
+		case key == "role":
+			replInfo.role = value
+		case key == "master_repl_offset":
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, pkgerrors.Errorf("invalid master_repl_offset: %s", value)
+			}
+			replInfo.masterReplOffset = offset
+		case strings.HasPrefix(key, "slave") && strings.Contains(value, "offset="):
+			// slave0:ip=127.0.0.1,port=7002,state=online,offset=1234,lag=0
+			for _, field := range strings.Split(value, ",") {
+				if !strings.HasPrefix(field, "offset=") {
+					continue
+				}
+				offset, err := strconv.ParseInt(strings.TrimPrefix(field, "offset="), 10, 64)
+				if err != nil {
+					return nil, pkgerrors.Errorf("invalid replica offset: %s", value)
+				}
+				replInfo.replicaOffsets = append(replInfo.replicaOffsets, offset)
+			}
+		}
+	}
+	return replInfo, nil
+}
+
+// parseUsedMemory returns the used_memory in INFO memory.
+func parseUsedMemory(info string) (int64, error) {
+	for _, line := range strings.Split(info, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) != 2 || kv[0] != "used_memory" {
+			continue
+		}
+		usedMemory, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil {
+			return 0, pkgerrors.Errorf("invalid used_memory: %s", kv[1])
+		}
+		return usedMemory, nil
+	}
+	return 0, pkgerrors.New("used_memory not found")
+}
+
+func podIsReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podOrdinal returns the index of the pod in the StatefulSet.
+func podOrdinal(podName string) (int, error) {
+	indexStr := podName[strings.LastIndex(podName, "-")+1:]
+	index, err := strconv.ParseInt(indexStr, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int(index), nil
+}
+
+// getStatefulSetPods returns the pods sorted by the ordinal in descending order
+// like what the StatefulSet controller does.
+// The pods waiting to be scaled down are not included.
+func getStatefulSetPods(c client.Client, ss *appsv1.StatefulSet) ([]corev1.Pod, error) {
+	podList := &corev1.PodList{}
+	err := c.List(
+		context.TODO(),
+		podList,
+		client.InNamespace(ss.Namespace),
+		client.MatchingLabels(ss.Spec.Selector.MatchLabels),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := int(*ss.Spec.Replicas)
+	pods := []corev1.Pod{}
+	for _, pod := range podList.Items {
+		index, err := podOrdinal(pod.ObjectMeta.Name)
+		if err != nil || index >= replicas {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+
+	sort.Slice(pods, func(i, j int) bool {
+		a, _ := podOrdinal(pods[i].ObjectMeta.Name)
+		b, _ := podOrdinal(pods[j].ObjectMeta.Name)
+		return a > b
+	})
+	return pods, nil
+}
+
+func podOutdated(pod *corev1.Pod, targetRevision string) bool {
+	return pod.ObjectMeta.Labels[appsv1.StatefulSetRevisionLabel] != targetRevision
+}
+
+func deletePodForUpgrade(c client.Client, pod *corev1.Pod) error {
+	if pod.ObjectMeta.DeletionTimestamp != nil {
+		return nil
+	}
+	err := c.Delete(context.TODO(), pod)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package undermoon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReplicationInfo(t *testing.T) {
+	cases := []struct {
+		name     string
+		info     string
+		expected *replicationInfo
+		err      bool
+	}{
+		{
+			name: "master with replicas",
+			info: "# Replication\r\nrole:master\r\nconnected_slaves:2\r\n" +
+				"slave0:ip=10.0.0.1,port=7002,state=online,offset=1234,lag=0\r\n" +
+				"slave1:ip=10.0.0.2,port=7002,state=online,offset=1000,lag=1\r\n" +
+				"master_replid:abc\r\nmaster_repl_offset:1300\r\n",
+			expected: &replicationInfo{
+				role:             "master",
+				masterReplOffset: 1300,
+				replicaOffsets:   []int64{1234, 1000},
+			},
+		},
+		{
+			name: "master without replicas",
+			info: "role:master\r\nconnected_slaves:0\r\nmaster_repl_offset:42\r\n",
+			expected: &replicationInfo{
+				role:             "master",
+				masterReplOffset: 42,
+			},
+		},
+		{
+			name: "replica",
+			info: "role:slave\r\nmaster_host:10.0.0.1\r\nslave_repl_offset:100\r\nslave_priority:100\r\nmaster_repl_offset:100\r\n",
+			expected: &replicationInfo{
+				role:             "slave",
+				masterReplOffset: 100,
+			},
+		},
+		{
+			name: "invalid master offset",
+			info: "role:master\r\nmaster_repl_offset:abc\r\n",
+			err:  true,
+		},
+		{
+			name: "invalid replica offset",
+			info: "role:master\r\nslave0:ip=10.0.0.1,port=7002,state=online,offset=x,lag=0\r\n",
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		replInfo, err := parseReplicationInfo(c.info)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", c.name, replInfo)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(replInfo, c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.expected, replInfo)
+		}
+	}
+}
+
+func TestParseUsedMemory(t *testing.T) {
+	cases := []struct {
+		name     string
+		info     string
+		expected int64
+		err      bool
+	}{
+		{
+			name:     "memory",
+			info:     "# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\nused_memory_rss:2097152\r\n",
+			expected: 1048576,
+		},
+		{name: "not found", info: "# Memory\r\nused_memory_rss:2097152\r\n", err: true},
+		{name: "invalid", info: "used_memory:1.00M\r\n", err: true},
+	}
+
+	for _, c := range cases {
+		usedMemory, err := parseUsedMemory(c.info)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %d", c.name, usedMemory)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if usedMemory != c.expected {
+			t.Errorf("%s: expected %d, got %d", c.name, c.expected, usedMemory)
+		}
+	}
+}
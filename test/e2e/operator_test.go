@@ -89,6 +89,19 @@ func undermoonScaleTest(t *testing.T, f *framework.Framework, ctx *framework.Tes
 		return err
 	}
 
+	// wait for the status to report the cluster with 1 chunk ready
+	err = waitForUndermoonReady(t, f, namespace, testUndermoonName, 1, retryInterval, timeout)
+	if err != nil {
+		return err
+	}
+
+	// wait for the storage PodDisruptionBudget to allow only 1 pod to be evicted
+	storagePDBName := umctrl.StoragePodDisruptionBudgetName(testUndermoonName)
+	err = waitForPodDisruptionBudget(t, f.KubeClient, namespace, storagePDBName, 1, retryInterval, timeout)
+	if err != nil {
+		return err
+	}
+
 	// scale up to 2 chunks and 4 replicas
 	err = f.Client.Get(goctx.TODO(), types.NamespacedName{Name: testUndermoonName, Namespace: namespace}, exampleUndermoon)
 	if err != nil {
@@ -118,6 +131,18 @@ func undermoonScaleTest(t *testing.T, f *framework.Framework, ctx *framework.Tes
 		return err
 	}
 
+	// wait for the slots to be migrated to the 2 chunks
+	err = waitForUndermoonReady(t, f, namespace, testUndermoonName, 2, retryInterval, timeout)
+	if err != nil {
+		return err
+	}
+
+	// wait for the storage PodDisruptionBudget to follow the new replicas
+	err = waitForPodDisruptionBudget(t, f.KubeClient, namespace, storagePDBName, 3, retryInterval, timeout)
+	if err != nil {
+		return err
+	}
+
 	// scale down to 1 chunks and 2 replicas
 	err = f.Client.Get(goctx.TODO(), types.NamespacedName{Name: testUndermoonName, Namespace: namespace}, exampleUndermoon)
 	if err != nil {
@@ -147,6 +172,39 @@ func undermoonScaleTest(t *testing.T, f *framework.Framework, ctx *framework.Tes
 		return err
 	}
 
+	// wait for the status to report the cluster with 1 chunk ready
+	err = waitForUndermoonReady(t, f, namespace, testUndermoonName, 1, retryInterval, timeout)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func undermoonDriftTest(t *testing.T, f *framework.Framework, ctx *framework.TestCtx) error {
+	namespace, err := ctx.GetNamespace()
+	if err != nil {
+		return fmt.Errorf("could not get namespace: %v", err)
+	}
+
+	// change the storage service manually
+	storageServiceName := umctrl.StorageServiceName(testUndermoonName)
+	service, err := f.KubeClient.CoreV1().Services(namespace).Get(storageServiceName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	service.Spec.PublishNotReadyAddresses = false
+	_, err = f.KubeClient.CoreV1().Services(namespace).Update(service)
+	if err != nil {
+		return err
+	}
+
+	// wait for the operator to revert the change
+	err = waitForServicePublishNotReadyAddresses(t, f.KubeClient, namespace, storageServiceName, true, retryInterval, timeout)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -174,4 +232,8 @@ func UndermoonCluster(t *testing.T) {
 	if err = undermoonScaleTest(t, f, ctx); err != nil {
 		t.Fatal(err)
 	}
+
+	if err = undermoonDriftTest(t, f, ctx); err != nil {
+		t.Fatal(err)
+	}
 }
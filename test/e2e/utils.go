@@ -1,11 +1,16 @@
 package e2e
 
 import (
+	goctx "context"
 	"testing"
 	"time"
 
+	operator "github.com/doyoubi/undermoon-operator/pkg/apis/undermoon/v1alpha1"
+	framework "github.com/operator-framework/operator-sdk/pkg/test"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 )
@@ -66,3 +71,85 @@ func waitForServiceEndpoints(t *testing.T, kubeclient kubernetes.Interface, name
 	t.Logf("Service %s is ready\n", name)
 	return nil
 }
+
+func waitForUndermoonReady(t *testing.T, f *framework.Framework, namespace, name string, chunkNumber uint32, retryInterval, timeout time.Duration) error {
+	err := wait.Poll(retryInterval, timeout, func() (done bool, err error) {
+		cr := &operator.Undermoon{}
+		err = f.Client.Get(goctx.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, cr)
+		if err != nil {
+			return false, err
+		}
+
+		if cr.Status.ObservedGeneration != cr.ObjectMeta.Generation {
+			t.Logf("Waiting for %s Undermoon to observe generation %d (%d)\n", name, cr.ObjectMeta.Generation, cr.Status.ObservedGeneration)
+			return false, nil
+		}
+
+		ready := false
+		for _, cond := range cr.Status.Conditions {
+			if cond.Type == operator.UndermoonReady && cond.Status == corev1.ConditionTrue {
+				ready = true
+			}
+		}
+		if ready && cr.Status.CurrentChunkNumber == chunkNumber && !cr.Status.IsMigrating {
+			return true, nil
+		}
+		t.Logf("Waiting for %s Undermoon to be ready (%d/%d chunks)\n", name, cr.Status.CurrentChunkNumber, chunkNumber)
+		return false, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	t.Logf("Undermoon %s is ready\n", name)
+	return nil
+}
+
+func waitForPodDisruptionBudget(t *testing.T, kubeclient kubernetes.Interface, namespace, name string, minAvailable int, retryInterval, timeout time.Duration) error {
+	err := wait.Poll(retryInterval, timeout, func() (done bool, err error) {
+		pdb, err := kubeclient.PolicyV1beta1().PodDisruptionBudgets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				t.Logf("Waiting for availability of %s PodDisruptionBudget\n", name)
+				return false, nil
+			}
+			return false, err
+		}
+
+		if pdb.Spec.MinAvailable != nil && pdb.Spec.MinAvailable.IntValue() == minAvailable {
+			return true, nil
+		}
+		t.Logf("Waiting for %s PodDisruptionBudget (minAvailable %v/%d)\n", name, pdb.Spec.MinAvailable, minAvailable)
+		return false, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	t.Logf("PodDisruptionBudget %s is ready\n", name)
+	return nil
+}
+
+func waitForServicePublishNotReadyAddresses(t *testing.T, kubeclient kubernetes.Interface, namespace, name string, publishNotReadyAddresses bool, retryInterval, timeout time.Duration) error {
+	err := wait.Poll(retryInterval, timeout, func() (done bool, err error) {
+		service, err := kubeclient.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		if service.Spec.PublishNotReadyAddresses == publishNotReadyAddresses {
+			return true, nil
+		}
+		t.Logf("Waiting for %s Service to be reverted\n", name)
+		return false, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	t.Logf("Service %s is reverted\n", name)
+	return nil
+}